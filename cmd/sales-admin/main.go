@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
 	"github.com/wgarcia4190/garagesale/internal/platform/conf"
 	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/seal"
+	"github.com/wgarcia4190/garagesale/internal/product"
 	"github.com/wgarcia4190/garagesale/internal/schema"
 	"github.com/wgarcia4190/garagesale/internal/user"
 )
@@ -71,7 +79,13 @@ func run() error {
 	case "useradd":
 		err = useradd(dbConfig, cfg.Args.Num(1), cfg.Args.Num(2))
 	case "keygen":
-		err = keygen(cfg.Args.Num(1))
+		err = keygen(cfg.Args.Num(1), cfg.Args.Num(2))
+	case "mfakeygen":
+		err = mfakeygen(cfg.Args.Num(1))
+	case "unlock":
+		err = unlock(dbConfig, cfg.Args.Num(1))
+	case "import":
+		err = importProducts(dbConfig, cfg.Args.Num(1), cfg.Args.Num(2), cfg.Args.Num(3) == "dry-run")
 	default:
 		err = errors.New("Must specify a command")
 	}
@@ -155,15 +169,135 @@ func useradd(cfg database.Config, email, password string) error {
 	return nil
 }
 
-// keygen creates an x509 private key for signing auth tokens.
-func keygen(path string) error {
+// unlock forgets the failed logins of an email so its owner can log in again.
+func unlock(cfg database.Config, email string) error {
+	if email == "" {
+		return errors.New("unlock command must be called with an additional argument for the email")
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := user.Unlock(context.Background(), db, email); err != nil {
+		return err
+	}
+
+	fmt.Printf("Logins unlocked for %q\n", email)
+	return nil
+}
+
+// importProducts creates the products listed in a CSV or JSON file, picked by
+// its extension, on behalf of the user with the given email. Every row is
+// validated and the valid ones are created together unless it is a dry run.
+func importProducts(cfg database.Config, path, email string, dryRun bool) error {
+	if path == "" || email == "" {
+		return errors.New("import command must be called with additional arguments for the file and the owner's email, optionally followed by dry-run")
+	}
+
+	format := product.ImportJSON
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		format = product.ImportCSV
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "opening import file")
+	}
+	defer file.Close()
+
+	rows, err := product.DecodeImport(file, format)
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	u, err := user.RetrieveByEmail(ctx, db, email)
+	if err != nil {
+		return errors.Wrapf(err, "finding owner %q", email)
+	}
+
+	now := time.Now()
+	claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+
+	res, err := product.Import(ctx, db, claims, rows, dryRun, now)
+	if err != nil {
+		return err
+	}
+
+	for _, ie := range res.Errors {
+		fmt.Printf("row %d: %s\n", ie.Row, ie.Error)
+		for _, f := range ie.Fields {
+			fmt.Printf("\t%s: %s\n", f.Field, f.Error)
+		}
+	}
+
+	if dryRun {
+		fmt.Printf("Dry run: %d of %d products would be imported\n", res.Imported, res.Total)
+		return nil
+	}
+
+	fmt.Printf("Imported %d of %d products\n", res.Imported, res.Total)
+	return nil
+}
+
+// keygen creates an x509 private key for signing auth tokens. The algorithm
+// decides the type of key: RS256 (the default) makes an RSA 2048 key, ES256
+// and ES384 make ECDSA keys on the P-256 and P-384 curves and EdDSA makes an
+// Ed25519 key.
+func keygen(path, algorithm string) error {
 	if path == "" {
 		return errors.New("keygen missing argument for key path")
 	}
 
-	key, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return errors.Wrap(err, "generating keys")
+	var block pem.Block
+
+	switch algorithm {
+	case "", "RS256":
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return errors.Wrap(err, "generating keys")
+		}
+		block = pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+
+	case "ES256", "ES384":
+		curve := elliptic.P256()
+		if algorithm == "ES384" {
+			curve = elliptic.P384()
+		}
+
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return errors.Wrap(err, "generating keys")
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return errors.Wrap(err, "encoding private key")
+		}
+		block = pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return errors.Wrap(err, "generating keys")
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return errors.Wrap(err, "encoding private key")
+		}
+		block = pem.Block{Type: "PRIVATE KEY", Bytes: der}
+
+	default:
+		return errors.Errorf("keygen unsupported algorithm %q", algorithm)
 	}
 
 	file, err := os.Create(path)
@@ -172,11 +306,6 @@ func keygen(path string) error {
 	}
 	defer file.Close()
 
-	block := pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	}
-
 	if err := pem.Encode(file, &block); err != nil {
 		return errors.Wrap(err, "encoding to private file")
 	}
@@ -187,3 +316,22 @@ func keygen(path string) error {
 
 	return nil
 }
+
+// mfakeygen creates the key sealing the two-factor secrets of users and
+// writes it to path.
+func mfakeygen(path string) error {
+	if path == "" {
+		return errors.New("mfakeygen missing argument for key path")
+	}
+
+	key, err := seal.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return errors.Wrap(err, "writing key file")
+	}
+
+	return nil
+}
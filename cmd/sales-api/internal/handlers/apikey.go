@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/apikey"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// APIKeys has handler methods for dealing with the API keys of machine
+// clients.
+type APIKeys struct {
+	DB *sqlx.DB
+}
+
+// List gives all API keys. The keys themselves are never shown.
+func (k *APIKeys) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKeys.List")
+	defer span.End()
+
+	keys, err := apikey.List(ctx, k.DB)
+	if err != nil {
+		return errors.Wrap(err, "listing api keys")
+	}
+
+	return web.Respond(ctx, w, keys, http.StatusOK)
+}
+
+// Create decodes the body of a request to create a new API key. The response
+// is the only time the key is shown.
+func (k *APIKeys) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKeys.Create")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var nk apikey.NewAPIKey
+	if err := web.Decode(r, &nk); err != nil {
+		return errors.Wrap(err, "decoding new api key")
+	}
+
+	key, err := apikey.Create(ctx, k.DB, claims, nk, time.Now())
+	if err != nil {
+		switch errors.Cause(err) {
+		case apikey.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case apikey.ErrInvalidExpiry, apikey.ErrUnknownRole, apikey.ErrExpiryRequired:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "creating api key %q", nk.Name)
+		}
+	}
+
+	return web.Respond(ctx, w, key, http.StatusCreated)
+}
+
+// Delete removes an API key so it stops working.
+func (k *APIKeys) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.APIKeys.Delete")
+	defer span.End()
+
+	id := chi.URLParam(r, "id")
+	if err := apikey.Delete(ctx, k.DB, id); err != nil {
+		switch err {
+		case apikey.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case apikey.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "deleting api key %q", id)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
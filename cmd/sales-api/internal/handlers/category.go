@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/category"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+)
+
+// Category has handler methods for dealing with Categories.
+type Category struct {
+	DB *sqlx.DB
+}
+
+// GetListCategories gives all categories as list.
+func (c *Category) GetListCategories(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	list, err := category.List(ctx, c.DB)
+	if err != nil {
+		return errors.Wrap(err, "listing categories")
+	}
+
+	return web.Respond(ctx, writer, list, http.StatusOK)
+}
+
+// GetSummaries gives the sales roll-up of every category.
+func (c *Category) GetSummaries(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	list, err := category.Summaries(ctx, c.DB)
+	if err != nil {
+		return errors.Wrap(err, "summarizing categories")
+	}
+
+	return web.Respond(ctx, writer, list, http.StatusOK)
+}
+
+// RetrieveCategory gives a single Category.
+func (c *Category) RetrieveCategory(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	id := chi.URLParam(request, "id")
+
+	cat, err := category.Retrieve(ctx, c.DB, id)
+	if err != nil {
+		switch err {
+		case category.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case category.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "looking for category %q", id)
+		}
+	}
+
+	return web.Respond(ctx, writer, cat, http.StatusOK)
+}
+
+// CreateCategory decodes a JSON document from a POST request and creates a new
+// Category.
+func (c *Category) CreateCategory(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	var nc category.NewCategory
+	if err := web.Decode(request, &nc); err != nil {
+		return errors.Wrap(err, "decoding new category")
+	}
+
+	cat, err := category.Create(ctx, c.DB, nc, time.Now())
+	if err != nil {
+		switch err {
+		case category.ErrDuplicateName:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrap(err, "creating category")
+		}
+	}
+
+	return web.Respond(ctx, writer, cat, http.StatusCreated)
+}
+
+// UpdateCategory decodes the body of a request to update an existing category.
+// The ID of the category is part of the request URL.
+func (c *Category) UpdateCategory(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	id := chi.URLParam(request, "id")
+
+	var update category.UpdateCategory
+	if err := web.Decode(request, &update); err != nil {
+		return errors.Wrap(err, "decoding category update")
+	}
+
+	if err := category.Update(ctx, c.DB, id, update, time.Now()); err != nil {
+		switch err {
+		case category.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case category.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case category.ErrDuplicateName:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "updating category %q", id)
+		}
+	}
+
+	return web.Respond(ctx, writer, nil, http.StatusNoContent)
+}
+
+// DeleteCategory removes a single category identified by an ID in the request
+// URL.
+func (c *Category) DeleteCategory(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	id := chi.URLParam(request, "id")
+
+	if err := category.Delete(ctx, c.DB, id); err != nil {
+		switch err {
+		case category.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "deleting category %q", id)
+		}
+	}
+
+	return web.Respond(ctx, writer, nil, http.StatusNoContent)
+}
@@ -3,33 +3,166 @@ package handlers
 import (
 	"context"
 	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
 	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"github.com/wgarcia4190/garagesale/internal/schema"
+	"go.opencensus.io/trace"
 )
 
+// checkTimeout bounds the time each readiness check may take.
+const checkTimeout = 2 * time.Second
+
+// Status is the state of the service reported by the probes that only main
+// knows about.
+type Status struct {
+	Build   string
+	Started time.Time
+
+	shuttingDown int32
+}
+
+// ShutDown marks the service as shutting down so readiness fails and load
+// balancers stop sending it new requests while outstanding ones finish.
+func (s *Status) ShutDown() {
+	atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// ShuttingDown tells if ShutDown was called.
+func (s *Status) ShuttingDown() bool {
+	return atomic.LoadInt32(&s.shuttingDown) == 1
+}
+
 // Check has handlers to implement service orchestration.
 type Check struct {
-	DB *sqlx.DB
+	DB            *sqlx.DB
+	log           *logger.Logger
+	authenticator *auth.Authenticator
+	status        *Status
+}
+
+// liveness describes the running process.
+type liveness struct {
+	Status    string    `json:"status"`
+	Build     string    `json:"build"`
+	GoVersion string    `json:"go_version"`
+	Host      string    `json:"host,omitempty"`
+	Started   time.Time `json:"started"`
+	Uptime    string    `json:"uptime"`
+}
+
+// checkResult is the outcome of one readiness check.
+type checkResult struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// readiness is the outcome of every readiness check.
+type readiness struct {
+	Status string        `json:"status"`
+	Checks []checkResult `json:"checks"`
+}
+
+// Liveness responds with a 200 OK while the process is up. It does not look at
+// any dependency so a failing database does not get the service restarted.
+func (c *Check) Liveness(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Check.Liveness")
+	defer span.End()
+
+	// The host only helps tell instances apart so failing to get it is fine.
+	host, _ := os.Hostname()
+
+	live := liveness{
+		Status:    "up",
+		Build:     c.status.Build,
+		GoVersion: runtime.Version(),
+		Host:      host,
+		Started:   c.status.Started.UTC(),
+		Uptime:    time.Since(c.status.Started).Round(time.Second).String(),
+	}
+
+	return web.Respond(ctx, writer, live, http.StatusOK)
 }
 
-// Health responds with a 200 OK if the service is healthy and ready for traffic
-func (c *Check) Health(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+// Readiness responds with a 200 OK if the service is ready for traffic: the
+// database is reachable, its schema is up to date and a key is loaded to sign
+// tokens. It responds with a 503 as soon as the service starts shutting down.
+// The body lists every check with its latency. Failures are logged and only
+// described in the body so the probe does not leak details of the service.
+func (c *Check) Readiness(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Check.Readiness")
+	defer span.End()
+
+	checks := []struct {
+		name    string
+		failure string
+		fn      func(ctx context.Context) error
+	}{
+		{"shutdown", "shutting down", c.checkShutdown},
+		{"database", "database unavailable", func(ctx context.Context) error { return database.StatusCheck(ctx, c.DB) }},
+		{"schema", "schema out of date", c.checkSchema},
+		{"signing_key", "signing key not loaded", func(context.Context) error { return c.authenticator.Ready() }},
+	}
+
+	ready := readiness{Status: "ready", Checks: make([]checkResult, 0, len(checks))}
+	status := http.StatusOK
+
+	for _, chk := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		start := time.Now()
+		err := chk.fn(checkCtx)
+		cancel()
 
-	var health struct {
-		Status string `json:"status"`
+		res := checkResult{
+			Name:      chk.name,
+			Status:    "ok",
+			LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		}
+
+		// Do not respond by just returning an error because further up in the
+		// call stack will interpret that as an unhandled error.
+		if err != nil {
+			c.log.Warn("readiness check failed", "check", chk.name, "error", err)
+			res.Status = "failed"
+			res.Error = chk.failure
+			ready.Status = "not ready"
+			status = http.StatusServiceUnavailable
+		}
+
+		ready.Checks = append(ready.Checks, res)
+	}
+
+	return web.Respond(ctx, writer, ready, status)
+}
+
+// checkShutdown fails once the service starts shutting down.
+func (c *Check) checkShutdown(context.Context) error {
+	if c.status.ShuttingDown() {
+		return errors.New("shutting down")
 	}
+	return nil
+}
 
-	if err := database.StatusCheck(ctx, c.DB); err != nil {
+// checkSchema fails when migrations are missing from the database.
+func (c *Check) checkSchema(ctx context.Context) error {
+	version, err := schema.Version(ctx, c.DB)
+	if err != nil {
+		return err
+	}
 
-		// If the database is not ready we will tell the client and use a 500
-		// status. Do not respond by just returning an error because further up in
-		// the call stack will interpret that as an unhandled error.
-		health.Status = "db not ready"
-		return web.Respond(ctx, writer, health, http.StatusInternalServerError)
+	if latest := schema.Latest(); version < latest {
+		return errors.Errorf("schema at version %g, latest is %g", version, latest)
 	}
 
-	health.Status = "ok"
-	return web.Respond(ctx, writer, health, http.StatusOK)
+	return nil
 }
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+)
+
+// Images serves objects kept in a blob store that does not serve them itself.
+type Images struct {
+	Store storage.BlobStore
+}
+
+// Serve writes the object stored under the key given by the rest of the
+// request URL.
+func (i *Images) Serve(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	key := chi.URLParam(request, "*")
+
+	r, err := i.Store.Get(ctx, key)
+	if err != nil {
+		switch err {
+		case storage.ErrNotFound, storage.ErrInvalidKey:
+			return web.NewRequestError(storage.ErrNotFound, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "getting image %q", key)
+		}
+	}
+	defer r.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	writer.Header().Set("Cache-Control", "public, max-age=86400")
+
+	return web.RespondStream(ctx, writer, r, contentType, http.StatusOK)
+}
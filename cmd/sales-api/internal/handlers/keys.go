@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"go.opencensus.io/trace"
+)
+
+// Keys publishes the keys our tokens can be verified with.
+type Keys struct {
+	authenticator *auth.Authenticator
+}
+
+// JWKS gives the public signing keys as a JSON Web Key Set. Clients may cache
+// it for a few minutes.
+func (k *Keys) JWKS(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Keys.JWKS")
+	defer span.End()
+
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	return web.Respond(ctx, w, k.authenticator.JWKS(), http.StatusOK)
+}
@@ -0,0 +1,23 @@
+package handlers
+
+import "github.com/wgarcia4190/garagesale/internal/platform/metrics"
+
+// biz contains the business metrics of the application. They are counted once
+// a change is stored so failed requests are left out.
+var biz = struct {
+	sales       *metrics.Counter
+	saleUnits   *metrics.Counter
+	revenue     *metrics.Counter
+	refunds     *metrics.Counter
+	refunded    *metrics.Counter
+	orders      *metrics.Counter
+	orderTotals *metrics.Counter
+}{
+	sales:       metrics.NewCounter("sales_recorded_total", "Sales recorded."),
+	saleUnits:   metrics.NewCounter("sales_units_total", "Units of products sold."),
+	revenue:     metrics.NewCounter("sales_revenue_cents_total", "Amount paid for sales in cents."),
+	refunds:     metrics.NewCounter("refunds_recorded_total", "Refunds recorded."),
+	refunded:    metrics.NewCounter("refunds_amount_cents_total", "Amount refunded in cents."),
+	orders:      metrics.NewCounter("orders_placed_total", "Orders placed."),
+	orderTotals: metrics.NewCounter("orders_total_cents_total", "Amount of orders placed in cents."),
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"github.com/wgarcia4190/garagesale/internal/role"
+	"github.com/wgarcia4190/garagesale/internal/user"
+	"go.opencensus.io/trace"
+)
+
+// mfaChallengeResponse tells a client that gave the right password to
+// complete the login with a second factor. Enroll is set when the user must
+// first enroll because their role makes two-factor authentication mandatory.
+type mfaChallengeResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	Enroll      bool      `json:"enroll"`
+	Challenge   string    `json:"challenge"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// recoveryCodesResponse holds the recovery codes of a user who just turned on
+// two-factor authentication.
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// mfaChallenge starts a challenge when the authenticated user must give a
+// second factor. It gives nil when the password is enough.
+func (u *Users) mfaChallenge(ctx context.Context, usr *user.User, now time.Time) (*mfaChallengeResponse, error) {
+	enabled, err := user.MFAEnabled(ctx, u.DB, usr.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking two-factor enrollment")
+	}
+
+	required, err := role.RequiresMFA(ctx, u.DB, usr.Roles)
+	if err != nil {
+		return nil, errors.Wrap(err, "checking two-factor policy")
+	}
+
+	if !enabled && !required {
+		return nil, nil
+	}
+
+	challenge, expires, err := user.StartChallenge(ctx, u.DB, usr.ID, now)
+	if err != nil {
+		return nil, errors.Wrap(err, "starting two-factor challenge")
+	}
+
+	resp := mfaChallengeResponse{
+		MFARequired: true,
+		Enroll:      !enabled,
+		Challenge:   challenge,
+		ExpiresAt:   expires,
+	}
+
+	return &resp, nil
+}
+
+// MFALogin completes a login with the challenge given by Token and a code
+// from the authenticator app of the user or one of their recovery codes.
+func (u *Users) MFALogin(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.MFALogin")
+	defer span.End()
+
+	var ml user.MFALogin
+	if err := web.Decode(r, &ml); err != nil {
+		return errors.Wrap(err, "decoding two-factor login")
+	}
+
+	now := time.Now()
+
+	usr, codes, err := user.CompleteChallenge(ctx, u.DB, u.mfa, ml.Challenge, ml.Code, clientIP(r), now)
+	if err != nil {
+		if err := tooManyAttempts(w, err); err != nil {
+			return err
+		}
+
+		switch err {
+		case user.ErrInvalidChallenge, user.ErrInvalidMFACode, user.ErrMFANotEnrolled:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "completing two-factor login")
+		}
+	}
+
+	claims, refresh, err := user.StartSession(ctx, u.DB, usr, u.sessions, now)
+	if err != nil {
+		return errors.Wrap(err, "starting session")
+	}
+
+	return u.respondToken(ctx, w, claims, refresh, codes)
+}
+
+// MFALoginEnroll gives a user who must use two-factor authentication, but has
+// not enrolled yet, the secret for their authenticator app. The login is then
+// completed with MFALogin which confirms the enrollment.
+func (u *Users) MFALoginEnroll(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.MFALoginEnroll")
+	defer span.End()
+
+	var me user.MFAEnroll
+	if err := web.Decode(r, &me); err != nil {
+		return errors.Wrap(err, "decoding two-factor enrollment")
+	}
+
+	now := time.Now()
+
+	userID, err := user.ChallengeUser(ctx, u.DB, me.Challenge, now)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidChallenge:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "checking two-factor challenge")
+		}
+	}
+
+	return u.enroll(ctx, w, userID, now)
+}
+
+// EnrollMFA starts two-factor authentication for the authenticated user. The
+// current password of the user must be given. It takes effect once confirmed
+// with ConfirmMFA.
+func (u *Users) EnrollMFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.EnrollMFA")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var ms user.MFASetup
+	if err := web.Decode(r, &ms); err != nil {
+		return errors.Wrap(err, "decoding two-factor enrollment")
+	}
+
+	now := time.Now()
+
+	if err := u.checkPassword(ctx, w, r, claims.Subject, ms.Password, now); err != nil {
+		return err
+	}
+
+	return u.enroll(ctx, w, claims.Subject, now)
+}
+
+// checkPassword verifies the current password of the user before a change to
+// how they log in.
+func (u *Users) checkPassword(ctx context.Context, w http.ResponseWriter, r *http.Request, userID, password string, now time.Time) error {
+	err := user.CheckPassword(ctx, u.DB, u.lockout, userID, password, clientIP(r), now)
+	if err != nil {
+		if err := tooManyAttempts(w, err); err != nil {
+			return err
+		}
+
+		switch err {
+		case user.ErrAuthenticationFailure:
+			return web.NewRequestError(errors.New("current password is not correct"), http.StatusForbidden)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "checking password of %s", userID)
+		}
+	}
+
+	return nil
+}
+
+// enroll responds with a new two-factor secret for the user.
+func (u *Users) enroll(ctx context.Context, w http.ResponseWriter, userID string, now time.Time) error {
+	e, err := user.Enroll(ctx, u.DB, u.mfa, userID, now)
+	if err != nil {
+		switch err {
+		case user.ErrMFAEnrolled:
+			return web.NewRequestError(err, http.StatusConflict)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "enrolling %s", userID)
+		}
+	}
+
+	return web.Respond(ctx, w, e, http.StatusCreated)
+}
+
+// ConfirmMFA turns on two-factor authentication for the authenticated user
+// with their current password and a code from their app. The response holds
+// their recovery codes.
+func (u *Users) ConfirmMFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.ConfirmMFA")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var mc user.MFAConfirm
+	if err := web.Decode(r, &mc); err != nil {
+		return errors.Wrap(err, "decoding two-factor code")
+	}
+
+	now := time.Now()
+
+	if err := u.checkPassword(ctx, w, r, claims.Subject, mc.Password, now); err != nil {
+		return err
+	}
+
+	codes, err := user.ConfirmMFA(ctx, u.DB, u.mfa, claims.Subject, mc.Code, clientIP(r), now)
+	if err != nil {
+		if err := tooManyAttempts(w, err); err != nil {
+			return err
+		}
+
+		switch err {
+		case user.ErrInvalidMFACode:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrMFAEnrolled, user.ErrMFANotEnrolled:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "confirming two-factor enrollment of %s", claims.Subject)
+		}
+	}
+
+	return web.Respond(ctx, w, recoveryCodesResponse{RecoveryCodes: codes}, http.StatusOK)
+}
+
+// DisableMFA turns off two-factor authentication for the authenticated user.
+// Users whose role makes it mandatory can not turn it off.
+func (u *Users) DisableMFA(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.DisableMFA")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var mc user.MFACode
+	if err := web.Decode(r, &mc); err != nil {
+		return errors.Wrap(err, "decoding two-factor code")
+	}
+
+	required, err := role.RequiresMFA(ctx, u.DB, claims.Roles)
+	if err != nil {
+		return errors.Wrap(err, "checking two-factor policy")
+	}
+	if required {
+		err := errors.New("two-factor authentication is mandatory for your role")
+		return web.NewRequestError(err, http.StatusForbidden)
+	}
+
+	if err := user.DisableMFA(ctx, u.DB, u.mfa, claims.Subject, mc.Code, clientIP(r), time.Now()); err != nil {
+		if err := tooManyAttempts(w, err); err != nil {
+			return err
+		}
+
+		switch err {
+		case user.ErrInvalidMFACode:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrMFANotEnrolled:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "disabling two-factor authentication of %s", claims.Subject)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
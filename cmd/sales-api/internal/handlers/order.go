@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/order"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"github.com/wgarcia4190/garagesale/internal/product"
+	"go.opencensus.io/trace"
+)
+
+// Order has handler methods for dealing with Orders.
+type Order struct {
+	DB *sqlx.DB
+}
+
+// CreateOrder decodes a JSON document from a POST request and records a new
+// Order with all of its lines.
+func (o *Order) CreateOrder(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.Create")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var no order.NewOrder
+	if err := web.Decode(request, &no); err != nil {
+		return errors.Wrap(err, "decoding new order")
+	}
+
+	ord, err := order.Create(ctx, o.DB, claims, no, time.Now())
+	if err != nil {
+		if _, ok := errors.Cause(err).(*product.StockError); ok {
+			return web.NewRequestError(err, http.StatusConflict)
+		}
+
+		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "creating order")
+		}
+	}
+
+	biz.orders.Inc()
+	biz.orderTotals.Add(float64(ord.Total))
+
+	return web.Respond(ctx, writer, ord, http.StatusCreated)
+}
+
+// RetrieveOrder gives a single Order with its lines and totals. Only the user
+// who recorded the order or one allowed to read all orders may see it.
+func (o *Order) RetrieveOrder(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Order.Retrieve")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	id := chi.URLParam(request, "id")
+
+	ord, err := order.Retrieve(ctx, o.DB, claims, id)
+	if err != nil {
+		switch err {
+		case order.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case order.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case order.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "looking for order %q", id)
+		}
+	}
+
+	return web.Respond(ctx, writer, ord, http.StatusOK)
+}
@@ -2,14 +2,20 @@ package handlers
 
 import (
 	"context"
-	"log"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
 	"github.com/wgarcia4190/garagesale/internal/product"
 	"go.opencensus.io/trace"
@@ -17,21 +23,56 @@ import (
 
 // Product has handler methods for dealing with Products.
 type Product struct {
-	DB  *sqlx.DB
-	Log *log.Logger
+	DB     *sqlx.DB
+	Log    *logger.Logger
+	Store  storage.BlobStore
+	Images product.ImageConfig
 }
 
-// GetListProducts gives all products as list.
+// GetListProducts gives a page of products. The page can be narrowed down and
+// ordered with query parameters. The next_cursor of the response is passed
+// back in the cursor parameter to fetch the following page.
+//
+// Clients accepting text/csv are streamed every matching product as a CSV
+// document instead, ignoring the limit.
 func (p *Product) GetListProducts(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Product.List")
 	defer span.End()
 
-	list, err := product.List(ctx, p.DB)
-
+	lq, err := parseListQuery(request.URL.Query())
 	if err != nil {
 		return err
 	}
 
+	if lq.IncludeArchived {
+		claims, ok := ctx.Value(auth.Key).(auth.Claims)
+		if !ok {
+			return web.NewShutdownError("auth claims not in context")
+		}
+		if !claims.HasPermission(auth.PermProductsManage) {
+			err := errors.New("only product managers can list archived products")
+			return web.NewRequestError(err, http.StatusForbidden)
+		}
+	}
+
+	if web.Accepts(request, "text/csv") {
+		err := web.RespondCSV(ctx, writer, product.Product{}, http.StatusOK, func(encode func(interface{}) error) error {
+			return product.Export(ctx, p.DB, lq, func(prod product.Product) error {
+				return encode(prod)
+			})
+		})
+		return listError(err)
+	}
+
+	list, err := product.List(ctx, p.DB, lq)
+	if err != nil {
+		return listError(err)
+	}
+
+	for i := range list.Products {
+		product.SetImageURLs(p.Store, &list.Products[i])
+	}
+
 	return web.Respond(ctx, writer, list, http.StatusOK)
 }
 
@@ -51,6 +92,10 @@ func (p *Product) RetrieveProduct(ctx context.Context, writer http.ResponseWrite
 		}
 	}
 
+	product.SetImageURLs(p.Store, prod)
+
+	writer.Header().Set("ETag", etag(prod.Version))
+
 	return web.Respond(ctx, writer, prod, http.StatusOK)
 }
 
@@ -69,14 +114,81 @@ func (p *Product) CreateProduct(ctx context.Context, writer http.ResponseWriter,
 
 	prod, err := product.Create(ctx, p.DB, claims, np, time.Now())
 	if err != nil {
-		return err
+		switch err {
+		case product.ErrInvalidCategory:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "creating product")
+		}
 	}
 
+	writer.Header().Set("ETag", etag(prod.Version))
+
 	return web.Respond(ctx, writer, prod, http.StatusCreated)
 }
 
+// maxImportSize is the largest import document accepted.
+const maxImportSize = 10 << 20
+
+// ImportProducts creates many products at once from a CSV document or a JSON
+// array of products, picked by the Content-Type of the request. Every row is
+// validated and the valid ones are created together. With dry_run=true
+// nothing is created but the result reports what would have been.
+func (p *Product) ImportProducts(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.Import")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	dryRun, err := queryBool(request.URL.Query(), "dry_run")
+	if err != nil {
+		return err
+	}
+
+	format := product.ImportJSON
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "text/csv") {
+		format = product.ImportCSV
+	}
+
+	body := http.MaxBytesReader(writer, request.Body, maxImportSize)
+
+	rows, err := product.DecodeImport(body, format)
+	if err != nil {
+		switch errors.Cause(err) {
+		case product.ErrInvalidImport:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrTooManyRows:
+			return web.NewRequestError(err, http.StatusRequestEntityTooLarge)
+		default:
+			return errors.Wrap(err, "decoding import")
+		}
+	}
+
+	res, err := product.Import(ctx, p.DB, claims, rows, dryRun, time.Now())
+	if err != nil {
+		switch errors.Cause(err) {
+		case product.ErrTooManyRows:
+			return web.NewRequestError(err, http.StatusRequestEntityTooLarge)
+		default:
+			return errors.Wrap(err, "importing products")
+		}
+	}
+
+	status := http.StatusCreated
+	if dryRun {
+		status = http.StatusOK
+	}
+
+	return web.Respond(ctx, writer, res, status)
+}
+
 // UpdateProduct decodes the body of a request to update an existing product. The ID
-// of the product is part of the request URL
+// of the product is part of the request URL. An If-Match header holding the
+// ETag of the product makes the update conditional on its version. The
+// response carries the ETag of the updated product.
 func (p *Product) UpdateProduct(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 	id := chi.URLParam(request, "id")
 
@@ -85,12 +197,22 @@ func (p *Product) UpdateProduct(ctx context.Context, writer http.ResponseWriter,
 		return errors.New("auth claims not in context")
 	}
 
+	// A bad precondition is reported before looking at the body.
+	version, err := ifMatch(request)
+	if err != nil {
+		return err
+	}
+
 	var update product.UpdateProduct
 	if err := web.Decode(request, &update); err != nil {
 		return errors.Wrap(err, "decoding product update")
 	}
+	if version != 0 {
+		update.Version = &version
+	}
 
-	if err := product.Update(ctx, p.DB, claims, id, update, time.Now()); err != nil {
+	prod, err := product.Update(ctx, p.DB, claims, id, update, time.Now())
+	if err != nil {
 		switch err {
 		case product.ErrNotFound:
 			return web.NewRequestError(err, http.StatusNotFound)
@@ -98,24 +220,91 @@ func (p *Product) UpdateProduct(ctx context.Context, writer http.ResponseWriter,
 			return web.NewRequestError(err, http.StatusBadRequest)
 		case product.ErrForbidden:
 			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrInvalidCategory:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrConflict:
+			return conflictError(request, err)
 		default:
 			return errors.Wrapf(err, "updating product %q", id)
 		}
 	}
 
+	writer.Header().Set("ETag", etag(prod.Version))
+
 	return web.Respond(ctx, writer, nil, http.StatusNoContent)
 }
 
-// DeleteProduct removes a single product identified by an ID in the request URL.
+// DeleteProduct archives a single product identified by an ID in the request
+// URL. Its sales are kept. An If-Match header holding the ETag of the product
+// makes the removal conditional on its version.
 func (p *Product) DeleteProduct(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	id := chi.URLParam(request, "id")
+
+	version, err := ifMatch(request)
+	if err != nil {
+		return err
+	}
+
+	if err := product.Archive(ctx, p.DB, claims, id, version, time.Now()); err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrConflict:
+			return conflictError(request, err)
+		default:
+			return errors.Wrapf(err, "archiving product %q", id)
+		}
+	}
+
+	return web.Respond(ctx, writer, nil, http.StatusNoContent)
+}
+
+// RestoreProduct brings back an archived product identified by an ID in the
+// request URL.
+func (p *Product) RestoreProduct(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 	id := chi.URLParam(request, "id")
 
-	if err := product.Delete(ctx, p.DB, id); err != nil {
+	if err := product.Restore(ctx, p.DB, id, time.Now()); err != nil {
 		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
 		case product.ErrInvalidID:
 			return web.NewRequestError(err, http.StatusBadRequest)
 		default:
-			return errors.Wrapf(err, "deleting product %q", id)
+			return errors.Wrapf(err, "restoring product %q", id)
+		}
+	}
+
+	return web.Respond(ctx, writer, nil, http.StatusNoContent)
+}
+
+// PurgeProduct permanently removes a product identified by an ID in the
+// request URL. Products with sales can not be purged.
+func (p *Product) PurgeProduct(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	id := chi.URLParam(request, "id")
+
+	if err := product.Purge(ctx, p.DB, p.Store, id); err != nil {
+		if _, ok := errors.Cause(err).(*product.CleanupError); ok {
+			p.Log.Warn("purged product left stored images behind", "product_id", id, "error", err)
+			return web.Respond(ctx, writer, nil, http.StatusNoContent)
+		}
+
+		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrHasSales:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "purging product %q", id)
 		}
 	}
 
@@ -125,6 +314,11 @@ func (p *Product) DeleteProduct(ctx context.Context, writer http.ResponseWriter,
 // AddSale creates a new Sale for a particular product. It looks for a JSON
 // object in the request body. The full model is returned to the caller.
 func (p *Product) AddSale(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
 	var ns product.NewSale
 	if err := web.Decode(request, &ns); err != nil {
 		return errors.Wrap(err, "decoding new sale")
@@ -132,22 +326,460 @@ func (p *Product) AddSale(ctx context.Context, writer http.ResponseWriter, reque
 
 	productID := chi.URLParam(request, "id")
 
-	sale, err := product.AddSale(ctx, p.DB, ns, productID, time.Now())
+	sale, err := product.AddSale(ctx, p.DB, claims, ns, productID, time.Now())
 	if err != nil {
-		return errors.Wrap(err, "adding new sale")
+		if _, ok := errors.Cause(err).(*product.StockError); ok {
+			return web.NewRequestError(err, http.StatusConflict)
+		}
+
+		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrap(err, "adding new sale")
+		}
 	}
 
+	biz.sales.Inc()
+	biz.saleUnits.Add(float64(sale.Quantity))
+	biz.revenue.Add(float64(sale.Paid))
+
 	return web.Respond(ctx, writer, sale, http.StatusCreated)
 }
 
-// ListSales get all sales for a particular product.
+// ListSales get all sales for a particular product. Clients accepting
+// text/csv are streamed the sales as a CSV document.
 func (p *Product) GetListSales(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 	id := chi.URLParam(request, "id")
 
+	if web.Accepts(request, "text/csv") {
+		return p.respondSalesCSV(ctx, writer, product.SaleQuery{ProductID: id})
+	}
+
 	list, err := product.ListSales(ctx, p.DB, id)
 	if err != nil {
-		return errors.Wrap(err, "getting sales list")
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "getting sales list")
+		}
 	}
 
 	return web.Respond(ctx, writer, list, http.StatusOK)
 }
+
+// SearchSales gives a page of the sales of every product made within the range
+// of the from and to query parameters. The limit and cursor query parameters
+// page through them. Clients accepting text/csv are streamed every sale as a
+// CSV document unless they ask for a limit.
+func (p *Product) SearchSales(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.SearchSales")
+	defer span.End()
+
+	values := request.URL.Query()
+
+	sq := product.SaleQuery{
+		ProductID: values.Get("product_id"),
+		Cursor:    values.Get("cursor"),
+	}
+
+	var err error
+	if sq.From, err = queryTime(values, "from"); err != nil {
+		return err
+	}
+	if sq.To, err = queryTime(values, "to"); err != nil {
+		return err
+	}
+	if sq.Limit, err = queryInt(values, "limit"); err != nil {
+		return err
+	}
+
+	if web.Accepts(request, "text/csv") {
+		return p.respondSalesCSV(ctx, writer, sq)
+	}
+
+	res, err := product.SearchSales(ctx, p.DB, sq)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidRange, product.ErrInvalidCursor:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "searching sales")
+		}
+	}
+
+	return web.Respond(ctx, writer, res, http.StatusOK)
+}
+
+// respondSalesCSV streams the sales matching a query as a CSV document.
+func (p *Product) respondSalesCSV(ctx context.Context, writer http.ResponseWriter, sq product.SaleQuery) error {
+	err := web.RespondCSV(ctx, writer, product.Sale{}, http.StatusOK, func(encode func(interface{}) error) error {
+		return product.EachSale(ctx, p.DB, sq, func(s product.Sale) error {
+			return encode(s)
+		})
+	})
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID, product.ErrInvalidRange, product.ErrInvalidCursor:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "exporting sales")
+		}
+	}
+
+	return nil
+}
+
+// AddRefund refunds part or all of a Sale of a particular product. It looks
+// for a JSON object in the request body. The full model is returned to the
+// caller.
+func (p *Product) AddRefund(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var nr product.NewRefund
+	if err := web.Decode(request, &nr); err != nil {
+		return errors.Wrap(err, "decoding new refund")
+	}
+
+	productID := chi.URLParam(request, "id")
+	saleID := chi.URLParam(request, "saleID")
+
+	refund, err := product.AddRefund(ctx, p.DB, claims, productID, saleID, nr, time.Now())
+	if err != nil {
+		switch err {
+		case product.ErrSaleNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidID, product.ErrEmptyRefund:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrRefundExceedsSale:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrap(err, "adding new refund")
+		}
+	}
+
+	biz.refunds.Inc()
+	biz.refunded.Add(float64(refund.Amount))
+
+	return web.Respond(ctx, writer, refund, http.StatusCreated)
+}
+
+// GetListRefunds gets all refunds of a Sale of a particular product.
+func (p *Product) GetListRefunds(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	productID := chi.URLParam(request, "id")
+	saleID := chi.URLParam(request, "saleID")
+
+	list, err := product.ListRefunds(ctx, p.DB, productID, saleID)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "getting refunds list")
+		}
+	}
+
+	return web.Respond(ctx, writer, list, http.StatusOK)
+}
+
+// AddImage stores a photo of a product uploaded as the "image" field of a
+// multipart form. The stored image is returned to the caller.
+func (p *Product) AddImage(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Product.AddImage")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	productID := chi.URLParam(request, "id")
+
+	// Leave some room above the image for the rest of the multipart body.
+	request.Body = http.MaxBytesReader(writer, request.Body, product.MaxImageSize+1<<20)
+
+	file, _, err := request.FormFile("image")
+	if err != nil {
+		err := errors.Wrap(err, "reading image field of multipart form")
+		return web.NewRequestError(err, http.StatusBadRequest)
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(file, product.MaxImageSize+1))
+	if err != nil {
+		return errors.Wrap(err, "reading uploaded image")
+	}
+
+	img, err := product.AddImage(ctx, p.DB, p.Store, p.Images, claims, productID, data, time.Now())
+	if err != nil {
+		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrInvalidID, product.ErrUnsupportedImage:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrImageTooLarge, product.ErrImageDimensions:
+			return web.NewRequestError(err, http.StatusRequestEntityTooLarge)
+		default:
+			return errors.Wrap(err, "adding image")
+		}
+	}
+
+	return web.Respond(ctx, writer, img, http.StatusCreated)
+}
+
+// DeleteImage removes a photo of a product.
+func (p *Product) DeleteImage(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	productID := chi.URLParam(request, "id")
+	imageID := chi.URLParam(request, "imageID")
+
+	if err := product.DeleteImage(ctx, p.DB, p.Store, claims, productID, imageID); err != nil {
+		if _, ok := errors.Cause(err).(*product.CleanupError); ok {
+			p.Log.Warn("deleted image left stored files behind", "image_id", imageID, "error", err)
+			return web.Respond(ctx, writer, nil, http.StatusNoContent)
+		}
+
+		switch err {
+		case product.ErrNotFound, product.ErrImageNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrapf(err, "deleting image %q", imageID)
+		}
+	}
+
+	return web.Respond(ctx, writer, nil, http.StatusNoContent)
+}
+
+// GetListPrices gets the price history of a particular product.
+func (p *Product) GetListPrices(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	id := chi.URLParam(request, "id")
+
+	list, err := product.ListPrices(ctx, p.DB, id)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "getting prices list")
+		}
+	}
+
+	return web.Respond(ctx, writer, list, http.StatusOK)
+}
+
+// SchedulePrice plans a change of the cost of a particular product. It looks
+// for a JSON object in the request body. The full model is returned to the
+// caller.
+func (p *Product) SchedulePrice(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var nps product.NewPriceSchedule
+	if err := web.Decode(request, &nps); err != nil {
+		return errors.Wrap(err, "decoding new price schedule")
+	}
+
+	id := chi.URLParam(request, "id")
+
+	ps, err := product.SchedulePrice(ctx, p.DB, claims, id, nps, time.Now())
+	if err != nil {
+		switch err {
+		case product.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidID, product.ErrInvalidSchedule:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrap(err, "scheduling price")
+		}
+	}
+
+	return web.Respond(ctx, writer, ps, http.StatusCreated)
+}
+
+// GetListSchedules gets the scheduled price changes of a particular product.
+func (p *Product) GetListSchedules(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	id := chi.URLParam(request, "id")
+
+	list, err := product.ListSchedules(ctx, p.DB, id)
+	if err != nil {
+		switch err {
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "getting price schedules list")
+		}
+	}
+
+	return web.Respond(ctx, writer, list, http.StatusOK)
+}
+
+// CancelSchedule removes a price change of a particular product that was not
+// applied yet.
+func (p *Product) CancelSchedule(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	id := chi.URLParam(request, "id")
+	scheduleID := chi.URLParam(request, "scheduleID")
+
+	if err := product.CancelSchedule(ctx, p.DB, claims, id, scheduleID); err != nil {
+		switch err {
+		case product.ErrNotFound, product.ErrScheduleNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case product.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case product.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case product.ErrScheduleApplied:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "canceling price schedule %q", scheduleID)
+		}
+	}
+
+	return web.Respond(ctx, writer, nil, http.StatusNoContent)
+}
+
+// parseListQuery reads the product listing parameters from a request URL.
+func parseListQuery(values url.Values) (product.ListQuery, error) {
+	lq := product.ListQuery{
+		Cursor:     values.Get("cursor"),
+		Name:       values.Get("name"),
+		UserID:     values.Get("user_id"),
+		CategoryID: values.Get("category_id"),
+		Tags:       values["tag"],
+		Sort:       values.Get("sort"),
+		Order:      values.Get("order"),
+	}
+
+	var err error
+	if lq.Limit, err = queryInt(values, "limit"); err != nil {
+		return product.ListQuery{}, err
+	}
+
+	if v := values.Get("min_cost"); v != "" {
+		n, err := queryInt(values, "min_cost")
+		if err != nil {
+			return product.ListQuery{}, err
+		}
+		lq.MinCost = &n
+	}
+
+	if v := values.Get("max_cost"); v != "" {
+		n, err := queryInt(values, "max_cost")
+		if err != nil {
+			return product.ListQuery{}, err
+		}
+		lq.MaxCost = &n
+	}
+
+	if lq.InStock, err = queryBool(values, "in_stock"); err != nil {
+		return product.ListQuery{}, err
+	}
+
+	if lq.IncludeArchived, err = queryBool(values, "include_archived"); err != nil {
+		return product.ListQuery{}, err
+	}
+
+	return lq, nil
+}
+
+// listError maps the errors of listing products to responses.
+func listError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case product.ErrInvalidCursor, product.ErrInvalidSort, product.ErrInvalidID:
+		return web.NewRequestError(err, http.StatusBadRequest)
+	default:
+		return errors.Wrap(err, "listing products")
+	}
+}
+
+// queryInt reads an integer query parameter. A missing parameter is zero.
+func queryInt(values url.Values, key string) (int, error) {
+	v := values.Get(key)
+	if v == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, web.NewRequestError(errors.Errorf("%s must be an integer, got %q", key, v), http.StatusBadRequest)
+	}
+
+	return n, nil
+}
+
+// queryBool reads a boolean query parameter. A missing parameter is false.
+func queryBool(values url.Values, key string) (bool, error) {
+	v := values.Get(key)
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, web.NewRequestError(errors.Errorf("%s must be a boolean, got %q", key, v), http.StatusBadRequest)
+	}
+
+	return b, nil
+}
+
+// etag formats the version of a product as an entity tag.
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ifMatch reads the product version from the If-Match header of a request.
+// It returns zero when the header is missing or matches any version.
+func ifMatch(request *http.Request) (int, error) {
+	v := strings.TrimSpace(request.Header.Get("If-Match"))
+	if v == "" || v == "*" {
+		return 0, nil
+	}
+
+	v = strings.Trim(strings.TrimPrefix(v, "W/"), `"`)
+
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		err := errors.Errorf("If-Match does not hold a product ETag: %q", request.Header.Get("If-Match"))
+		return 0, web.NewRequestError(err, http.StatusPreconditionFailed)
+	}
+
+	return version, nil
+}
+
+// conflictError maps a product.ErrConflict to a response. Requests that sent
+// an If-Match header failed their precondition; other requests lost a race
+// with a concurrent change.
+func conflictError(request *http.Request, err error) error {
+	if request.Header.Get("If-Match") != "" {
+		return web.NewRequestError(err, http.StatusPreconditionFailed)
+	}
+	return web.NewRequestError(err, http.StatusConflict)
+}
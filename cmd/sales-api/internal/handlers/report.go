@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"github.com/wgarcia4190/garagesale/internal/report"
+	"go.opencensus.io/trace"
+)
+
+// Report has handler methods for reporting on sales.
+type Report struct {
+	DB *sqlx.DB
+}
+
+// GetSalesReport gives the revenue, units and number of sales bucketed over a
+// range of time. The report is shaped with the bucket, from, to and group_by
+// query parameters.
+func (rp *Report) GetSalesReport(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Report.Sales")
+	defer span.End()
+
+	values := request.URL.Query()
+
+	sq := report.SalesQuery{
+		Bucket:  values.Get("bucket"),
+		GroupBy: values.Get("group_by"),
+	}
+
+	var err error
+	if sq.From, err = queryTime(values, "from"); err != nil {
+		return err
+	}
+	if sq.To, err = queryTime(values, "to"); err != nil {
+		return err
+	}
+
+	rep, err := report.Sales(ctx, rp.DB, sq, time.Now())
+	if err != nil {
+		switch err {
+		case report.ErrInvalidBucket, report.ErrInvalidGroup, report.ErrInvalidRange:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "reporting sales")
+		}
+	}
+
+	return web.Respond(ctx, writer, rep, http.StatusOK)
+}
+
+// queryTime reads a time query parameter given either as RFC 3339 or as a
+// plain date. A missing parameter is the zero time.
+func queryTime(values url.Values, key string) (time.Time, error) {
+	v := values.Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+
+	err := errors.Errorf("%s must be a RFC 3339 time or a YYYY-MM-DD date, got %q", key, v)
+	return time.Time{}, web.NewRequestError(err, http.StatusBadRequest)
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"github.com/wgarcia4190/garagesale/internal/role"
+	"go.opencensus.io/trace"
+)
+
+// Roles has handler methods for dealing with the permissions of roles.
+type Roles struct {
+	DB    *sqlx.DB
+	cache *role.Cache
+}
+
+// List gives every role with its permissions.
+func (rl *Roles) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Roles.List")
+	defer span.End()
+
+	roles, err := role.List(ctx, rl.DB)
+	if err != nil {
+		return errors.Wrap(err, "listing roles")
+	}
+
+	return web.Respond(ctx, w, roles, http.StatusOK)
+}
+
+// Update replaces the permissions of a role.
+func (rl *Roles) Update(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Roles.Update")
+	defer span.End()
+
+	name := chi.URLParam(r, "name")
+
+	var upd role.UpdateRole
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "decoding role update")
+	}
+
+	rol, err := role.Update(ctx, rl.DB, name, upd, time.Now())
+	if err != nil {
+		switch errors.Cause(err) {
+		case role.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case role.ErrUnknownPermission:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case role.ErrNoRoleManager:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "updating role %q", name)
+		}
+	}
+
+	if rl.cache != nil {
+		rl.cache.Invalidate()
+	}
+
+	return web.Respond(ctx, w, rol, http.StatusOK)
+}
@@ -1,39 +1,160 @@
 package handlers
 
 import (
-	"github.com/wgarcia4190/garagesale/internal/platform/auth"
-	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/wgarcia4190/garagesale/internal/apikey"
 	"github.com/wgarcia4190/garagesale/internal/middleware"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+	"github.com/wgarcia4190/garagesale/internal/platform/seal"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
+	"github.com/wgarcia4190/garagesale/internal/product"
+	"github.com/wgarcia4190/garagesale/internal/role"
+	"github.com/wgarcia4190/garagesale/internal/user"
 )
 
+// Config holds what the API needs to serve its routes.
+type Config struct {
+	Log           *logger.Logger
+	DB            *sqlx.DB
+	Authenticator *auth.Authenticator
+	Store         storage.BlobStore
+	Images        product.ImageConfig
+	Notifier      notify.Notifier
+	Sessions      user.SessionConfig
+	Lockout       user.LockoutConfig
+	MFASecrets    *seal.Box
+	DenyList      *user.DenyList
+	Roles         *role.Cache
+	Status        *Status
+}
+
 // API constructs a handler that knows about all API routes.
-func API(shutdown chan os.Signal, logger *log.Logger, db *sqlx.DB, authenticator *auth.Authenticator) http.Handler {
-	app := web.NewApp(shutdown, logger, middleware.Logger(logger), middleware.Errors(logger), middleware.Metrics(),
+func API(shutdown chan os.Signal, cfg Config) http.Handler {
+	log, db, authenticator, store := cfg.Log, cfg.DB, cfg.Authenticator, cfg.Store
+
+	app := web.NewApp(shutdown, log, middleware.Logger(log), middleware.Metrics(), middleware.Errors(log),
 		middleware.Panics())
 
-	c := Check{DB: db}
-	app.Handler(http.MethodGet, "/v1/health", c.Health)
+	authn := middleware.Authenticate(authenticator, cfg.DenyList, apikey.NewVerifier(db), cfg.Roles)
+
+	// Without a status from main the service is taken to have just started.
+	status := cfg.Status
+	if status == nil {
+		status = &Status{Started: time.Now()}
+	}
 
-	u := Users{DB: db, authenticator: authenticator}
+	check := Check{DB: db, log: log, authenticator: authenticator, status: status}
+	app.Handler(http.MethodGet, "/v1/liveness", check.Liveness)
+	app.Handler(http.MethodGet, "/v1/readiness", check.Readiness)
+
+	// Health is the readiness probe under the path existing deployments use.
+	app.Handler(http.MethodGet, "/v1/health", check.Readiness)
+
+	k := Keys{authenticator: authenticator}
+	app.Handler(http.MethodGet, "/.well-known/jwks.json", k.JWKS)
+
+	u := Users{
+		DB:            db,
+		log:           log,
+		authenticator: authenticator,
+		notifier:      cfg.Notifier,
+		sessions:      cfg.Sessions,
+		lockout:       cfg.Lockout,
+		mfa:           user.MFAConfig{Issuer: authenticator.Issuer(), Secrets: cfg.MFASecrets, Lockout: cfg.Lockout},
+		denyList:      cfg.DenyList,
+	}
 	app.Handler(http.MethodGet, "/v1/users/token", u.Token)
+	app.Handler(http.MethodPost, "/v1/users/token/refresh", u.Refresh)
+	app.Handler(http.MethodPost, "/v1/users/logout", u.Logout, authn)
+	app.Handler(http.MethodPost, "/v1/users/password/forgot", u.RequestReset)
+	app.Handler(http.MethodPost, "/v1/users/password/reset", u.ResetPassword)
+	app.Handler(http.MethodPut, "/v1/users/me/password", u.ChangePassword, authn)
+	app.Handler(http.MethodPost, "/v1/users/token/mfa", u.MFALogin)
+	app.Handler(http.MethodPost, "/v1/users/token/mfa/enroll", u.MFALoginEnroll)
+	app.Handler(http.MethodPost, "/v1/users/me/mfa", u.EnrollMFA, authn)
+	app.Handler(http.MethodPost, "/v1/users/me/mfa/confirm", u.ConfirmMFA, authn)
+	app.Handler(http.MethodDelete, "/v1/users/me/mfa", u.DisableMFA, authn)
+	app.Handler(http.MethodGet, "/v1/users", u.List, authn, middleware.RequirePermission(auth.PermUsersManage))
+	app.Handler(http.MethodGet, "/v1/users/me", u.Me, authn)
+	app.Handler(http.MethodGet, "/v1/users/{id}", u.Retrieve, authn)
+	app.Handler(http.MethodPost, "/v1/users", u.Create, authn, middleware.RequirePermission(auth.PermUsersManage))
+	app.Handler(http.MethodPut, "/v1/users/{id}", u.Update, authn)
+	app.Handler(http.MethodDelete, "/v1/users/{id}", u.Delete, authn, middleware.RequirePermission(auth.PermUsersManage))
+	app.Handler(http.MethodDelete, "/v1/users/{id}/lockout", u.Unlock, authn, middleware.RequirePermission(auth.PermUsersManage))
+
+	ak := APIKeys{DB: db}
+	app.Handler(http.MethodGet, "/v1/apikeys", ak.List, authn, middleware.RequirePermission(auth.PermAPIKeysManage))
+	app.Handler(http.MethodPost, "/v1/apikeys", ak.Create, authn, middleware.RequirePermission(auth.PermAPIKeysManage))
+	app.Handler(http.MethodDelete, "/v1/apikeys/{id}", ak.Delete, authn, middleware.RequirePermission(auth.PermAPIKeysManage))
+
+	rl := Roles{DB: db, cache: cfg.Roles}
+	app.Handler(http.MethodGet, "/v1/roles", rl.List, authn, middleware.RequirePermission(auth.PermRolesManage))
+	app.Handler(http.MethodPut, "/v1/roles/{name}", rl.Update, authn, middleware.RequirePermission(auth.PermRolesManage))
+
+	p := Product{DB: db, Log: log, Store: store, Images: cfg.Images}
+
+	app.Handler(http.MethodGet, "/v1/products", p.GetListProducts, authn)
+	app.Handler(http.MethodGet, "/v1/products/{id}", p.RetrieveProduct, authn)
+	app.Handler(http.MethodPost, "/v1/products", p.CreateProduct, authn, middleware.RequirePermission(auth.PermProductsWrite))
+	app.Handler(http.MethodPost, "/v1/products/import", p.ImportProducts, authn,
+		middleware.RequirePermission(auth.PermProductsWrite))
+	app.Handler(http.MethodPut, "/v1/products/{id}", p.UpdateProduct, authn)
+	app.Handler(http.MethodDelete, "/v1/products/{id}", p.DeleteProduct, authn,
+		middleware.RequirePermission(auth.PermProductsDelete))
+	app.Handler(http.MethodPost, "/v1/products/{id}/restore", p.RestoreProduct, authn,
+		middleware.RequirePermission(auth.PermProductsManage))
+	app.Handler(http.MethodDelete, "/v1/products/{id}/purge", p.PurgeProduct, authn,
+		middleware.RequirePermission(auth.PermProductsManage))
+
+	app.Handler(http.MethodPost, "/v1/products/{id}/sales", p.AddSale, authn,
+		middleware.RequirePermission(auth.PermSalesRecord))
+	app.Handler(http.MethodGet, "/v1/products/{id}/sales", p.GetListSales, authn)
+	app.Handler(http.MethodGet, "/v1/sales", p.SearchSales, authn, middleware.RequirePermission(auth.PermSalesRead))
+
+	app.Handler(http.MethodPost, "/v1/products/{id}/sales/{saleID}/refunds", p.AddRefund,
+		authn, middleware.RequirePermission(auth.PermSalesRefund))
+	app.Handler(http.MethodGet, "/v1/products/{id}/sales/{saleID}/refunds", p.GetListRefunds,
+		authn)
+
+	app.Handler(http.MethodPost, "/v1/products/{id}/images", p.AddImage, authn)
+	app.Handler(http.MethodDelete, "/v1/products/{id}/images/{imageID}", p.DeleteImage,
+		authn)
+
+	app.Handler(http.MethodGet, "/v1/products/{id}/prices", p.GetListPrices, authn)
+	app.Handler(http.MethodPost, "/v1/products/{id}/prices/schedules", p.SchedulePrice,
+		authn)
+	app.Handler(http.MethodGet, "/v1/products/{id}/prices/schedules", p.GetListSchedules,
+		authn)
+	app.Handler(http.MethodDelete, "/v1/products/{id}/prices/schedules/{scheduleID}", p.CancelSchedule,
+		authn)
+
+	i := Images{Store: store}
+	app.Handler(http.MethodGet, "/v1/images/*", i.Serve)
+
+	c := Category{DB: db}
+
+	app.Handler(http.MethodGet, "/v1/categories", c.GetListCategories, authn)
+	app.Handler(http.MethodGet, "/v1/categories/revenue", c.GetSummaries, authn)
+	app.Handler(http.MethodGet, "/v1/categories/{id}", c.RetrieveCategory, authn)
+	app.Handler(http.MethodPost, "/v1/categories", c.CreateCategory, authn, middleware.RequirePermission(auth.PermCategoriesWrite))
+	app.Handler(http.MethodPut, "/v1/categories/{id}", c.UpdateCategory, authn, middleware.RequirePermission(auth.PermCategoriesWrite))
+	app.Handler(http.MethodDelete, "/v1/categories/{id}", c.DeleteCategory, authn, middleware.RequirePermission(auth.PermCategoriesWrite))
+
+	o := Order{DB: db}
 
-	p := Product{DB: db, Log: logger}
+	app.Handler(http.MethodPost, "/v1/orders", o.CreateOrder, authn, middleware.RequirePermission(auth.PermOrdersWrite))
+	app.Handler(http.MethodGet, "/v1/orders/{id}", o.RetrieveOrder, authn)
 
-	app.Handler(http.MethodGet, "/v1/products", p.GetListProducts, middleware.Authenticate(authenticator))
-	app.Handler(http.MethodGet, "/v1/products/{id}", p.RetrieveProduct, middleware.Authenticate(authenticator))
-	app.Handler(http.MethodPost, "/v1/products", p.CreateProduct, middleware.Authenticate(authenticator))
-	app.Handler(http.MethodPut, "/v1/products/{id}", p.UpdateProduct, middleware.Authenticate(authenticator))
-	app.Handler(http.MethodDelete, "/v1/products/{id}", p.DeleteProduct, middleware.Authenticate(authenticator),
-		middleware.HasRoles(auth.RoleAdmin))
+	rp := Report{DB: db}
 
-	app.Handler(http.MethodPost, "/v1/products/{id}/sales", p.AddSale, middleware.Authenticate(authenticator),
-		middleware.HasRoles(auth.RoleAdmin))
-	app.Handler(http.MethodGet, "/v1/products/{id}/sales", p.GetListSales, middleware.Authenticate(authenticator))
+	app.Handler(http.MethodGet, "/v1/reports/sales", rp.GetSalesReport, authn, middleware.RequirePermission(auth.PermReportsRead))
 
 	return app
 }
@@ -2,25 +2,54 @@ package handlers
 
 import (
 	"context"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
 	"github.com/wgarcia4190/garagesale/internal/user"
 	"go.opencensus.io/trace"
 )
 
+// resetResponseTime is the least time a password reset request takes to be
+// answered so known and unknown emails can not be told apart by timing.
+const resetResponseTime = time.Second
+
 // Users holds handlers for dealing with user.
 type Users struct {
 	DB            *sqlx.DB
+	log           *logger.Logger
 	authenticator *auth.Authenticator
+	notifier      notify.Notifier
+	sessions      user.SessionConfig
+	lockout       user.LockoutConfig
+	mfa           user.MFAConfig
+	denyList      *user.DenyList
+}
+
+// tokenResponse is the body of responses giving out tokens. The refresh token
+// is exchanged for a new access token before ExpiresAt.
+type tokenResponse struct {
+	Token         string    `json:"token"`
+	RefreshToken  string    `json:"refresh_token"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	RecoveryCodes []string  `json:"recovery_codes,omitempty"`
 }
 
 // Token generates an authentication token for a user. The client must include
 // an email and password for the request using HTTP Basic Auth. The user will
-// be identified by email and authenticated by their password.
+// be identified by email and authenticated by their password. A refresh token
+// for renewing the access token is given along with it. Users with two-factor
+// authentication are given a challenge instead, which is completed by
+// MFALogin.
 func (u *Users) Token(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 	ctx, span := trace.StartSpan(ctx, "handlers.Users.Token")
 	defer span.End()
@@ -36,9 +65,13 @@ func (u *Users) Token(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		return web.NewRequestError(err, http.StatusUnauthorized)
 	}
 
-	claims, err := user.Authenticate(ctx, u.DB, v.Start, email, pass)
+	usr, err := user.Authenticate(ctx, u.DB, u.lockout, v.Start, email, pass, clientIP(r))
 
 	if err != nil {
+		if err := tooManyAttempts(w, err); err != nil {
+			return err
+		}
+
 		switch err {
 		case user.ErrAuthenticationFailure:
 			return web.NewRequestError(err, http.StatusUnauthorized)
@@ -47,10 +80,120 @@ func (u *Users) Token(ctx context.Context, w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	var tkn struct {
-		Token string `json:"token"`
+	// Users who use a second factor, or whose role demands one, only get a
+	// challenge to complete the login with.
+	challenge, err := u.mfaChallenge(ctx, usr, v.Start)
+	if err != nil {
+		return err
+	}
+	if challenge != nil {
+		return web.Respond(ctx, w, challenge, http.StatusAccepted)
+	}
+
+	claims, refresh, err := user.StartSession(ctx, u.DB, usr, u.sessions, v.Start)
+	if err != nil {
+		return errors.Wrap(err, "starting session")
+	}
+
+	return u.respondToken(ctx, w, claims, refresh, nil)
+}
+
+// Unlock forgets the failed logins of the specified user so they can log in
+// again right away.
+func (u *Users) Unlock(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Unlock")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	id := chi.URLParam(r, "id")
+
+	usr, err := user.Retrieve(ctx, u.DB, claims, id)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "looking for user %q", id)
+		}
+	}
+
+	if err := user.Unlock(ctx, u.DB, usr.Email); err != nil {
+		return errors.Wrapf(err, "unlocking %s", id)
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Refresh exchanges a refresh token for a new access token. The refresh token
+// is rotated so the one given back must be used next time.
+func (u *Users) Refresh(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Refresh")
+	defer span.End()
+
+	v, ok := ctx.Value(web.KeyValues).(*web.Values)
+	if !ok {
+		return errors.New("web values missing from context")
 	}
 
+	var body struct {
+		RefreshToken string `json:"refresh_token" validate:"required"`
+	}
+	if err := web.Decode(r, &body); err != nil {
+		return errors.Wrap(err, "decoding refresh token")
+	}
+
+	claims, refresh, err := user.RefreshSession(ctx, u.DB, body.RefreshToken, u.sessions, v.Start)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidRefreshToken:
+			return web.NewRequestError(err, http.StatusUnauthorized)
+		default:
+			return errors.Wrap(err, "refreshing session")
+		}
+	}
+
+	return u.respondToken(ctx, w, claims, refresh, nil)
+}
+
+// Logout ends the session of the token the request was authenticated with.
+// Its refresh token and every access token issued for it stop working.
+func (u *Users) Logout(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Logout")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	id, until, err := user.EndSession(ctx, u.DB, claims, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "ending session")
+	}
+	u.denyList.Add(id, until)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// respondToken signs the claims and responds with them and the refresh token.
+// Recovery codes are included when a user just enrolled in two-factor
+// authentication.
+func (u *Users) respondToken(ctx context.Context, w http.ResponseWriter, claims auth.Claims, refresh string, codes []string) error {
+	tkn := tokenResponse{
+		RefreshToken:  refresh,
+		ExpiresAt:     time.Unix(claims.ExpiresAt, 0).UTC(),
+		RecoveryCodes: codes,
+	}
+
+	var err error
 	tkn.Token, err = u.authenticator.GenerateToken(claims)
 	if err != nil {
 		return errors.Wrap(err, "generating token")
@@ -58,3 +201,273 @@ func (u *Users) Token(ctx context.Context, w http.ResponseWriter, r *http.Reques
 
 	return web.Respond(ctx, w, tkn, http.StatusOK)
 }
+
+// List returns all the existing users in the system.
+func (u *Users) List(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.List")
+	defer span.End()
+
+	users, err := user.List(ctx, u.DB)
+	if err != nil {
+		return errors.Wrap(err, "listing users")
+	}
+
+	return web.Respond(ctx, w, users, http.StatusOK)
+}
+
+// Retrieve returns the specified user from the system. Users without the
+// permission to manage users may only retrieve themselves.
+func (u *Users) Retrieve(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Retrieve")
+	defer span.End()
+
+	return u.respondUser(ctx, w, chi.URLParam(r, "id"))
+}
+
+// Me returns the user the request was authenticated as.
+func (u *Users) Me(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Me")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	return u.respondUser(ctx, w, claims.Subject)
+}
+
+// respondUser responds with the user with the given id.
+func (u *Users) respondUser(ctx context.Context, w http.ResponseWriter, id string) error {
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	usr, err := user.Retrieve(ctx, u.DB, claims, id)
+	if err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		default:
+			return errors.Wrapf(err, "looking for user %q", id)
+		}
+	}
+
+	return web.Respond(ctx, w, usr, http.StatusOK)
+}
+
+// Create inserts a new user into the system.
+func (u *Users) Create(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Create")
+	defer span.End()
+
+	var nu user.NewUser
+	if err := web.Decode(r, &nu); err != nil {
+		return errors.Wrap(err, "decoding new user")
+	}
+
+	usr, err := user.Create(ctx, u.DB, nu, time.Now())
+	if err != nil {
+		switch err {
+		case user.ErrDuplicateEmail:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "creating user %q", nu.Email)
+		}
+	}
+
+	return web.Respond(ctx, w, usr, http.StatusCreated)
+}
+
+// Update updates the specified user in the system. Users without the
+// permission to manage users may only update themselves and can not change
+// their roles.
+func (u *Users) Update(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Update")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var upd user.UpdateUser
+	if err := web.Decode(r, &upd); err != nil {
+		return errors.Wrap(err, "decoding user update")
+	}
+
+	id := chi.URLParam(r, "id")
+	if err := user.Update(ctx, u.DB, claims, id, upd, time.Now()); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrForbidden:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrDuplicateEmail, user.ErrLastAdmin:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "updating user %q", id)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// Delete removes the specified user from the system. Users can not delete
+// themselves and the last admin is kept.
+func (u *Users) Delete(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.Delete")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	id := chi.URLParam(r, "id")
+	if err := user.Delete(ctx, u.DB, claims, id); err != nil {
+		switch err {
+		case user.ErrInvalidID:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		case user.ErrDeleteSelf:
+			return web.NewRequestError(err, http.StatusForbidden)
+		case user.ErrLastAdmin:
+			return web.NewRequestError(err, http.StatusConflict)
+		default:
+			return errors.Wrapf(err, "deleting user %q", id)
+		}
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// ChangePassword replaces the password of the authenticated user. The
+// current password must be given along with the new one. Every session of the
+// user is ended so they have to log in again.
+func (u *Users) ChangePassword(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.ChangePassword")
+	defer span.End()
+
+	claims, ok := ctx.Value(auth.Key).(auth.Claims)
+	if !ok {
+		return web.NewShutdownError("auth claims not in context")
+	}
+
+	var cp user.PasswordChange
+	if err := web.Decode(r, &cp); err != nil {
+		return errors.Wrap(err, "decoding password change")
+	}
+
+	revoked, err := user.ChangePassword(ctx, u.DB, u.lockout, claims, claims.Subject, cp, clientIP(r), time.Now())
+	if err != nil {
+		if err := tooManyAttempts(w, err); err != nil {
+			return err
+		}
+
+		switch err {
+		case user.ErrAuthenticationFailure:
+			return web.NewRequestError(errors.New("current password is not correct"), http.StatusForbidden)
+		case user.ErrNotFound:
+			return web.NewRequestError(err, http.StatusNotFound)
+		default:
+			return errors.Wrapf(err, "changing password of %s", claims.Subject)
+		}
+	}
+
+	u.revoke(revoked)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// RequestReset sends a password reset token to the user with the email in
+// the request. The response is always a 202 given after the same amount of
+// time whether or not the email is known. Failures to send the token are
+// logged rather than reported to the client.
+func (u *Users) RequestReset(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.RequestReset")
+	defer span.End()
+
+	start := time.Now()
+
+	var rr user.ResetRequest
+	if err := web.Decode(r, &rr); err != nil {
+		return errors.Wrap(err, "decoding reset request")
+	}
+
+	if err := user.RequestReset(ctx, u.DB, u.notifier, rr.Email, start); err != nil {
+		u.log.Error("requesting password reset", "error", err)
+	}
+
+	select {
+	case <-time.After(resetResponseTime - time.Since(start)):
+	case <-ctx.Done():
+	}
+
+	return web.Respond(ctx, w, nil, http.StatusAccepted)
+}
+
+// ResetPassword redeems a password reset token to set a new password. Every
+// session of the user is ended.
+func (u *Users) ResetPassword(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	ctx, span := trace.StartSpan(ctx, "handlers.Users.ResetPassword")
+	defer span.End()
+
+	var pr user.PasswordReset
+	if err := web.Decode(r, &pr); err != nil {
+		return errors.Wrap(err, "decoding password reset")
+	}
+
+	revoked, err := user.ResetPassword(ctx, u.DB, pr, time.Now())
+	if err != nil {
+		switch err {
+		case user.ErrInvalidResetToken:
+			return web.NewRequestError(err, http.StatusBadRequest)
+		default:
+			return errors.Wrap(err, "resetting password")
+		}
+	}
+
+	u.revoke(revoked)
+
+	return web.Respond(ctx, w, nil, http.StatusNoContent)
+}
+
+// revoke adds revocations to the deny list so this instance rejects the
+// tokens right away.
+func (u *Users) revoke(revoked []user.Revocation) {
+	for _, r := range revoked {
+		u.denyList.Add(r.ID, r.Until)
+	}
+}
+
+// tooManyAttempts responds to a *user.LockedError with a 429 telling the
+// client when to try again. It gives nil for any other error.
+func tooManyAttempts(w http.ResponseWriter, err error) error {
+	lerr, ok := errors.Cause(err).(*user.LockedError)
+	if !ok {
+		return nil
+	}
+
+	retry := int(math.Ceil(lerr.RetryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	return web.NewRequestError(err, http.StatusTooManyRequests)
+}
+
+// clientIP gives the address of the client a request came from. Proxy headers
+// are not trusted since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -2,20 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto/rsa"
 	_ "expvar" // Register the /debug/vars handlers
 	"fmt"
 	"io/ioutil"
-	"log"
+	stdlog "log"
 	"net/http"
 	_ "net/http/pprof" //nolint:gosec Register the /debug/pprof handlers
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
 	"syscall"
 	"time"
 
 	"contrib.go.opencensus.io/exporter/zipkin"
-	"github.com/dgrijalva/jwt-go"
+	"github.com/jmoiron/sqlx"
 	openzipkin "github.com/openzipkin/zipkin-go"
 	zipkinHTTP "github.com/openzipkin/zipkin-go/reporter/http"
 	"github.com/pkg/errors"
@@ -23,28 +24,43 @@ import (
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
 	"github.com/wgarcia4190/garagesale/internal/platform/conf"
 	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/metrics"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+	"github.com/wgarcia4190/garagesale/internal/platform/seal"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
+	"github.com/wgarcia4190/garagesale/internal/product"
+	"github.com/wgarcia4190/garagesale/internal/role"
+	"github.com/wgarcia4190/garagesale/internal/user"
 	"go.opencensus.io/trace"
 )
 
+// build is the version of the service. It is set when building with
+// -ldflags "-X main.build=<version>".
+var build = "develop"
+
 func main() {
 	if err := run(); err != nil {
-		log.Fatal(err)
+		stdlog.Fatal(err)
 	}
 }
 
 func run() error {
-	log := log.New(os.Stdout, "SALES : ", log.LstdFlags)
-
 	// =========================================================================
 	// Configuration
 
 	var cfg struct {
+		Log struct {
+			Level  string `conf:"default:info,help:lowest level logged: debug, info, warn or error"`
+			Format string `conf:"default:json,help:format of log entries: json or text"`
+		}
 		Web struct {
 			Address         string        `conf:"default:localhost:8000"`
 			Debug           string        `conf:"default:localhost:6060"`
 			ReadTimeout     time.Duration `conf:"default:5s"`
 			WriteTimeout    time.Duration `conf:"default:5s"`
 			ShutdownTimeout time.Duration `conf:"default:5s"`
+			ShutdownDrain   time.Duration `conf:"default:5s,help:time to keep serving after readiness fails on shutdown"`
 		}
 		DB struct {
 			User       string `conf:"default:postgres"`
@@ -53,10 +69,38 @@ func run() error {
 			Name       string `conf:"default:postgres"`
 			DisableTLS bool   `conf:"default:false"`
 		}
+		Prices struct {
+			Interval time.Duration `conf:"default:1m"`
+		}
+		Storage struct {
+			Root           string `conf:"default:uploads"`
+			BaseURL        string `conf:"default:http://localhost:8000/v1/images"`
+			MaxImagePixels int    `conf:"default:40000000,help:largest width times height of uploaded images"`
+		}
+		Notify struct {
+			Kind string `conf:"default:file,help:where notifications go: file or log (log redacts tokens so resets can not be completed)"`
+			Dir  string `conf:"default:notifications"`
+		}
 		Auth struct {
-			KeyID          string `conf:"default:1"`
-			PrivateKeyFile string `conf:"default:private.pem"`
-			Algorithm      string `conf:"default:RS256"`
+			KeyID           string        `conf:"default:1"`
+			KeysDir         string        `conf:"default:keys"`
+			RetiredKeys     []string      `conf:"help:ids of keys in keys-dir that no longer verify tokens"`
+			PrivateKeyFile  string        `conf:"default:private.pem"`
+			Algorithm       string        `conf:"default:RS256,help:algorithm of RSA keys; other keys sign with the algorithm of their type"`
+			Issuer          string        `conf:"default:garagesale"`
+			Audience        string        `conf:"default:sales-api"`
+			Leeway          time.Duration `conf:"default:30s"`
+			AccessTTL       time.Duration `conf:"default:15m"`
+			RefreshTTL      time.Duration `conf:"default:720h"`
+			DenyListRefresh time.Duration `conf:"default:30s"`
+			RolesRefresh    time.Duration `conf:"default:30s"`
+			MFAKeyFile      string        `conf:"default:mfa.key,help:file holding the base64 key that seals two-factor secrets"`
+		}
+		Lockout struct {
+			Threshold int           `conf:"default:5"`
+			Delay     time.Duration `conf:"default:30s"`
+			MaxDelay  time.Duration `conf:"default:15m"`
+			Window    time.Duration `conf:"default:1h"`
 		}
 		Trace struct {
 			URL         string  `conf:"default:http://localhost:9411/api/v2/spans"`
@@ -77,20 +121,54 @@ func run() error {
 		return errors.Wrap(err, "parsing config")
 	}
 
+	// =========================================================================
+	// Logging
+	level, err := logger.ParseLevel(cfg.Log.Level)
+	if err != nil {
+		return errors.Wrap(err, "parsing log level")
+	}
+
+	log, err := logger.New(os.Stdout, level, cfg.Log.Format)
+	if err != nil {
+		return errors.Wrap(err, "creating logger")
+	}
+
 	// =========================================================================
 	// App Starting
-	log.Printf("main: Started")
-	defer log.Println("main: Completed")
+	log.Info("main : Started", "build", build)
+	defer log.Info("main : Completed")
 
 	out, err := conf.String(&cfg)
 	if err != nil {
 		return errors.Wrap(err, "generating config for output")
 	}
-	log.Printf("main : Config :\n%v\n", out)
+	log.Info("main : Config", "config", out)
 
 	// =========================================================================
 	// Initialize authentication support
-	authenticator, _ := createAuth(cfg.Auth.PrivateKeyFile, cfg.Auth.KeyID, cfg.Auth.Algorithm)
+	authCfg := auth.Config{
+		Issuer:   cfg.Auth.Issuer,
+		Audience: cfg.Auth.Audience,
+		Leeway:   cfg.Auth.Leeway,
+	}
+	authenticator, err := createAuth(cfg.Auth.KeysDir, cfg.Auth.PrivateKeyFile, cfg.Auth.KeyID, cfg.Auth.Algorithm,
+		cfg.Auth.RetiredKeys, authCfg)
+	if err != nil {
+		return errors.Wrap(err, "constructing authenticator")
+	}
+
+	mfaKey, err := ioutil.ReadFile(cfg.Auth.MFAKeyFile)
+	if err != nil {
+		return errors.Wrap(err, "reading two-factor key")
+	}
+	mfaKey, err = seal.ParseKey(mfaKey)
+	if err != nil {
+		return errors.Wrap(err, "parsing two-factor key")
+	}
+	mfaSecrets, err := seal.NewBox(mfaKey)
+	if err != nil {
+		return errors.Wrap(err, "constructing two-factor secrets")
+	}
 
 	// =========================================================================
 	// Start Database
@@ -107,6 +185,40 @@ func run() error {
 
 	defer db.Close()
 
+	sessions := user.SessionConfig{
+		AccessTTL:  cfg.Auth.AccessTTL,
+		RefreshTTL: cfg.Auth.RefreshTTL,
+	}
+	denyList := user.NewDenyList(db, cfg.Auth.DenyListRefresh)
+	roles := role.NewCache(db, cfg.Auth.RolesRefresh)
+	lockout := user.LockoutConfig{
+		Threshold: cfg.Lockout.Threshold,
+		Delay:     cfg.Lockout.Delay,
+		MaxDelay:  cfg.Lockout.MaxDelay,
+		Window:    cfg.Lockout.Window,
+	}
+
+	// =========================================================================
+	// Start Blob Storage
+	store, err := storage.NewLocal(cfg.Storage.Root, cfg.Storage.BaseURL)
+	if err != nil {
+		return errors.Wrap(err, "opening blob storage")
+	}
+
+	// =========================================================================
+	// Start Notifications
+	var notifier notify.Notifier
+	switch cfg.Notify.Kind {
+	case "log":
+		notifier = notify.NewLog(log)
+	case "file":
+		if notifier, err = notify.NewFile(cfg.Notify.Dir); err != nil {
+			return errors.Wrap(err, "opening notifications")
+		}
+	default:
+		return errors.Errorf("unknown notification kind %q", cfg.Notify.Kind)
+	}
+
 	// =========================================================================
 	// Start Tracing Support
 	closer, err := registerTracer(cfg.Trace.Service, cfg.Web.Address, cfg.Trace.URL, cfg.Trace.Probability)
@@ -117,15 +229,30 @@ func run() error {
 
 	// =========================================================================
 	// Start Debug Service
+	// Prometheus scrapes /metrics on the debug listener along with the pool
+	// stats of the database and the number of goroutines.
+	database.RegisterMetrics(metrics.Default, db)
+	metrics.Default.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	http.Handle("/metrics", metrics.Handler())
+
 	go func() {
-		log.Printf("main : Debug service listening on %s", cfg.Web.Debug)
+		log.Info("main : Debug service listening", "addr", cfg.Web.Debug)
 		err := http.ListenAndServe(cfg.Web.Debug, http.DefaultServeMux)
 
 		if err != nil {
-			log.Printf("main: Debug service ended %v", err)
+			log.Error("main : Debug service ended", "error", err)
 		}
 	}()
 
+	// =========================================================================
+	// Start Price Worker
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stopPrices := startPriceWorker(ctx, log, db, cfg.Prices.Interval)
+	defer stopPrices()
+
 	// =========================================================================
 	// Start API Service
 	// Make a channel to listen for an interrupt or terminate signal from the OS.
@@ -133,11 +260,29 @@ func run() error {
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
 
+	status := handlers.Status{Build: build, Started: time.Now()}
+
+	apiCfg := handlers.Config{
+		Log:           log,
+		DB:            db,
+		Authenticator: authenticator,
+		Store:         store,
+		Images:        product.ImageConfig{MaxPixels: cfg.Storage.MaxImagePixels},
+		Notifier:      notifier,
+		Sessions:      sessions,
+		Lockout:       lockout,
+		MFASecrets:    mfaSecrets,
+		DenyList:      denyList,
+		Roles:         roles,
+		Status:        &status,
+	}
+
 	api := http.Server{
 		Addr:         cfg.Web.Address,
-		Handler:      handlers.API(shutdown, log, db, authenticator),
+		Handler:      handlers.API(shutdown, apiCfg),
 		ReadTimeout:  cfg.Web.ReadTimeout,
 		WriteTimeout: cfg.Web.WriteTimeout,
+		ErrorLog:     stdlog.New(log.Writer(logger.LevelError), "", 0),
 	}
 
 	// Make a channel to listen for errors coming from the listener. Use a
@@ -146,11 +291,10 @@ func run() error {
 
 	// Start the service listening for requests.
 	go func() {
-		log.Printf("main : API listening on %s", api.Addr)
+		log.Info("main : API listening", "addr", api.Addr)
 		serverError <- api.ListenAndServe()
 	}()
 
-
 	// =========================================================================
 	// Shutdown
 
@@ -160,7 +304,17 @@ func run() error {
 		return errors.Wrap(err, "Listening and serving")
 
 	case sig := <-shutdown:
-		log.Println("main: Start shutdown", sig)
+		log.Info("main : Start shutdown", "signal", sig)
+
+		// Fail readiness first so no new requests are routed here. Keep
+		// serving while load balancers notice, unless signaled again.
+		status.ShutDown()
+
+		log.Info("main : Draining", "delay", cfg.Web.ShutdownDrain)
+		select {
+		case <-time.After(cfg.Web.ShutdownDrain):
+		case <-shutdown:
+		}
 
 		// Give outstanding requests a deadline for completion.
 		timeout := cfg.Web.ShutdownTimeout
@@ -172,7 +326,7 @@ func run() error {
 		err := api.Shutdown(ctx)
 
 		if err != nil {
-			log.Printf("main : Graceful shutdown did not complete in %v : %v", timeout, err)
+			log.Warn("main : Graceful shutdown did not complete", "timeout", timeout, "error", err)
 			err = api.Close()
 		}
 
@@ -188,20 +342,80 @@ func run() error {
 	return nil
 }
 
-func createAuth(privateKeyFile, keyID, algorithm string) (*auth.Authenticator, error) {
-	keyContents, err := ioutil.ReadFile(privateKeyFile)
+// createAuth builds the Authenticator from the keys in keysDir, signing with
+// the key named by keyID. When the directory holds no keys the single key in
+// privateKeyFile is used instead. The type of each key, RSA, ECDSA or Ed25519,
+// is read from its PEM encoding.
+func createAuth(keysDir, privateKeyFile, keyID, algorithm string, retired []string, cfg auth.Config) (*auth.Authenticator, error) {
+	files, err := filepath.Glob(filepath.Join(keysDir, "*.pem"))
 	if err != nil {
-		return nil, errors.Wrap(err, "reading auth private key")
+		return nil, errors.Wrap(err, "listing auth keys")
 	}
 
-	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyContents)
-	if err != nil {
-		return nil, errors.Wrap(err, "parsing auth private key")
+	var keys *auth.KeySet
+	if len(files) > 0 {
+		if keys, err = auth.LoadKeySet(keysDir); err != nil {
+			return nil, errors.Wrap(err, "loading auth keys")
+		}
+	} else {
+		keyContents, err := ioutil.ReadFile(privateKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading auth private key")
+		}
+
+		key, err := auth.ParsePrivateKeyPEM(keyContents)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing auth private key")
+		}
+
+		keys = auth.NewKeySet()
+		keys.AddPrivate(keyID, key)
+	}
+
+	if err := keys.Activate(keyID); err != nil {
+		return nil, errors.Wrap(err, "activating auth key")
+	}
+	if err := keys.Retire(retired...); err != nil {
+		return nil, errors.Wrap(err, "retiring auth keys")
 	}
 
-	public := auth.NewSimpleKeyLookupFunc(keyID, key.Public().(*rsa.PublicKey))
+	return auth.NewKeySetAuthenticator(keys, algorithm, cfg)
+}
+
+// startPriceWorker applies scheduled price changes every interval until ctx
+// is canceled or the returned function is called. The function cancels a
+// running pass and waits for it to end.
+func startPriceWorker(ctx context.Context, log *logger.Logger, db *sqlx.DB, interval time.Duration) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n, err := product.ApplyScheduledPrices(ctx, db, time.Now())
+				if n > 0 {
+					log.Info("main : Price worker : applied scheduled prices", "count", n)
+				}
+				if err != nil && ctx.Err() == nil {
+					log.Error("main : Price worker : applying scheduled prices", "error", err)
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
-	return auth.NewAuthenticator(key, keyID, algorithm, public)
+	return func() {
+		cancel()
+		<-stopped
+	}
 }
 
 func registerTracer(service, httpAddr, traceURL string, probability float64) (func() error, error) {
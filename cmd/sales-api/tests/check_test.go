@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/cmd/sales-api/internal/handlers"
+	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
+	"github.com/wgarcia4190/garagesale/internal/role"
+	"github.com/wgarcia4190/garagesale/internal/user"
+)
+
+// TestChecks exercises the liveness and readiness probes.
+func TestChecks(t *testing.T) {
+	db, teardown := databasetest.Setup(t)
+	defer teardown()
+
+	log, err := logger.New(ioutil.Discard, logger.LevelError, logger.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, _ := newAuth(t)
+
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/v1/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := handlers.Status{Build: "test", Started: time.Now()}
+	app := handlers.API(make(chan os.Signal, 1), handlers.Config{
+		Log:           log,
+		DB:            db,
+		Authenticator: authenticator,
+		Store:         store,
+		Notifier:      notify.NewLog(log),
+		Sessions:      user.SessionConfig{AccessTTL: time.Hour, RefreshTTL: time.Hour},
+		DenyList:      user.NewDenyList(db, time.Minute),
+		Roles:         role.NewCache(db, time.Minute),
+		Status:        &status,
+	})
+
+	get := func(t *testing.T, path string, want int) map[string]interface{} {
+		t.Helper()
+
+		resp := httptest.NewRecorder()
+		app.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if resp.Code != want {
+			t.Fatalf("%s: expected status code %v, got %v: %s", path, want, resp.Code, resp.Body)
+		}
+
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: decoding: %s", path, err)
+		}
+		return body
+	}
+
+	live := get(t, "/v1/liveness", http.StatusOK)
+	if live["status"] != "up" || live["build"] != "test" {
+		t.Fatalf("unexpected liveness: %v", live)
+	}
+
+	ready := get(t, "/v1/readiness", http.StatusOK)
+	checks := ready["checks"].([]interface{})
+	if len(checks) != 4 {
+		t.Fatalf("expected 4 checks, got %v", checks)
+	}
+	for _, c := range checks {
+		if c := c.(map[string]interface{}); c["status"] != "ok" {
+			t.Fatalf("check %v failed: %v", c["name"], c["error"])
+		}
+	}
+
+	status.ShutDown()
+
+	ready = get(t, "/v1/readiness", http.StatusServiceUnavailable)
+	if ready["status"] != "not ready" {
+		t.Fatalf("expected not ready while shutting down, got %v", ready)
+	}
+	for _, c := range ready["checks"].([]interface{}) {
+		if c := c.(map[string]interface{}); c["name"] == "shutdown" && c["error"] != "shutting down" {
+			t.Fatalf("expected the fixed shutdown message, got %v", c["error"])
+		}
+	}
+
+	get(t, "/v1/liveness", http.StatusOK)
+}
@@ -1,19 +1,27 @@
 package tests
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/wgarcia4190/garagesale/cmd/sales-api/internal/handlers"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
 	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
+	"github.com/wgarcia4190/garagesale/internal/role"
 	"github.com/wgarcia4190/garagesale/internal/schema"
+	"github.com/wgarcia4190/garagesale/internal/user"
 )
 
 // TestProducts runs a series of tests to exercise Product behavior from the
@@ -30,22 +38,96 @@ func TestProducts(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	log := log.New(os.Stderr, "TEST : ", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
+	log, err := logger.New(os.Stderr, logger.LevelDebug, logger.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator, token := newAuth(t)
+
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/v1/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan os.Signal, 1)
+	app := handlers.API(shutdown, handlers.Config{
+		Log:           log,
+		DB:            db,
+		Authenticator: authenticator,
+		Store:         store,
+		Notifier:      notify.NewLog(log),
+		Sessions:      user.SessionConfig{AccessTTL: time.Hour, RefreshTTL: 24 * time.Hour},
+		DenyList:      user.NewDenyList(db, time.Minute),
+		Roles:         role.NewCache(db, time.Minute),
+		Status:        &handlers.Status{Build: "test", Started: time.Now()},
+	})
+
+	userToken, err := authenticator.GenerateToken(auth.NewClaims(
+		"45b5fbd3-755f-4379-8f07-a58d4a30fa2f", // This is the seeded regular user.
+		[]string{auth.RoleUser},
+		time.Now(), time.Hour,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	tests := ProductTests{app: handlers.API(log, db)}
+	tests := ProductTests{
+		app:       app,
+		token:     token,
+		userToken: userToken,
+	}
 
 	t.Run("List", tests.List)
+	t.Run("ProductCRUD", tests.ProductCRUD)
+	t.Run("UserPermissions", tests.UserPermissions)
+	t.Run("RoleManagers", tests.RoleManagers)
+	t.Run("UserManagers", tests.UserManagers)
+}
+
+// newAuth creates an Authenticator backed by a throwaway key along with a
+// token for an admin user signed by it.
+func newAuth(t *testing.T) (*auth.Authenticator, string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const kid = "4754d86b-7a6d-4df5-9c65-224741361492"
+	lookup := auth.NewSimpleKeyLookupFunc(kid, key.Public().(*rsa.PublicKey))
+	authenticator, err := auth.NewAuthenticator(key, kid, "RS256", lookup, auth.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := auth.NewClaims(
+		"5cf37266-3473-4006-984f-9325122678b7", // This is the seeded admin user.
+		[]string{auth.RoleAdmin, auth.RoleUser},
+		time.Now(), time.Hour,
+	)
+
+	token, err := authenticator.GenerateToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return authenticator, token
 }
 
 // ProductTests holds methods for each product subtest. This type allows
 // passing dependencies for tests while still providing a convenient syntax
 // when subtests are registered.
 type ProductTests struct {
-	app http.Handler
+	app       http.Handler
+	token     string
+	userToken string
 }
 
 func (p *ProductTests) List(t *testing.T) {
 	req := httptest.NewRequest("GET", "/v1/products", nil)
+	req.Header.Set("Authorization", "Bearer "+p.token)
 	resp := httptest.NewRecorder()
 
 	p.app.ServeHTTP(resp, req)
@@ -54,28 +136,43 @@ func (p *ProductTests) List(t *testing.T) {
 		t.Fatalf("getting: expected status code %v, got %v", http.StatusOK, resp.Code)
 	}
 
-	var list []map[string]interface{}
+	var list map[string]interface{}
 
 	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
 		t.Fatalf("decoding: %s", err)
 	}
 
-	want := []map[string]interface{}{
-		{
-			"id":           "a2b0639f-2cc6-44b8-b97b-15d69dbb511e",
-			"name":         "Comic Books",
-			"cost":         float64(50),
-			"quantity":     float64(42),
-			"date_created": "2019-01-01T00:00:01.000001Z",
-			"date_updated": "2019-01-01T00:00:01.000001Z",
-		},
-		{
-			"id":           "72f8b983-3eb4-48db-9ed0-e45cc6bd716b",
-			"name":         "McDonalds Toys",
-			"cost":         float64(75),
-			"quantity":     float64(120),
-			"date_created": "2019-01-01T00:00:02.000001Z",
-			"date_updated": "2019-01-01T00:00:02.000001Z",
+	want := map[string]interface{}{
+		"limit": float64(50),
+		"products": []interface{}{
+			map[string]interface{}{
+				"id":           "a2b0639f-2cc6-44b8-b97b-15d69dbb511e",
+				"name":         "Comic Books",
+				"tags":         []interface{}{},
+				"images":       []interface{}{},
+				"cost":         float64(50),
+				"quantity":     float64(42),
+				"sold":         float64(7),
+				"revenue":      float64(350),
+				"user_id":      "00000000-0000-0000-0000-000000000000",
+				"version":      float64(1),
+				"date_created": "2019-01-01T00:00:01.000001Z",
+				"date_updated": "2019-01-01T00:00:01.000001Z",
+			},
+			map[string]interface{}{
+				"id":           "72f8b983-3eb4-48db-9ed0-e45cc6bd716b",
+				"name":         "McDonalds Toys",
+				"tags":         []interface{}{},
+				"images":       []interface{}{},
+				"cost":         float64(75),
+				"quantity":     float64(120),
+				"sold":         float64(3),
+				"revenue":      float64(225),
+				"user_id":      "00000000-0000-0000-0000-000000000000",
+				"version":      float64(1),
+				"date_created": "2019-01-01T00:00:02.000001Z",
+				"date_updated": "2019-01-01T00:00:02.000001Z",
+			},
 		},
 	}
 
@@ -92,6 +189,7 @@ func (p *ProductTests) ProductCRUD(t *testing.T) {
 
 		req := httptest.NewRequest("POST", "/v1/products", body)
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+p.token)
 		resp := httptest.NewRecorder()
 
 		p.app.ServeHTTP(resp, req)
@@ -121,8 +219,14 @@ func (p *ProductTests) ProductCRUD(t *testing.T) {
 			"date_created": created["date_created"],
 			"date_updated": created["date_updated"],
 			"name":         "product0",
+			"tags":         []interface{}{},
+			"images":       []interface{}{},
 			"cost":         float64(55),
 			"quantity":     float64(6),
+			"sold":         float64(0),
+			"revenue":      float64(0),
+			"user_id":      "5cf37266-3473-4006-984f-9325122678b7",
+			"version":      float64(1),
 		}
 
 		if diff := cmp.Diff(want, created); diff != "" {
@@ -134,6 +238,7 @@ func (p *ProductTests) ProductCRUD(t *testing.T) {
 		url := fmt.Sprintf("/v1/products/%s", created["id"])
 		req := httptest.NewRequest("GET", url, nil)
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+p.token)
 		resp := httptest.NewRecorder()
 
 		p.app.ServeHTTP(resp, req)
@@ -154,3 +259,85 @@ func (p *ProductTests) ProductCRUD(t *testing.T) {
 		}
 	}
 }
+
+// UserPermissions checks that regular users can create and update their own
+// products but deleting them and recording their sales is left to admins.
+func (p *ProductTests) UserPermissions(t *testing.T) {
+	do := func(method, url, body, token string, want int) *httptest.ResponseRecorder {
+		t.Helper()
+
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+
+		p.app.ServeHTTP(resp, req)
+
+		if resp.Code != want {
+			t.Fatalf("%s %s: expected status code %v, got %v: %s", method, url, want, resp.Code, resp.Body)
+		}
+		return resp
+	}
+
+	resp := do("POST", "/v1/products", `{"name":"product1", "cost":10, "quantity": 3}`, p.userToken, http.StatusCreated)
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+	url := fmt.Sprintf("/v1/products/%s", created["id"])
+
+	resp = do("PUT", url, `{"cost":12}`, p.userToken, http.StatusNoContent)
+	if exp, got := fmt.Sprintf(`"%v"`, created["version"].(float64)+1), resp.Header().Get("ETag"); exp != got {
+		t.Fatalf("expected ETag %s after updating, got %s", exp, got)
+	}
+	do("POST", url+"/sales", `{"quantity":1, "paid":12}`, p.userToken, http.StatusForbidden)
+	do("DELETE", url, "", p.userToken, http.StatusForbidden)
+
+	do("POST", url+"/sales", `{"quantity":1, "paid":12}`, p.token, http.StatusCreated)
+	do("DELETE", url, "", p.token, http.StatusNoContent)
+}
+
+// RoleManagers checks that the last role able to manage roles can not lose
+// that permission.
+func (p *ProductTests) RoleManagers(t *testing.T) {
+	body := strings.NewReader(`{"permissions":["products:read"]}`)
+	req := httptest.NewRequest("PUT", "/v1/roles/"+auth.RoleAdmin, body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	resp := httptest.NewRecorder()
+
+	p.app.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusConflict {
+		t.Fatalf("expected status code %v, got %v: %s", http.StatusConflict, resp.Code, resp.Body)
+	}
+}
+
+// UserManagers checks that a role other than ADMIN given users:manage can
+// unlock users. It changes the USER role so it runs last.
+func (p *ProductTests) UserManagers(t *testing.T) {
+	do := func(method, url, body, token string, want int) {
+		t.Helper()
+
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp := httptest.NewRecorder()
+
+		p.app.ServeHTTP(resp, req)
+
+		if resp.Code != want {
+			t.Fatalf("%s %s: expected status code %v, got %v: %s", method, url, want, resp.Code, resp.Body)
+		}
+	}
+
+	const lockout = "/v1/users/5cf37266-3473-4006-984f-9325122678b7/lockout" // This is the seeded admin user.
+
+	do("DELETE", lockout, "", p.userToken, http.StatusForbidden)
+
+	perms := fmt.Sprintf(`{"permissions":[%q, %q]}`, auth.PermProductsWrite, auth.PermUsersManage)
+	do("PUT", "/v1/roles/"+auth.RoleUser, perms, p.token, http.StatusOK)
+
+	do("DELETE", lockout, "", p.userToken, http.StatusNoContent)
+}
@@ -0,0 +1,242 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+)
+
+var (
+	// ErrNotFound is used when a specific APIKey is requested but does not exist.
+	ErrNotFound = errors.New("api key not found")
+
+	// ErrInvalidID is used when an invalid UUID is provided.
+	ErrInvalidID = errors.New("ID is not in its proper UUID format")
+
+	// ErrForbidden occurs when a user asks for a key with roles they do not hold.
+	ErrForbidden = errors.New("attempted action is not allowed")
+
+	// ErrInvalidExpiry occurs when a key would expire before it is created.
+	ErrInvalidExpiry = errors.New("api key must expire in the future")
+
+	// ErrUnknownRole occurs when a key is given a role that does not exist.
+	ErrUnknownRole = errors.New("unknown role")
+
+	// ErrExpiryRequired occurs when a key without an expiry is given a role
+	// requiring two-factor authentication, which keys can never pass.
+	ErrExpiryRequired = errors.New("api keys with roles requiring two-factor authentication must expire")
+)
+
+// keyPrefix starts every key so they are easy to recognise, for instance by
+// secret scanners.
+const keyPrefix = "gsk_"
+
+// claimsTTL is how long the claims made from a key last. They only live for
+// the request that presented the key.
+const claimsTTL = time.Minute
+
+// lastUsedPrecision is how stale the last use of a key may get before it is
+// recorded again. It spares a write on every request made with a busy key.
+const lastUsedPrecision = time.Minute
+
+// List gets all APIKeys from the database.
+func List(ctx context.Context, db *sqlx.DB) ([]APIKey, error) {
+	keys := make([]APIKey, 0)
+
+	const q = `SELECT * FROM api_keys ORDER BY date_created`
+	if err := db.SelectContext(ctx, &keys, q); err != nil {
+		return nil, errors.Wrap(err, "selecting api keys")
+	}
+
+	return keys, nil
+}
+
+// Create makes a new APIKey acting for the user of the claims. The key is only
+// returned here; just its hash is stored.
+func Create(ctx context.Context, db *sqlx.DB, user auth.Claims, nk NewAPIKey, now time.Time) (*Created, error) {
+	for _, role := range nk.Roles {
+		if !user.HasRole(role) {
+			return nil, ErrForbidden
+		}
+	}
+
+	if nk.ExpiresAt != nil && !nk.ExpiresAt.After(now) {
+		return nil, ErrInvalidExpiry
+	}
+
+	var roles []struct {
+		Name       string `db:"name"`
+		RequireMFA bool   `db:"require_mfa"`
+	}
+
+	const check = `SELECT name, require_mfa FROM roles WHERE name = ANY($1)`
+	if err := db.SelectContext(ctx, &roles, check, pq.Array(nk.Roles)); err != nil {
+		return nil, errors.Wrap(err, "selecting api key roles")
+	}
+
+	known := make(map[string]bool, len(roles))
+	for _, r := range roles {
+		known[r.Name] = true
+		if r.RequireMFA && nk.ExpiresAt == nil {
+			return nil, ErrExpiryRequired
+		}
+	}
+	for _, role := range nk.Roles {
+		if !known[role] {
+			return nil, errors.Wrap(ErrUnknownRole, role)
+		}
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+
+	k := Created{
+		APIKey: APIKey{
+			ID:          uuid.New().String(),
+			UserID:      user.Subject,
+			Name:        nk.Name,
+			Prefix:      key[:len(keyPrefix)+8],
+			KeyHash:     hashKey(key),
+			Roles:       nk.Roles,
+			DateCreated: now.UTC(),
+			DateUpdated: now.UTC(),
+		},
+		Key: key,
+	}
+	if nk.ExpiresAt != nil {
+		expires := nk.ExpiresAt.UTC()
+		k.ExpiresAt = &expires
+	}
+
+	const q = `INSERT INTO api_keys
+		(key_id, user_id, name, prefix, key_hash, roles, expires_at, date_created, date_updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = db.ExecContext(ctx, q,
+		k.ID, k.UserID, k.Name, k.Prefix, k.KeyHash, k.Roles,
+		k.ExpiresAt, k.DateCreated, k.DateUpdated)
+	if err != nil {
+		return nil, errors.Wrap(err, "inserting api key")
+	}
+
+	return &k, nil
+}
+
+// Delete removes the APIKey identified by a given ID. The key stops working
+// right away.
+func Delete(ctx context.Context, db *sqlx.DB, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `DELETE FROM api_keys WHERE key_id = $1`
+
+	res, err := db.ExecContext(ctx, q, id)
+	if err != nil {
+		return errors.Wrapf(err, "deleting api key %s", id)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "counting deleted api keys")
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Authenticate finds the APIKey of a key and gives back claims acting for the
+// user who created it. The claims only hold those roles of the key that the
+// user still has. It returns auth.ErrInvalidAPIKey for unknown and expired
+// keys. The last use of the key is only recorded about once a minute.
+func Authenticate(ctx context.Context, db *sqlx.DB, key string, now time.Time) (auth.Claims, error) {
+	var k struct {
+		APIKey
+		UserRoles pq.StringArray `db:"user_roles"`
+	}
+
+	const q = `SELECT k.*, u.roles AS user_roles
+		FROM api_keys AS k
+		JOIN users AS u ON u.user_id = k.user_id
+		WHERE k.key_hash = $1`
+
+	if err := db.GetContext(ctx, &k, q, hashKey(key)); err != nil {
+		if err == sql.ErrNoRows {
+			return auth.Claims{}, auth.ErrInvalidAPIKey
+		}
+		return auth.Claims{}, errors.Wrap(err, "selecting api key")
+	}
+
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return auth.Claims{}, auth.ErrInvalidAPIKey
+	}
+
+	held := auth.Claims{Roles: k.UserRoles}
+	roles := make([]string, 0, len(k.Roles))
+	for _, role := range k.Roles {
+		if held.HasRole(role) {
+			roles = append(roles, role)
+		}
+	}
+
+	if k.LastUsed == nil || now.Sub(*k.LastUsed) >= lastUsedPrecision {
+		const used = `UPDATE api_keys SET last_used = $2
+			WHERE key_id = $1 AND (last_used IS NULL OR last_used < $3)`
+
+		stale := now.Add(-lastUsedPrecision).UTC()
+		if _, err := db.ExecContext(ctx, used, k.ID, now.UTC(), stale); err != nil {
+			return auth.Claims{}, errors.Wrap(err, "recording api key use")
+		}
+	}
+
+	claims := auth.NewClaims(k.UserID, roles, now, claimsTTL)
+	claims.APIKey = k.ID
+
+	return claims, nil
+}
+
+// Verifier checks API keys against the database. It implements
+// auth.KeyVerifier.
+type Verifier struct {
+	db *sqlx.DB
+}
+
+// NewVerifier makes a Verifier reading keys from db.
+func NewVerifier(db *sqlx.DB) *Verifier {
+	return &Verifier{db: db}
+}
+
+// VerifyKey implements the auth.KeyVerifier interface.
+func (v *Verifier) VerifyKey(ctx context.Context, key string) (auth.Claims, error) {
+	return Authenticate(ctx, v.db, key, time.Now())
+}
+
+// newKey generates a random key.
+func newKey() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", errors.Wrap(err, "generating api key")
+	}
+	return keyPrefix + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// hashKey gives the hash a key is stored under. Keys are long and random so a
+// fast hash is enough.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
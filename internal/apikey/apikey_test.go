@@ -0,0 +1,115 @@
+package apikey_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/apikey"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/user"
+)
+
+func TestAPIKey(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	nu := user.NewUser{
+		Name:            "Bill Kennedy",
+		Email:           "bill@ardanlabs.com",
+		Roles:           []string{auth.RoleAdmin, auth.RoleUser},
+		Password:        "gophers",
+		PasswordConfirm: "gophers",
+	}
+	u, err := user.Create(ctx, db, nu, now)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	owner := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	limited := auth.NewClaims(u.ID, []string{auth.RoleUser}, now, time.Hour)
+
+	nk := apikey.NewAPIKey{Name: "Tablet 1", Roles: []string{auth.RoleAdmin}}
+	if _, err := apikey.Create(ctx, db, limited, nk, now); err != apikey.ErrForbidden {
+		t.Fatalf("expected %v granting a role not held, got %v", apikey.ErrForbidden, err)
+	}
+
+	past := now.Add(-time.Hour)
+	if _, err := apikey.Create(ctx, db, owner, apikey.NewAPIKey{Name: "Old", Roles: []string{auth.RoleUser}, ExpiresAt: &past}, now); err != apikey.ErrInvalidExpiry {
+		t.Fatalf("expected %v creating an expired key, got %v", apikey.ErrInvalidExpiry, err)
+	}
+
+	unknown := auth.NewClaims(u.ID, []string{"OWNER"}, now, time.Hour)
+	if _, err := apikey.Create(ctx, db, unknown, apikey.NewAPIKey{Name: "Tablet 1", Roles: []string{"OWNER"}}, now); errors.Cause(err) != apikey.ErrUnknownRole {
+		t.Fatalf("expected %v granting a role that does not exist, got %v", apikey.ErrUnknownRole, err)
+	}
+
+	// Keys can never pass two-factor authentication so they must expire.
+	if _, err := db.ExecContext(ctx, `UPDATE roles SET require_mfa = TRUE WHERE name = $1`, auth.RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apikey.Create(ctx, db, owner, apikey.NewAPIKey{Name: "Tablet 1", Roles: []string{auth.RoleAdmin}}, now); err != apikey.ErrExpiryRequired {
+		t.Fatalf("expected %v creating a key that never expires, got %v", apikey.ErrExpiryRequired, err)
+	}
+
+	expires := now.Add(24 * time.Hour)
+	nk = apikey.NewAPIKey{Name: "Tablet 1", Roles: []string{auth.RoleUser}, ExpiresAt: &expires}
+	k, err := apikey.Create(ctx, db, owner, nk, now)
+	if err != nil {
+		t.Fatalf("creating api key: %v", err)
+	}
+
+	claims, err := apikey.Authenticate(ctx, db, k.Key, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("authenticating with api key: %v", err)
+	}
+	if claims.Subject != u.ID || claims.APIKey != k.ID {
+		t.Fatalf("expected claims of user %s and key %s, got %+v", u.ID, k.ID, claims)
+	}
+	if !claims.HasRole(auth.RoleUser) || claims.HasRole(auth.RoleAdmin) {
+		t.Fatalf("expected only the roles of the key, got %v", claims.Roles)
+	}
+
+	keys, err := apikey.List(ctx, db)
+	if err != nil {
+		t.Fatalf("listing api keys: %v", err)
+	}
+	if len(keys) != 1 || keys[0].LastUsed == nil {
+		t.Fatalf("expected one key marked as used, got %+v", keys)
+	}
+	lastUsed := *keys[0].LastUsed
+
+	// Uses within a minute of the last recorded one are not written.
+	if _, err := apikey.Authenticate(ctx, db, k.Key, now.Add(90*time.Second)); err != nil {
+		t.Fatalf("authenticating with api key: %v", err)
+	}
+	keys, err = apikey.List(ctx, db)
+	if err != nil {
+		t.Fatalf("listing api keys: %v", err)
+	}
+	if !keys[0].LastUsed.Equal(lastUsed) {
+		t.Fatalf("expected last use to stay at %v, got %v", lastUsed, keys[0].LastUsed)
+	}
+
+	if _, err := apikey.Authenticate(ctx, db, "gsk_unknown", now); err != auth.ErrInvalidAPIKey {
+		t.Fatalf("expected %v for an unknown key, got %v", auth.ErrInvalidAPIKey, err)
+	}
+	if _, err := apikey.Authenticate(ctx, db, k.Key, expires); err != auth.ErrInvalidAPIKey {
+		t.Fatalf("expected %v for an expired key, got %v", auth.ErrInvalidAPIKey, err)
+	}
+
+	if err := apikey.Delete(ctx, db, k.ID); err != nil {
+		t.Fatalf("deleting api key: %v", err)
+	}
+	if _, err := apikey.Authenticate(ctx, db, k.Key, now); err != auth.ErrInvalidAPIKey {
+		t.Fatalf("expected %v for a deleted key, got %v", auth.ErrInvalidAPIKey, err)
+	}
+	if err := apikey.Delete(ctx, db, k.ID); err != apikey.ErrNotFound {
+		t.Fatalf("expected %v deleting twice, got %v", apikey.ErrNotFound, err)
+	}
+}
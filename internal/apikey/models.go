@@ -0,0 +1,40 @@
+package apikey
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// APIKey lets a machine client such as a point-of-sale tablet call the API
+// without a user's password. The key itself is only known to the client; we
+// keep a hash of it and its first characters so people can tell keys apart.
+type APIKey struct {
+	ID          string         `db:"key_id" json:"id"`
+	UserID      string         `db:"user_id" json:"user_id"`
+	Name        string         `db:"name" json:"name"`
+	Prefix      string         `db:"prefix" json:"prefix"`
+	KeyHash     string         `db:"key_hash" json:"-"`
+	Roles       pq.StringArray `db:"roles" json:"roles"`
+	ExpiresAt   *time.Time     `db:"expires_at" json:"expires_at,omitempty"`
+	LastUsed    *time.Time     `db:"last_used" json:"last_used,omitempty"`
+	DateCreated time.Time      `db:"date_created" json:"date_created"`
+	DateUpdated time.Time      `db:"date_updated" json:"date_updated"`
+}
+
+// NewAPIKey is what we require from clients when creating an APIKey. The
+// roles must exist and be held by the user creating the key. Keys without an
+// ExpiresAt never expire, which is not allowed for roles requiring two-factor
+// authentication.
+type NewAPIKey struct {
+	Name      string     `json:"name" validate:"required"`
+	Roles     []string   `json:"roles" validate:"required,dive,required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Created is a newly created APIKey along with the key itself. It is the only
+// time the key is available.
+type Created struct {
+	APIKey
+	Key string `json:"key"`
+}
@@ -0,0 +1,155 @@
+package category
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound      = errors.New("Category not found")
+	ErrInvalidID     = errors.New("id provided was not a valid UUID")
+	ErrDuplicateName = errors.New("a category with that name already exists")
+)
+
+// List returns all known Categories ordered by name.
+func List(ctx context.Context, db *sqlx.DB) ([]Category, error) {
+	list := make([]Category, 0)
+
+	const q = `SELECT * FROM categories ORDER BY name`
+	if err := db.SelectContext(ctx, &list, q); err != nil {
+		return nil, errors.Wrap(err, "selecting categories")
+	}
+
+	return list, nil
+}
+
+// Retrieve returns a single Category.
+func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Category, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var c Category
+
+	const q = `SELECT * FROM categories WHERE category_id = $1`
+	if err := db.GetContext(ctx, &c, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting category %q", id)
+	}
+
+	return &c, nil
+}
+
+// Create makes a new Category.
+func Create(ctx context.Context, db *sqlx.DB, nc NewCategory, now time.Time) (*Category, error) {
+	c := Category{
+		ID:          uuid.New().String(),
+		Name:        nc.Name,
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+
+	const q = `INSERT INTO categories
+		(category_id, name, date_created, date_updated)
+		VALUES ($1, $2, $3, $4)`
+
+	if _, err := db.ExecContext(ctx, q, c.ID, c.Name, c.DateCreated, c.DateUpdated); err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicateName
+		}
+		return nil, errors.Wrap(err, "inserting category")
+	}
+
+	return &c, nil
+}
+
+// Update modifies data about a Category. It will error if the specified ID is
+// invalid or does not reference an existing category.
+func Update(ctx context.Context, db *sqlx.DB, id string, update UpdateCategory, now time.Time) error {
+	c, err := Retrieve(ctx, db, id)
+	if err != nil {
+		return err
+	}
+
+	if update.Name != nil {
+		c.Name = *update.Name
+	}
+	c.DateUpdated = now.UTC()
+
+	const q = `UPDATE categories SET
+		"name" = $2,
+		"date_updated" = $3
+		WHERE category_id = $1`
+
+	if _, err := db.ExecContext(ctx, q, id, c.Name, c.DateUpdated); err != nil {
+		if isUniqueViolation(err) {
+			return ErrDuplicateName
+		}
+		return errors.Wrap(err, "updating category")
+	}
+
+	return nil
+}
+
+// Delete removes the category identified by a given ID. Its products are kept
+// without a category.
+func Delete(ctx context.Context, db *sqlx.DB, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `DELETE FROM categories WHERE category_id = $1`
+
+	if _, err := db.ExecContext(ctx, q, id); err != nil {
+		return errors.Wrapf(err, "deleting category %s", id)
+	}
+
+	return nil
+}
+
+// Summaries rolls up the sales of the products of every Category. Archived
+// products are included so the figures match the revenue actually made.
+func Summaries(ctx context.Context, db *sqlx.DB) ([]Summary, error) {
+	list := make([]Summary, 0)
+
+	const q = `SELECT
+			c.category_id, c.name,
+			COUNT(p.product_id) AS products,
+			COALESCE(SUM(s.quantity), 0) - COALESCE(SUM(r.quantity), 0) AS sold,
+			COALESCE(SUM(s.paid), 0) - COALESCE(SUM(r.amount), 0) AS revenue
+		FROM categories AS c
+		LEFT JOIN products AS p ON p.category_id = c.category_id
+		LEFT JOIN (
+			SELECT product_id, SUM(quantity) AS quantity, SUM(paid) AS paid
+			FROM sales
+			GROUP BY product_id
+		) AS s ON p.product_id = s.product_id
+		LEFT JOIN (
+			SELECT product_id, SUM(quantity) AS quantity, SUM(amount) AS amount
+			FROM refunds
+			GROUP BY product_id
+		) AS r ON p.product_id = r.product_id
+		GROUP BY c.category_id
+		ORDER BY revenue DESC, c.name`
+
+	if err := db.SelectContext(ctx, &list, q); err != nil {
+		return nil, errors.Wrap(err, "selecting category summaries")
+	}
+
+	return list, nil
+}
+
+// isUniqueViolation reports whether err was caused by a duplicate value in a
+// unique column.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
@@ -0,0 +1,72 @@
+package category_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/category"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/product"
+)
+
+func TestCategories(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	claims := auth.NewClaims(
+		"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+		[]string{auth.RoleAdmin, auth.RoleUser},
+		now, time.Hour,
+	)
+
+	c, err := category.Create(ctx, db, category.NewCategory{Name: "Toys"}, now)
+	if err != nil {
+		t.Fatalf("creating category: %v", err)
+	}
+
+	if _, err := category.Create(ctx, db, category.NewCategory{Name: "Toys"}, now); err != category.ErrDuplicateName {
+		t.Fatalf("expected %v for a duplicate name, got %v", category.ErrDuplicateName, err)
+	}
+
+	np := product.NewProduct{
+		Name:       "Yo-yo",
+		Cost:       5,
+		Quantity:   10,
+		CategoryID: &c.ID,
+		Tags:       []string{"Vintage", "vintage ", "wood"},
+	}
+
+	p, err := product.Create(ctx, db, claims, np, now)
+	if err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+
+	if _, err := product.AddSale(ctx, db, claims, product.NewSale{Quantity: 2, Paid: 8}, p.ID, now); err != nil {
+		t.Fatalf("adding sale: %v", err)
+	}
+
+	ps, err := product.List(ctx, db, product.ListQuery{CategoryID: c.ID, Tags: []string{"VINTAGE"}})
+	if err != nil {
+		t.Fatalf("listing products: %v", err)
+	}
+	if exp, got := 1, len(ps.Products); exp != got {
+		t.Fatalf("expected %d product in category, got %d", exp, got)
+	}
+	if exp, got := 2, len(ps.Products[0].Tags); exp != got {
+		t.Fatalf("expected %d normalized tags, got %v", exp, ps.Products[0].Tags)
+	}
+
+	sums, err := category.Summaries(ctx, db)
+	if err != nil {
+		t.Fatalf("summarizing categories: %v", err)
+	}
+	if exp, got := 8, sums[0].Revenue; exp != got {
+		t.Fatalf("expected category revenue %d, got %d", exp, got)
+	}
+}
@@ -0,0 +1,33 @@
+package category
+
+import "time"
+
+// Category groups Products that are priced and laid out together.
+type Category struct {
+	ID          string    `db:"category_id" json:"id"`
+	Name        string    `db:"name" json:"name"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+	DateUpdated time.Time `db:"date_updated" json:"date_updated"`
+}
+
+// NewCategory is what we require from clients to make a new Category.
+type NewCategory struct {
+	Name string `json:"name" validate:"required"`
+}
+
+// UpdateCategory defines what information may be provided to modify an
+// existing Category. All fields are optional so clients can send just the
+// fields they want changed.
+type UpdateCategory struct {
+	Name *string `json:"name" validate:"omitempty,min=1"`
+}
+
+// Summary rolls up the sales of every Product of a Category. Sold and Revenue
+// are net of refunds.
+type Summary struct {
+	ID       string `db:"category_id" json:"id"`
+	Name     string `db:"name" json:"name"`
+	Products int    `db:"products" json:"products"`
+	Sold     int    `db:"sold" json:"sold"`
+	Revenue  int    `db:"revenue" json:"revenue"`
+}
@@ -16,8 +16,12 @@ var (
 		errors.New("you are not authorized for that action"), http.StatusForbidden)
 )
 
-// Authenticate validates a JWT from the Authorization header.
-func Authenticate(authenticator *auth.Authenticator) web.Middleware {
+// Authenticate validates a JWT or an API key from the Authorization header.
+// Tokens that have been revoked are rejected when revocations is not nil. API
+// keys are only accepted when keys is not nil. The permissions of the claims
+// are resolved from their roles when permissions is not nil.
+func Authenticate(authenticator *auth.Authenticator, revocations auth.Revocations, keys auth.KeyVerifier,
+	permissions auth.PermissionResolver) web.Middleware {
 	// This is the actual middleware function to be executed.
 	f := func(after web.Handler) web.Handler {
 		// Wrap this handler around the next one provided
@@ -25,19 +29,68 @@ func Authenticate(authenticator *auth.Authenticator) web.Middleware {
 			ctx, span := trace.StartSpan(ctx, "internal.mid.Authenticate")
 			defer span.End()
 			//  Parse the authorization header. Expected header is of
-			//c the format 'Bearer <token>.'
+			//c the format 'Bearer <token>' or 'ApiKey <key>'.
 			parts := strings.Split(r.Header.Get("Authorization"), " ")
-			if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
-				err := errors.New("expected authorization header format: Bearer <token>")
+			if len(parts) != 2 {
+				err := errors.New("expected authorization header format: Bearer <token> or ApiKey <key>")
 				return web.NewRequestError(err, http.StatusUnauthorized)
 			}
 
-			_, span = trace.StartSpan(ctx, "internal.auth.ParseClaims")
-			claims, err := authenticator.ParseClaims(parts[1])
-			if err != nil {
+			var claims auth.Claims
+
+			switch strings.ToLower(parts[0]) {
+			case "bearer":
+				_, span = trace.StartSpan(ctx, "internal.auth.ParseClaims")
+				var err error
+				claims, err = authenticator.ParseClaims(parts[1])
+				if err != nil {
+					return web.NewRequestError(err, http.StatusUnauthorized)
+				}
+				span.End()
+
+				if revocations != nil {
+					revoked, err := revocations.Revoked(ctx, claims)
+					if err != nil {
+						return errors.Wrap(err, "checking token revocation")
+					}
+					if revoked {
+						err := errors.New("token has been revoked")
+						return web.NewRequestError(err, http.StatusUnauthorized)
+					}
+				}
+
+			case "apikey":
+				if keys == nil {
+					err := errors.New("api keys are not accepted")
+					return web.NewRequestError(err, http.StatusUnauthorized)
+				}
+
+				var err error
+				claims, err = keys.VerifyKey(ctx, parts[1])
+				if err != nil {
+					if errors.Cause(err) == auth.ErrInvalidAPIKey {
+						return web.NewRequestError(err, http.StatusUnauthorized)
+					}
+					return errors.Wrap(err, "verifying api key")
+				}
+
+			default:
+				err := errors.New("expected authorization header format: Bearer <token> or ApiKey <key>")
 				return web.NewRequestError(err, http.StatusUnauthorized)
 			}
-			span.End()
+
+			if permissions != nil {
+				perms, err := permissions.Resolve(ctx, claims.Roles)
+				if err != nil {
+					return errors.Wrap(err, "resolving permissions")
+				}
+				claims.Permissions = append(make([]string, 0, len(perms)), perms...)
+			}
+
+			// Record who made the request so it can be logged.
+			if v, ok := ctx.Value(web.KeyValues).(*web.Values); ok {
+				v.UserID = claims.Subject
+			}
 
 			// Add claims to the context so they can be retrieved later.
 			ctx = context.WithValue(ctx, auth.Key, claims)
@@ -75,3 +128,30 @@ func HasRoles(roles ...string) web.Middleware {
 
 	return f
 }
+
+// RequirePermission validates that an authenticated user holds every one of
+// the specified permissions.
+func RequirePermission(perms ...string) web.Middleware {
+	// This is the actual middleware function to be executed
+	f := func(after web.Handler) web.Handler {
+		h := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+			ctx, span := trace.StartSpan(ctx, "internal.mid.RequirePermission")
+			defer span.End()
+
+			claims, ok := ctx.Value(auth.Key).(auth.Claims)
+			if !ok {
+				return errors.New("claims missing from context: RequirePermission called without/before Authentication")
+			}
+
+			if !claims.HasPermission(perms...) {
+				return ErrForbidden
+			}
+
+			return after(ctx, w, r)
+		}
+
+		return h
+	}
+
+	return f
+}
@@ -2,33 +2,47 @@ package middleware
 
 import (
 	"context"
-	"log"
 	"net/http"
 
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
 	"go.opencensus.io/trace"
 )
 
 // Errors handles errors coming out of the call chain. It detects normal
 // application errors which are used to respond to the client in a uniform way.
-// Unexpected errors (status >= 500) are logged.
-func Errors(log *log.Logger) web.Middleware {
+// Errors the client caused are logged at the debug level. Unexpected errors
+// (status >= 500) are kept in the request values for Logger to write along
+// with the request so they are not logged twice.
+func Errors(log *logger.Logger) web.Middleware {
 	// This is the actual middleware function to be executed.
 	f := func(before web.Handler) web.Handler {
 		h := func(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
 			ctx, span := trace.StartSpan(ctx, "internal.mid.errros")
 			defer span.End()
 
+			v, ok := ctx.Value(web.KeyValues).(*web.Values)
+			if !ok {
+				return web.NewShutdownError("web values missing from context")
+			}
+
 			// Run the handler chain and catch any propagated error.
 			if err := before(ctx, writer, request); err != nil {
-				// Log the error
-				log.Printf("ERROR: %+v", err)
+				// A streamed response keeps the status it was sent with.
+				streamed := v.Written
 
 				// Respond to the error.
 				if err := web.RespondError(ctx, writer, err); err != nil {
 					return err
 				}
 
+				// Log the error
+				if streamed || v.StatusCode >= http.StatusInternalServerError {
+					v.Err = err
+				} else {
+					log.Debug("request rejected", "trace_id", v.TraceID, "status", v.StatusCode, "error", err)
+				}
+
 				// Ensure that shutdown errors are allowed to bubble up to web.go
 				if web.IsShutdown(err) {
 					return err
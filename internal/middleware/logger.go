@@ -2,17 +2,20 @@ package middleware
 
 import (
 	"context"
-	"log"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
 	"go.opencensus.io/trace"
 )
 
-// Logger writes some information about the request to the logs in the
-// format: TraceID : (200) GET /foo -> IP ADDR (latency)
-func Logger(log *log.Logger) web.Middleware {
+// Logger writes an entry about every request holding its trace id, method,
+// path, status, latency and the user who made it when they authenticated.
+// Server errors are logged at the error level along with the error kept by
+// Errors.
+func Logger(log *logger.Logger) web.Middleware {
 	// This is the actual middleware function to be executed.
 	f := func(before web.Handler) web.Handler {
 		h := func(ctx context.Context, writer http.ResponseWriter, request *http.Request) error {
@@ -27,10 +30,26 @@ func Logger(log *log.Logger) web.Middleware {
 			// Run the handler chain and catch any propagated error.
 			err := before(ctx, writer, request)
 
-			log.Printf(
-				"%s : (%d) : %s %s -> %s (%s)",
-				v.TraceID, v.StatusCode, request.Method, request.URL.Path, request.RemoteAddr, time.Since(v.Start),
-			)
+			kv := []interface{}{
+				"trace_id", v.TraceID,
+				"method", request.Method,
+				"path", request.URL.Path,
+				"status", v.StatusCode,
+				"latency_ms", float64(time.Since(v.Start).Microseconds()) / 1000,
+				"remote_addr", request.RemoteAddr,
+			}
+			if v.UserID != "" {
+				kv = append(kv, "user_id", v.UserID)
+			}
+			if v.Err != nil {
+				kv = append(kv, "error", fmt.Sprintf("%+v", v.Err))
+			}
+
+			if v.StatusCode >= http.StatusInternalServerError || v.Err != nil {
+				log.Error("request", kv...)
+			} else {
+				log.Info("request", kv...)
+			}
 
 			// Return the error to the handler further up the chain.
 			return err
@@ -2,25 +2,33 @@ package middleware
 
 import (
 	"context"
-	"expvar"
 	"net/http"
-	"runtime"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi"
+	"github.com/wgarcia4190/garagesale/internal/platform/metrics"
 	"github.com/wgarcia4190/garagesale/internal/platform/web"
 	"go.opencensus.io/trace"
 )
 
-// m contains the global program counters for the application.
+// m contains the request metrics of the application. Requests are labelled by
+// the route pattern rather than the raw path so ids do not make a series each.
 var m = struct {
-	gr  *expvar.Int
-	req *expvar.Int
-	err *expvar.Int
+	req      *metrics.Counter
+	latency  *metrics.Histogram
+	inFlight *metrics.Gauge
 }{
-	gr:  expvar.NewInt("goroutines"),
-	req: expvar.NewInt("requests"),
-	err: expvar.NewInt("errors"),
+	req: metrics.NewCounter("http_requests_total",
+		"HTTP requests served by route, method and status class.", "route", "method", "code"),
+	latency: metrics.NewHistogram("http_request_duration_seconds",
+		"Time taken to serve HTTP requests by route and method.", metrics.DefaultBuckets, "route", "method"),
+	inFlight: metrics.NewGauge("http_requests_in_flight",
+		"HTTP requests being served."),
 }
 
+// Metrics records the number, latency and status of requests. It must run
+// outside of Errors so the status of failed requests is known.
 func Metrics() web.Middleware {
 	// This is the actual middleware function to be executed.
 	f := func(before web.Handler) web.Handler {
@@ -29,21 +37,25 @@ func Metrics() web.Middleware {
 			ctx, span := trace.StartSpan(ctx, "internal.mid.metrics")
 			defer span.End()
 
-			err := before(ctx, writer, request)
+			v, ok := ctx.Value(web.KeyValues).(*web.Values)
+			if !ok {
+				return web.NewShutdownError("web values missing from context")
+			}
 
-			// increase the request counter
-			m.req.Add(1)
+			// The gauge is lowered even when a handler panics.
+			m.inFlight.Inc()
+			defer m.inFlight.Dec()
 
-			// Update the count for the number of active goroutines every 100 requests.
-			if m.req.Value()%100 == 0 {
-				m.gr.Set(int64(runtime.NumGoroutine()))
-			}
+			err := before(ctx, writer, request)
 
-			// Increment the errors counter if an error occurred on this request.
-			if err != nil {
-				m.err.Add(1)
+			route := request.URL.Path
+			if rc := chi.RouteContext(request.Context()); rc != nil {
+				route = rc.RoutePattern()
 			}
 
+			m.req.Inc(route, request.Method, statusClass(v.StatusCode, err))
+			m.latency.Observe(time.Since(v.Start).Seconds(), route, request.Method)
+
 			// Return the error so it can be handled further up the chain
 			return err
 		}
@@ -51,3 +63,15 @@ func Metrics() web.Middleware {
 	}
 	return f
 }
+
+// statusClass gives the class of a status such as 2xx. Requests ending in an
+// error nobody responded to count as server errors.
+func statusClass(status int, err error) string {
+	if status == 0 {
+		if err != nil {
+			return "5xx"
+		}
+		status = http.StatusOK
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
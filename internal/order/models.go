@@ -0,0 +1,38 @@
+package order
+
+import "time"
+
+// Order groups the sales of several products bought by one customer at once.
+// Quantity and Total are the sums of the Lines.
+type Order struct {
+	ID          string      `db:"order_id" json:"id"`
+	UserID      string      `db:"user_id" json:"user_id"`
+	Customer    string      `db:"customer" json:"customer"`
+	Lines       []OrderLine `db:"-" json:"lines"`
+	Quantity    int         `db:"-" json:"quantity"`
+	Total       int         `db:"-" json:"total"`
+	DateCreated time.Time   `db:"date_created" json:"date_created"`
+}
+
+// OrderLine is the sale of a single product within an Order. Each line is
+// stored as a product sale so it also shows up in the sales of that product.
+type OrderLine struct {
+	SaleID    string `db:"sale_id" json:"sale_id"`
+	ProductID string `db:"product_id" json:"product_id"`
+	Name      string `db:"name" json:"name"`
+	Quantity  int    `db:"quantity" json:"quantity"`
+	Paid      int    `db:"paid" json:"paid"`
+}
+
+// NewOrder is what we require from clients for recording a new Order.
+type NewOrder struct {
+	Customer string         `json:"customer"`
+	Lines    []NewOrderLine `json:"lines" validate:"required,min=1,dive"`
+}
+
+// NewOrderLine is what we require from clients for each line of a NewOrder.
+type NewOrderLine struct {
+	ProductID string `json:"product_id" validate:"required,uuid"`
+	Quantity  int    `json:"quantity" validate:"gte=1"`
+	Paid      int    `json:"paid" validate:"gte=0"`
+}
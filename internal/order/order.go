@@ -0,0 +1,141 @@
+package order
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/product"
+)
+
+var (
+	ErrNotFound  = errors.New("Order not found")
+	ErrInvalidID = errors.New("id provided was not a valid UUID")
+
+	// ErrForbidden occurs when a user asks for an Order they may not read.
+	ErrForbidden = errors.New("attempted action is not allowed")
+)
+
+// Create records an Order and a sale for each of its lines. Every line is
+// checked against the remaining stock of its product and nothing is recorded
+// unless all of them can be sold. It returns a *product.StockError for the
+// first line that asks for more units than are left.
+func Create(ctx context.Context, db *sqlx.DB, user auth.Claims, no NewOrder, now time.Time) (*Order, error) {
+	o := Order{
+		ID:          uuid.New().String(),
+		UserID:      user.Subject,
+		Customer:    no.Customer,
+		Lines:       make([]OrderLine, len(no.Lines)),
+		DateCreated: now.UTC(),
+	}
+
+	// Products are locked in a consistent order so two orders sharing some
+	// products can not deadlock each other.
+	idx := make([]int, len(no.Lines))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return no.Lines[idx[i]].ProductID < no.Lines[idx[j]].ProductID
+	})
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		const q = `INSERT INTO orders
+			(order_id, user_id, customer, date_created)
+			VALUES ($1, $2, $3, $4)`
+
+		if _, err := tx.ExecContext(ctx, q, o.ID, o.UserID, o.Customer, o.DateCreated); err != nil {
+			return errors.Wrap(err, "inserting order")
+		}
+
+		for _, i := range idx {
+			nl := no.Lines[i]
+			ns := product.NewSale{
+				Quantity: nl.Quantity,
+				Paid:     nl.Paid,
+			}
+
+			s, err := product.RecordSale(ctx, tx, ns, nl.ProductID, o.ID, now)
+			if err != nil {
+				return err
+			}
+
+			o.Lines[i] = OrderLine{
+				SaleID:    s.ID,
+				ProductID: s.ProductID,
+				Quantity:  s.Quantity,
+				Paid:      s.Paid,
+			}
+		}
+
+		const names = `SELECT name FROM products WHERE product_id = $1`
+		for i := range o.Lines {
+			if err := tx.GetContext(ctx, &o.Lines[i].Name, names, o.Lines[i].ProductID); err != nil {
+				return errors.Wrap(err, "selecting product name")
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	o.total()
+
+	return &o, nil
+}
+
+// Retrieve returns a single Order along with its lines. Users may only read
+// the orders they recorded unless they hold the permission to read all orders.
+func Retrieve(ctx context.Context, db *sqlx.DB, user auth.Claims, id string) (*Order, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	var o Order
+
+	const q = `SELECT order_id, user_id, customer, date_created FROM orders WHERE order_id = $1`
+	if err := db.GetContext(ctx, &o, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "selecting order")
+	}
+
+	if o.UserID != user.Subject && !user.HasPermission(auth.PermOrdersRead) {
+		return nil, ErrForbidden
+	}
+
+	o.Lines = make([]OrderLine, 0)
+
+	const lines = `SELECT
+			s.sale_id, s.product_id, p.name, s.quantity, s.paid
+		FROM sales AS s
+		JOIN products AS p ON p.product_id = s.product_id
+		WHERE s.order_id = $1
+		ORDER BY p.name, s.sale_id`
+
+	if err := db.SelectContext(ctx, &o.Lines, lines, id); err != nil {
+		return nil, errors.Wrap(err, "selecting order lines")
+	}
+
+	o.total()
+
+	return &o, nil
+}
+
+// total sums the lines of the Order into its totals.
+func (o *Order) total() {
+	o.Quantity, o.Total = 0, 0
+	for _, l := range o.Lines {
+		o.Quantity += l.Quantity
+		o.Total += l.Paid
+	}
+}
@@ -0,0 +1,91 @@
+package order_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/order"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/product"
+	"github.com/wgarcia4190/garagesale/internal/schema"
+)
+
+func TestOrders(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	claims := auth.NewClaims(
+		"5cf37266-3473-4006-984f-9325122678b7", // This is the seeded admin user.
+		[]string{auth.RoleAdmin, auth.RoleUser},
+		now, time.Hour,
+	)
+
+	const (
+		comics = "a2b0639f-2cc6-44b8-b97b-15d69dbb511e"
+		toys   = "72f8b983-3eb4-48db-9ed0-e45cc6bd716b"
+	)
+
+	no := order.NewOrder{
+		Customer: "Jane",
+		Lines: []order.NewOrderLine{
+			{ProductID: toys, Quantity: 2, Paid: 150},
+			{ProductID: comics, Quantity: 1, Paid: 50},
+		},
+	}
+
+	o, err := order.Create(ctx, db, claims, no, now)
+	if err != nil {
+		t.Fatalf("creating order: %v", err)
+	}
+
+	saved, err := order.Retrieve(ctx, db, claims, o.ID)
+	if err != nil {
+		t.Fatalf("retrieving order: %v", err)
+	}
+
+	other := auth.NewClaims(
+		"45b5fbd3-755f-4379-8f07-a58d4a30fa2f", // This is the seeded regular user.
+		[]string{auth.RoleUser},
+		now, time.Hour,
+	)
+	if _, err := order.Retrieve(ctx, db, other, o.ID); err != order.ErrForbidden {
+		t.Fatalf("expected %v retrieving the order of another user, got %v", order.ErrForbidden, err)
+	}
+	other.Permissions = []string{auth.PermOrdersRead}
+	if _, err := order.Retrieve(ctx, db, other, o.ID); err != nil {
+		t.Fatalf("retrieving order with %s: %v", auth.PermOrdersRead, err)
+	}
+
+	if exp, got := 3, saved.Quantity; exp != got {
+		t.Fatalf("expected order quantity %d, got %d", exp, got)
+	}
+	if exp, got := 200, saved.Total; exp != got {
+		t.Fatalf("expected order total %d, got %d", exp, got)
+	}
+
+	// An order with one line exceeding the stock must not record any line.
+	no.Lines[1].Quantity = 1000
+	if _, err := order.Create(ctx, db, claims, no, now); err == nil {
+		t.Fatal("expected an error when a line exceeds the stock")
+	}
+
+	sales, err := product.ListSales(ctx, db, toys)
+	if err != nil {
+		t.Fatalf("listing sales: %v", err)
+	}
+
+	// One seeded sale plus the line of the first order.
+	if exp, got := 2, len(sales); exp != got {
+		t.Fatalf("expected %d sales for the product, got %d", exp, got)
+	}
+}
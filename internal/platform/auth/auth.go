@@ -1,8 +1,10 @@
 package auth
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"fmt"
+	"time"
+
 	"github.com/pkg/errors"
 
 	"github.com/dgrijalva/jwt-go"
@@ -17,13 +19,13 @@ import (
 //
 // * Key-id-to-public-key resolution is usually accomplished via a public JWKS
 // endpoint. See https://auth0.com/docs/jwks for more details.
-type KeyLookupFunc func(kid string) (*rsa.PublicKey, error)
+type KeyLookupFunc func(kid string) (crypto.PublicKey, error)
 
 // NewSimpleKeyLookupFunc is a simple implementation of KeyFunc that only even
 // supports one key. This is easy for development but in production should be
 // replaced with a caching layer that calls a JWKS endpoint.
-func NewSimpleKeyLookupFunc(activeKID string, publicKey *rsa.PublicKey) KeyLookupFunc {
-	f := func(kid string) (*rsa.PublicKey, error) {
+func NewSimpleKeyLookupFunc(activeKID string, publicKey crypto.PublicKey) KeyLookupFunc {
+	f := func(kid string) (crypto.PublicKey, error) {
 		if activeKID != kid {
 			return nil, fmt.Errorf("unrecognized key id %q", kid)
 		}
@@ -33,22 +35,35 @@ func NewSimpleKeyLookupFunc(activeKID string, publicKey *rsa.PublicKey) KeyLooku
 	return f
 }
 
+// Config sets who tokens are issued by and meant for. Tokens are generated
+// with the Issuer and Audience and must carry them to be accepted when they
+// are not blank. Leeway allows for clock skew between the machines that issue
+// and check tokens when checking the times in their claims.
+type Config struct {
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
 // Authenticator is used to authenticate clients. It can generate a token for a
-// set of user claims and recreate the claims by parsing the token.
+// set of user claims and recreate the claims by parsing the token. Tokens are
+// signed with RSA, ECDSA or Ed25519 keys. RSA keys use the algorithm of the
+// Authenticator while the algorithm of other keys follows from their type.
 type Authenticator struct {
-	privateKey       *rsa.PrivateKey
-	activeKID        string
+	keys             *KeySet
 	algorithm        string
 	pubKeyLookupFunc KeyLookupFunc
 	parser           *jwt.Parser
+	cfg              Config
 }
 
 // NewAuthenticator create an *Authenticator for use. It will error if:
 // - The private key is nil.
 // - The public key func is nil.
 // - The key ID is blank.
-// - The specified algorithm is unsupported
-func NewAuthenticator(privateKey *rsa.PrivateKey, activeKID, algorithm string, publicKeyLookupFunc KeyLookupFunc) (*Authenticator, error) {
+// - The specified algorithm is not an RSA algorithm.
+// - The type of the private key is unsupported.
+func NewAuthenticator(privateKey crypto.Signer, activeKID, algorithm string, publicKeyLookupFunc KeyLookupFunc, cfg Config) (*Authenticator, error) {
 	if privateKey == nil {
 		return nil, errors.New("private key cannot be nil")
 	}
@@ -56,39 +71,103 @@ func NewAuthenticator(privateKey *rsa.PrivateKey, activeKID, algorithm string, p
 	if activeKID == "" {
 		return nil, errors.New("active kid cannot be blank")
 	}
-	if jwt.GetSigningMethod(algorithm) == nil {
-		return nil, errors.Errorf("unknown algorithm %v", algorithm)
+	if !rsaAlgorithms[algorithm] {
+		return nil, errors.Errorf("unknown RSA algorithm %v", algorithm)
+	}
+	if _, err := keyAlgorithm(privateKey.Public(), algorithm); err != nil {
+		return nil, err
 	}
 	if publicKeyLookupFunc == nil {
 		return nil, errors.New("public key function cannot be nil")
 	}
 
 	// Create the token parser to use. The algorithm used to sign the JWT must be
-	// validated to avoid a critical vulnerability.
+	// validated to avoid a critical vulnerability. The parser only accepts the
+	// asymmetric algorithms we support and ParseClaims checks that the
+	// algorithm matches the key named by the token.
 	// https://auth0.com/blog/critical-vulnerabilities-in-json-web-token-libraries/
+	//
+	// The claims are validated by ParseClaims so the leeway can be applied.
 	parser := jwt.Parser{
-		ValidMethods: []string{algorithm},
+		ValidMethods:         validMethods,
+		SkipClaimsValidation: true,
+	}
+
+	keys := NewKeySet()
+	keys.AddPrivate(activeKID, privateKey)
+	if err := keys.Activate(activeKID); err != nil {
+		return nil, err
 	}
 
 	a := Authenticator{
-		privateKey:       privateKey,
-		activeKID:        activeKID,
+		keys:             keys,
 		algorithm:        algorithm,
 		pubKeyLookupFunc: publicKeyLookupFunc,
 		parser:           &parser,
+		cfg:              cfg,
 	}
 
 	return &a, nil
 }
 
-// GenerateToken generates a signed JWT token string representing the user Claims.
+// NewKeySetAuthenticator creates an *Authenticator signing tokens with the
+// active key of a KeySet and verifying them with any key of the set that is
+// not retired.
+func NewKeySetAuthenticator(keys *KeySet, algorithm string, cfg Config) (*Authenticator, error) {
+	kid, key := keys.Active()
+	if key == nil {
+		return nil, errors.New("key set has no active key")
+	}
+
+	a, err := NewAuthenticator(key, kid, algorithm, keys.Lookup, cfg)
+	if err != nil {
+		return nil, err
+	}
+	a.keys = keys
+
+	return a, nil
+}
+
+// Issuer gives the name tokens are issued under.
+func (a *Authenticator) Issuer() string {
+	return a.cfg.Issuer
+}
+
+// Ready returns nil when a key is loaded to sign tokens with.
+func (a *Authenticator) Ready() error {
+	if kid, key := a.keys.Active(); key == nil {
+		return errors.Errorf("signing key %q not loaded", kid)
+	}
+	return nil
+}
+
+// JWKS gives the public keys clients can verify our tokens with.
+func (a *Authenticator) JWKS() JWKS {
+	return a.keys.JWKS(a.algorithm)
+}
+
+// GenerateToken generates a signed JWT token string representing the user
+// Claims. The configured issuer and audience are filled in when the claims do
+// not name their own.
 func (a *Authenticator) GenerateToken(claims Claims) (string, error) {
-	method := jwt.GetSigningMethod(a.algorithm)
+	if claims.Issuer == "" {
+		claims.Issuer = a.cfg.Issuer
+	}
+	if claims.Audience == "" {
+		claims.Audience = a.cfg.Audience
+	}
 
-	tkn := jwt.NewWithClaims(method, claims)
-	tkn.Header["kid"] = a.activeKID
+	kid, key := a.keys.Active()
 
-	str, err := tkn.SignedString(a.privateKey)
+	alg, err := keyAlgorithm(key.Public(), a.algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	tkn := jwt.NewWithClaims(jwt.GetSigningMethod(alg), claims)
+	tkn.Header["kid"] = kid
+
+	str, err := tkn.SignedString(key)
 	if err != nil {
 		return "", errors.Wrap(err, "signing token")
 	}
@@ -97,7 +176,8 @@ func (a *Authenticator) GenerateToken(claims Claims) (string, error) {
 }
 
 // ParseClaims recreates the Claims that were used to generate a token. It
-// verifies that the token was signed using our key
+// verifies that the token was signed using our key, that it is meant for us
+// and that it is valid at this time.
 func (a *Authenticator) ParseClaims(tokenStr string) (Claims, error) {
 	// keyFunc is a function that returns the public key for validating a token. We use
 	// the parsed (but unverified) token to find the key id. That ID is passed to
@@ -113,7 +193,21 @@ func (a *Authenticator) ParseClaims(tokenStr string) (Claims, error) {
 			return nil, errors.New("user token key id (kid) must be string")
 		}
 
-		return a.pubKeyLookupFunc(userKID)
+		key, err := a.pubKeyLookupFunc(userKID)
+		if err != nil {
+			return nil, err
+		}
+
+		// A token may only use the algorithm of its key.
+		alg, err := keyAlgorithm(key, a.algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if t.Method.Alg() != alg {
+			return nil, errors.Errorf("key %q does not sign with %s", userKID, t.Method.Alg())
+		}
+
+		return key, nil
 	}
 
 	var claims Claims
@@ -126,5 +220,35 @@ func (a *Authenticator) ParseClaims(tokenStr string) (Claims, error) {
 		return Claims{}, errors.New("invalid token")
 	}
 
+	if err := a.validate(claims, time.Now()); err != nil {
+		return Claims{}, err
+	}
+
 	return claims, nil
 }
+
+// validate checks the times, issuer and audience of the claims of a token.
+// The times are compared allowing for the configured leeway.
+func (a *Authenticator) validate(claims Claims, now time.Time) error {
+	leeway := int64(a.cfg.Leeway / time.Second)
+	unix := now.Unix()
+
+	if !claims.VerifyExpiresAt(unix-leeway, true) {
+		return errors.New("token is expired")
+	}
+	if !claims.VerifyNotBefore(unix+leeway, false) {
+		return errors.New("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(unix+leeway, false) {
+		return errors.New("token was issued in the future")
+	}
+
+	if a.cfg.Issuer != "" && !claims.VerifyIssuer(a.cfg.Issuer, true) {
+		return errors.Errorf("token was not issued by %q", a.cfg.Issuer)
+	}
+	if a.cfg.Audience != "" && !claims.VerifyAudience(a.cfg.Audience, true) {
+		return errors.Errorf("token is not meant for %q", a.cfg.Audience)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+)
+
+func TestClaimValidation(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const kid = "1"
+	lookup := auth.NewSimpleKeyLookupFunc(kid, &key.PublicKey)
+
+	cfg := auth.Config{Issuer: "garagesale", Audience: "sales-api", Leeway: time.Minute}
+	a, err := auth.NewAuthenticator(key, kid, "RS256", lookup, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const subject = "718ffbea-f4a1-4667-8ae3-b349da52675e"
+	roles := []string{auth.RoleUser}
+
+	other := auth.NewClaims(subject, roles, time.Now(), time.Hour)
+	other.Audience = "reports"
+
+	tests := []struct {
+		name   string
+		claims auth.Claims
+		valid  bool
+	}{
+		{"current", auth.NewClaims(subject, roles, time.Now(), time.Hour), true},
+		{"skewed", auth.NewClaims(subject, roles, time.Now().Add(30*time.Second), time.Hour), true},
+		{"future", auth.NewClaims(subject, roles, time.Now().Add(5*time.Minute), time.Hour), false},
+		{"just expired", auth.NewClaims(subject, roles, time.Now().Add(-time.Hour-30*time.Second), time.Hour), true},
+		{"expired", auth.NewClaims(subject, roles, time.Now().Add(-2*time.Hour), time.Hour), false},
+		{"other audience", other, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tkn, err := a.GenerateToken(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := a.ParseClaims(tkn)
+			if tt.valid && err != nil {
+				t.Fatalf("expected the token to be accepted: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("expected the token to be rejected")
+			}
+			if tt.valid && (claims.Issuer != cfg.Issuer || claims.Audience != cfg.Audience) {
+				t.Fatalf("expected issuer %q and audience %q, got %q and %q", cfg.Issuer, cfg.Audience, claims.Issuer, claims.Audience)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeySet holds the keys tokens are signed and verified with. Exactly one key,
+// the active one, signs new tokens. Tokens signed by any other key of the set
+// keep verifying until that key is retired, so keys can be rotated without
+// logging everyone out. Keys may be RSA, ECDSA (P-256 or P-384) or Ed25519
+// keys. A KeySet is not safe to change while it is in use.
+type KeySet struct {
+	active  string
+	private map[string]crypto.Signer
+	public  map[string]crypto.PublicKey
+	retired map[string]bool
+}
+
+// NewKeySet makes an empty KeySet.
+func NewKeySet() *KeySet {
+	return &KeySet{
+		private: make(map[string]crypto.Signer),
+		public:  make(map[string]crypto.PublicKey),
+		retired: make(map[string]bool),
+	}
+}
+
+// LoadKeySet reads every .pem file of a directory into a KeySet. The key id
+// of each key is its file name without the extension. Files may hold a
+// private key, which can be made active, or only a public key, which can
+// just verify tokens.
+func LoadKeySet(dir string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, errors.Wrap(err, "listing key files")
+	}
+	if len(files) == 0 {
+		return nil, errors.Errorf("no .pem key files in %s", dir)
+	}
+
+	ks := NewKeySet()
+
+	for _, file := range files {
+		kid := strings.TrimSuffix(filepath.Base(file), ".pem")
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading key %s", kid)
+		}
+
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.Errorf("key %s is not PEM encoded", kid)
+		}
+
+		if strings.Contains(block.Type, "PUBLIC KEY") {
+			key, err := ParsePublicKeyPEM(data)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parsing public key %s", kid)
+			}
+			ks.AddPublic(kid, key)
+			continue
+		}
+
+		key, err := ParsePrivateKeyPEM(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing private key %s", kid)
+		}
+		ks.AddPrivate(kid, key)
+	}
+
+	return ks, nil
+}
+
+// AddPrivate adds a key that can both sign and verify tokens.
+func (ks *KeySet) AddPrivate(kid string, key crypto.Signer) {
+	ks.private[kid] = key
+	ks.public[kid] = key.Public()
+}
+
+// AddPublic adds a key that can only verify tokens.
+func (ks *KeySet) AddPublic(kid string, key crypto.PublicKey) {
+	ks.public[kid] = key
+}
+
+// Activate makes the key with the given id the one signing new tokens. The
+// private part of the key must be in the set.
+func (ks *KeySet) Activate(kid string) error {
+	if _, ok := ks.private[kid]; !ok {
+		return errors.Errorf("no private key with id %q", kid)
+	}
+	if ks.retired[kid] {
+		return errors.Errorf("key %q is retired", kid)
+	}
+
+	ks.active = kid
+	return nil
+}
+
+// Retire stops the keys with the given ids from verifying tokens. The active
+// key can not be retired and every id must name a key of the set so a typo is
+// not mistaken for a retired key. No key is retired when any id is refused.
+func (ks *KeySet) Retire(kids ...string) error {
+	for _, kid := range kids {
+		if _, ok := ks.public[kid]; !ok {
+			return errors.Errorf("no key with id %q", kid)
+		}
+		if kid == ks.active {
+			return errors.Errorf("key %q is active and can not be retired", kid)
+		}
+	}
+
+	for _, kid := range kids {
+		ks.retired[kid] = true
+	}
+	return nil
+}
+
+// Active gives the id and private key of the key signing new tokens.
+func (ks *KeySet) Active() (string, crypto.Signer) {
+	return ks.active, ks.private[ks.active]
+}
+
+// Lookup gives the public key with the given id unless it is retired. It is a
+// KeyLookupFunc.
+func (ks *KeySet) Lookup(kid string) (crypto.PublicKey, error) {
+	key, ok := ks.public[kid]
+	if !ok || ks.retired[kid] {
+		return nil, errors.Errorf("unrecognized key id %q", kid)
+	}
+	return key, nil
+}
+
+// JWK is the public part of a key as a JSON Web Key (RFC 7517). RSA keys set
+// N and E, ECDSA keys set Curve, X and Y and Ed25519 keys set Curve and X.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set. It is what clients fetch to verify our tokens.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS gives the public keys that verify tokens, ordered by key id. RSA keys
+// are published for the given RSA algorithm. Retired keys are left out.
+func (ks *KeySet) JWKS(rsaAlgorithm string) JWKS {
+	set := JWKS{Keys: make([]JWK, 0, len(ks.public))}
+
+	for kid, key := range ks.public {
+		if ks.retired[kid] {
+			continue
+		}
+
+		jwk, err := newJWK(kid, key, rsaAlgorithm)
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	sort.Slice(set.Keys, func(i, j int) bool {
+		return set.Keys[i].KeyID < set.Keys[j].KeyID
+	})
+
+	return set
+}
+
+// newJWK describes a public key as a JWK.
+func newJWK(kid string, key crypto.PublicKey, rsaAlgorithm string) (JWK, error) {
+	alg, err := keyAlgorithm(key, rsaAlgorithm)
+	if err != nil {
+		return JWK{}, err
+	}
+
+	jwk := JWK{
+		Use:       "sig",
+		Algorithm: alg,
+		KeyID:     kid,
+	}
+
+	enc := base64.RawURLEncoding
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = enc.EncodeToString(k.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// Coordinates are padded to the size of the curve (RFC 7518 6.2.1.2).
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = k.Curve.Params().Name
+		jwk.X = enc.EncodeToString(padded(k.X, size))
+		jwk.Y = enc.EncodeToString(padded(k.Y, size))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = enc.EncodeToString(k)
+	}
+
+	return jwk, nil
+}
+
+// padded gives the big-endian bytes of n left padded with zeros to size.
+func padded(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+
+	out := make([]byte, size)
+	copy(out[size-len(b):], b)
+	return out
+}
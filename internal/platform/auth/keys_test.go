@@ -0,0 +1,81 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+)
+
+func TestKeySet(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, kid := range []string{"2019", "2020"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		if err := ioutil.WriteFile(filepath.Join(dir, kid+".pem"), pem.EncodeToMemory(&block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := auth.LoadKeySet(dir)
+	if err != nil {
+		t.Fatalf("loading keys: %v", err)
+	}
+	if err := keys.Activate("2019"); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := auth.NewKeySetAuthenticator(keys, "RS256", auth.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, time.Now(), time.Hour)
+	tkn, err := old.GenerateToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotating to the new key keeps tokens of the old key verifying.
+	if err := keys.Activate("2020"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.ParseClaims(tkn); err != nil {
+		t.Fatalf("parsing a token of the previous key: %v", err)
+	}
+
+	if exp, got := 2, len(old.JWKS().Keys); exp != got {
+		t.Fatalf("expected %d published keys, got %d", exp, got)
+	}
+
+	if err := keys.Retire("2020"); err == nil {
+		t.Fatal("expected an error retiring the active key")
+	}
+	if err := keys.Retire("2019", "2091"); err == nil {
+		t.Fatal("expected an error retiring an unknown key")
+	}
+	if _, err := old.ParseClaims(tkn); err != nil {
+		t.Fatalf("expected no key retired when one is refused, got %v", err)
+	}
+	if err := keys.Retire("2019"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.ParseClaims(tkn); err == nil {
+		t.Fatal("expected tokens of a retired key to be rejected")
+	}
+
+	jwks := old.JWKS()
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != "2020" || jwks.Keys[0].E != "AQAB" {
+		t.Fatalf("expected only key 2020 published, got %+v", jwks.Keys)
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import "context"
+
+// These are the permissions roles can be granted. A permission names what may
+// be done to a kind of resource.
+const (
+	PermProductsWrite   = "products:write"
+	PermProductsDelete  = "products:delete"
+	PermProductsManage  = "products:manage"
+	PermSalesRecord     = "sales:record"
+	PermSalesRead       = "sales:read"
+	PermSalesRefund     = "sales:refund"
+	PermOrdersWrite     = "orders:write"
+	PermOrdersRead      = "orders:read"
+	PermCategoriesWrite = "categories:write"
+	PermReportsRead     = "reports:read"
+	PermUsersManage     = "users:manage"
+	PermAPIKeysManage   = "apikeys:manage"
+	PermRolesManage     = "roles:manage"
+)
+
+// Permissions lists every permission that exists.
+var Permissions = []string{
+	PermProductsWrite,
+	PermProductsDelete,
+	PermProductsManage,
+	PermSalesRecord,
+	PermSalesRead,
+	PermSalesRefund,
+	PermOrdersWrite,
+	PermOrdersRead,
+	PermCategoriesWrite,
+	PermReportsRead,
+	PermUsersManage,
+	PermAPIKeysManage,
+	PermRolesManage,
+}
+
+// DefaultRolePermissions are the permissions the built in roles are created
+// with. They are used for claims whose permissions were not resolved from the
+// roles stored in the database. Deleting products and recording sales are
+// left to admins unless another role is granted them.
+var DefaultRolePermissions = map[string][]string{
+	RoleAdmin: Permissions,
+	RoleUser:  {PermProductsWrite},
+}
+
+// IsPermission tells if perm is a permission that exists.
+func IsPermission(perm string) bool {
+	for _, p := range Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission returns true if the claims hold every one of the provided
+// permissions. Claims without resolved permissions fall back to the default
+// permissions of their roles.
+func (c Claims) HasPermission(perms ...string) bool {
+	held := c.Permissions
+	if held == nil {
+		for _, role := range c.Roles {
+			held = append(held, DefaultRolePermissions[role]...)
+		}
+	}
+
+	for _, want := range perms {
+		found := false
+		for _, has := range held {
+			if has == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PermissionResolver gives the permissions granted by a set of roles.
+type PermissionResolver interface {
+	Resolve(ctx context.Context, roles []string) ([]string, error)
+}
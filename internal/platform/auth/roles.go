@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"context"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 )
 
 // These are the expected values for Claims.Roles.
@@ -18,21 +21,32 @@ type ctxKey int
 // Key is used to store/retrieve a Claims value from a context.Context
 const Key ctxKey = 1
 
-// Claims represents the authorization claims transmitted via a JWT.
+// Claims represents the authorization claims transmitted via a JWT. Tokens
+// issued for a login session carry its id in Session so they can all be
+// revoked together. The Id of the standard claims (jti) identifies a single
+// token. Claims made from an API key carry its id in APIKey and act for the
+// user who created the key. Permissions are resolved from the roles when a
+// request is authenticated and are never part of a token.
 type Claims struct {
-	Roles []string `json:"roles"`
+	Roles       []string `json:"roles"`
+	Session     string   `json:"sid,omitempty"`
+	APIKey      string   `json:"akid,omitempty"`
+	Permissions []string `json:"-"`
 	jwt.StandardClaims
 }
 
 // NewClaims constructs a Claims value for the identifier user. The Claims
-// expire within a specified duration of the provided time. Additional fields
-// of the Claims can be set after calling NewClaims is desired.
+// are valid from the provided time and expire within a specified duration of
+// it. Additional fields of the Claims can be set after calling NewClaims is
+// desired.
 func NewClaims(subject string, roles []string, now time.Time, expires time.Duration) Claims {
 	c := Claims{
 		Roles: roles,
 		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
 			Subject:   subject,
 			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
 			ExpiresAt: now.Add(expires).Unix(),
 		},
 	}
@@ -52,3 +66,18 @@ func (c Claims) HasRole(roles ...string) bool {
 
 	return false
 }
+
+// Revocations reports whether the token the claims were parsed from has been
+// revoked even though it has not expired.
+type Revocations interface {
+	Revoked(ctx context.Context, claims Claims) (bool, error)
+}
+
+// ErrInvalidAPIKey occurs when an API key is unknown or has expired.
+var ErrInvalidAPIKey = errors.New("api key is not valid")
+
+// KeyVerifier turns an API key into the claims of the client holding it. It
+// returns ErrInvalidAPIKey for keys that must not be accepted.
+type KeyVerifier interface {
+	VerifyKey(ctx context.Context, key string) (Claims, error)
+}
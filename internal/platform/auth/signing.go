@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// SigningMethodEdDSA signs tokens with Ed25519 keys (RFC 8037). The version of
+// jwt-go we use does not provide it so it is registered here.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+// Alg implements the jwt.SigningMethod interface.
+func (m *signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Sign implements the jwt.SigningMethod interface. The key must be an
+// ed25519.PrivateKey.
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	k, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(k, []byte(signingString))), nil
+}
+
+// Verify implements the jwt.SigningMethod interface. The key must be an
+// ed25519.PublicKey.
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	k, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(k, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// rsaAlgorithms are the algorithms RSA keys may be configured to sign with.
+var rsaAlgorithms = map[string]bool{
+	"RS256": true,
+	"RS384": true,
+	"RS512": true,
+}
+
+// validMethods are every algorithm a token may be signed with. Which of them
+// a token may use is decided by the key it names.
+var validMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "EdDSA"}
+
+// keyAlgorithm gives the algorithm a public key signs with. RSA keys sign with
+// the configured RSA algorithm while other keys sign with the algorithm their
+// type and curve call for.
+func keyAlgorithm(key crypto.PublicKey, rsaAlgorithm string) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsaAlgorithm, nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ES256", nil
+		case elliptic.P384():
+			return "ES384", nil
+		}
+		return "", errors.Errorf("unsupported elliptic curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	}
+
+	return "", errors.Errorf("unsupported key type %T", key)
+}
+
+// ParsePrivateKeyPEM reads an RSA, ECDSA or Ed25519 private key from PEM
+// data. PKCS #1, SEC 1 and PKCS #8 encodings are accepted.
+func ParsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+
+	return nil, errors.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// ParsePublicKeyPEM reads an RSA, ECDSA or Ed25519 public key from PEM data.
+// PKIX and PKCS #1 encodings are accepted.
+func ParsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("key is not PEM encoded")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	return nil, errors.Errorf("unsupported PEM block %q", block.Type)
+}
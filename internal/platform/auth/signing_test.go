@@ -0,0 +1,111 @@
+package auth_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+)
+
+func TestSigningAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecBytes, err := x509.MarshalECPrivateKey(p256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edBytes, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		block pem.Block
+		alg   string
+		kty   string
+	}{
+		{"RS256", pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, "RS256", "RSA"},
+		{"ES256", pem.Block{Type: "EC PRIVATE KEY", Bytes: ecBytes}, "ES256", "EC"},
+		{"EdDSA", pem.Block{Type: "PRIVATE KEY", Bytes: edBytes}, "EdDSA", "OKP"},
+	}
+
+	claims := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, time.Now(), time.Hour)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := auth.ParsePrivateKeyPEM(pem.EncodeToMemory(&tt.block))
+			if err != nil {
+				t.Fatalf("parsing key: %v", err)
+			}
+
+			keys := auth.NewKeySet()
+			keys.AddPrivate("1", key)
+			if err := keys.Activate("1"); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err := auth.NewKeySetAuthenticator(keys, "RS256", auth.Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tkn, err := a.GenerateToken(claims)
+			if err != nil {
+				t.Fatalf("generating token: %v", err)
+			}
+			if _, err := a.ParseClaims(tkn); err != nil {
+				t.Fatalf("parsing token: %v", err)
+			}
+
+			jwks := a.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Algorithm != tt.alg || jwks.Keys[0].KeyType != tt.kty {
+				t.Fatalf("expected a %s %s key published, got %+v", tt.kty, tt.alg, jwks.Keys)
+			}
+		})
+	}
+
+	// A token signed by one key must not verify with a key of another type
+	// published under the same id.
+	signer, err := auth.NewAuthenticator(p384, "1", "RS256", auth.NewSimpleKeyLookupFunc("1", p384.Public()), auth.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tkn, err := signer.GenerateToken(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pub := range []crypto.PublicKey{rsaKey.Public(), p256.Public(), edKey.Public()} {
+		verifier, err := auth.NewAuthenticator(p384, "1", "RS256", auth.NewSimpleKeyLookupFunc("1", pub), auth.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := verifier.ParseClaims(tkn); err == nil {
+			t.Fatalf("expected an ES384 token to be rejected by a %T", pub)
+		}
+	}
+}
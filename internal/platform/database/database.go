@@ -6,6 +6,8 @@ import (
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq" // Register the postgres database/sql driver.
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/metrics"
 )
 
 // Config is what we require to open a database connection.
@@ -51,3 +53,46 @@ func StatusCheck(ctx context.Context, db *sqlx.DB) error {
 
 	return db.QueryRowContext(ctx, q).Scan(&tmp)
 }
+
+// WithTx runs fn inside a transaction. The transaction is committed when fn
+// returns nil and rolled back otherwise. The error from fn is returned as is
+// so callers can still compare it against their own error values.
+func WithTx(ctx context.Context, db *sqlx.DB, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "beginning transaction")
+	}
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return errors.Wrapf(err, "rolling back transaction: %v", rbErr)
+		}
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "committing transaction")
+	}
+
+	return nil
+}
+
+// RegisterMetrics registers with r the stats of the connection pool of db.
+func RegisterMetrics(r *metrics.Registry, db *sqlx.DB) {
+	r.NewGaugeFunc("db_max_open_connections", "Maximum number of open connections to the database.",
+		func() float64 { return float64(db.Stats().MaxOpenConnections) })
+	r.NewGaugeFunc("db_open_connections", "Established connections to the database.",
+		func() float64 { return float64(db.Stats().OpenConnections) })
+	r.NewGaugeFunc("db_in_use_connections", "Connections to the database in use.",
+		func() float64 { return float64(db.Stats().InUse) })
+	r.NewGaugeFunc("db_idle_connections", "Idle connections to the database.",
+		func() float64 { return float64(db.Stats().Idle) })
+	r.NewCounterFunc("db_wait_count_total", "Times a connection to the database was waited for.",
+		func() float64 { return float64(db.Stats().WaitCount) })
+	r.NewCounterFunc("db_wait_duration_seconds_total", "Time spent waiting for connections to the database.",
+		func() float64 { return db.Stats().WaitDuration.Seconds() })
+	r.NewCounterFunc("db_max_idle_closed_total", "Connections closed because of the idle connection limit.",
+		func() float64 { return float64(db.Stats().MaxIdleClosed) })
+	r.NewCounterFunc("db_max_lifetime_closed_total", "Connections closed because they reached their maximum lifetime.",
+		func() float64 { return float64(db.Stats().MaxLifetimeClosed) })
+}
@@ -0,0 +1,224 @@
+// Package logger writes leveled, structured log entries. Entries are a
+// message plus key/value fields and are written either as one JSON object per
+// line, for log pipelines, or as plain text, for people reading a terminal.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Level is the severity of an entry. Entries below the level of a Logger are
+// dropped.
+type Level int
+
+// These are the levels entries can have.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// String gives the name of the level.
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel gives the Level with the given name.
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return l, nil
+		}
+	}
+	return 0, errors.Errorf("unknown log level %q", name)
+}
+
+// These are the formats entries can be written in.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Logger writes entries at or above its level to an output. Loggers made by
+// With share the output of their parent. A Logger is safe for concurrent use.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	fields []interface{}
+	now    func() time.Time
+}
+
+// New makes a Logger writing entries at or above level to out in format.
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	if format != FormatJSON && format != FormatText {
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+
+	l := Logger{
+		mu:     &sync.Mutex{},
+		out:    out,
+		level:  level,
+		format: format,
+		now:    time.Now,
+	}
+
+	return &l, nil
+}
+
+// With gives a Logger adding the key/value pairs to every entry.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	c := *l
+	c.fields = append(append([]interface{}{}, l.fields...), keyvals...)
+	return &c
+}
+
+// Enabled tells if entries of a level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug writes an entry about the details of what the program is doing.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info writes an entry about something expected happening.
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn writes an entry about something unexpected the program recovered from.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error writes an entry about something failing.
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// Writer gives an io.Writer turning each write into an entry of the level. It
+// lets libraries that log through the standard library log package write to
+// the Logger, as with log.New(l.Writer(logger.LevelError), "", 0).
+func (l *Logger) Writer(level Level) io.Writer {
+	return writer{l: l, level: level}
+}
+
+type writer struct {
+	l     *Logger
+	level Level
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	w.l.log(w.level, strings.TrimRight(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+// log writes an entry. A key without a value is given the value "MISSING".
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	kv := append(append([]interface{}{}, l.fields...), keyvals...)
+	if len(kv)%2 != 0 {
+		kv = append(kv, "MISSING")
+	}
+
+	var buf bytes.Buffer
+	now := l.now().UTC()
+
+	switch l.format {
+	case FormatJSON:
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now.Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i < len(kv); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(kv[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, value(kv[i+1]))
+		}
+		buf.WriteString("}\n")
+
+	default:
+		fmt.Fprintf(&buf, "%s %-5s %s", now.Format(time.RFC3339), strings.ToUpper(level.String()), msg)
+		for i := 0; i < len(kv); i += 2 {
+			v := value(kv[i+1])
+			if s, ok := v.(string); ok && strings.ContainsAny(s, " \t\n\"=") {
+				v = fmt.Sprintf("%q", s)
+			}
+			fmt.Fprintf(&buf, " %v=%v", kv[i], v)
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.out.Write(buf.Bytes()) // nolint:errcheck There is nowhere to report it.
+}
+
+// value prepares a value for writing. Errors and durations are written as
+// their text since they do not marshal to anything useful. A nil pointer
+// held in an interface is written as null rather than calling its methods.
+func value(v interface{}) interface{} {
+	if isNil(v) {
+		return nil
+	}
+
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
+
+// isNil tells if v is nil or a nil pointer, map, slice, func or channel.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// writeJSON writes v as JSON falling back to its text when it can not be
+// marshalled.
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
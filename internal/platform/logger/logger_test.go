@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+
+	l, err := New(&buf, LevelInfo, FormatJSON)
+	if err != nil {
+		t.Fatalf("making logger: %s", err)
+	}
+	l.now = func() time.Time { return time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC) }
+
+	l.Debug("dropped")
+	l.With("trace_id", "abc").Error("failed", "status", 500, "err", errors.New("boom"), "odd")
+
+	want := `{"time":"2019-01-01T00:00:00Z","level":"error","msg":"failed","trace_id":"abc","status":500,"err":"boom","odd":"MISSING"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %s want %s", got, want)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("entry is not JSON: %s", err)
+	}
+}
+
+func TestText(t *testing.T) {
+	var buf bytes.Buffer
+
+	l, err := New(&buf, LevelDebug, FormatText)
+	if err != nil {
+		t.Fatalf("making logger: %s", err)
+	}
+	l.now = func() time.Time { return time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC) }
+
+	l.Info("started", "addr", "0.0.0.0:8000", "note", "two words")
+
+	want := `2019-01-01T00:00:00Z INFO  started addr=0.0.0.0:8000 note="two words"` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q want %q", got, want)
+	}
+}
+
+// nilError has a method that fails on a nil receiver.
+type nilError struct{ msg string }
+
+func (e *nilError) Error() string { return e.msg }
+
+func TestNilValues(t *testing.T) {
+	var buf bytes.Buffer
+
+	l, err := New(&buf, LevelInfo, FormatJSON)
+	if err != nil {
+		t.Fatalf("making logger: %s", err)
+	}
+	l.now = func() time.Time { return time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC) }
+
+	var e *nilError
+	var d *time.Duration
+	l.Info("nil", "err", error(e), "dur", d, "none", nil)
+
+	want := `{"time":"2019-01-01T00:00:00Z","level":"info","msg":"nil","err":null,"dur":null,"none":null}` + "\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %s want %s", got, want)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := ParseLevel("WARN")
+	if err != nil || l != LevelWarn {
+		t.Fatalf("got %v, %v want warn", l, err)
+	}
+
+	if _, err := ParseLevel("loud"); err == nil || !strings.Contains(err.Error(), "loud") {
+		t.Fatalf("unknown level should fail, got %v", err)
+	}
+
+	if _, err := New(nil, LevelInfo, "xml"); err == nil {
+		t.Fatal("unknown format should fail")
+	}
+}
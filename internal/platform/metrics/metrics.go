@@ -0,0 +1,395 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the
+// Prometheus text exposition format. Like expvar, metrics are usually made as
+// package variables registered with the Default registry which is served by
+// Handler.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of latency
+// histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is anything a Registry can write.
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds a set of metrics with unique names.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+// NewRegistry makes an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Default is the Registry used by the package level functions.
+var Default = NewRegistry()
+
+// register adds a metric. It panics when the name is taken since that is a
+// programming error, as with expvar.
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.names[m.name()] {
+		panic(fmt.Sprintf("metrics: reuse of metric name %q", m.name()))
+	}
+
+	r.names[m.name()] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric in the Prometheus text format ordered by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+	cw := countWriter{w: bufio.NewWriter(w)}
+	for _, m := range metrics {
+		m.write(&cw)
+	}
+
+	if err := cw.w.Flush(); err != nil {
+		return cw.n, err
+	}
+
+	return cw.n, nil
+}
+
+// ServeHTTP implements the http.Handler interface serving the metrics to a
+// Prometheus scraper.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w) // nolint:errcheck The scraper went away.
+}
+
+// Handler gives an http.Handler serving the Default registry.
+func Handler() http.Handler {
+	return Default
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc is the description shared by every kind of metric.
+type desc struct {
+	n      string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.n
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.n, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.n, d.kind)
+}
+
+// key joins label values into a map key. It panics when the number of values
+// does not match the labels.
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.n, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels of a series with their values given as a key.
+// Extra pairs, such as the bucket of a histogram, are added at the end.
+func (d *desc) labelPairs(key string, extra ...string) string {
+	var pairs []string
+
+	if len(d.labels) > 0 {
+		for i, v := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+`="`+escape(v)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escape(extra[i+1])+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys gives the keys of a series map in order so output is stable.
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// =============================================================================
+
+// Counter is a value that only goes up, split in series by its labels.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter makes a Counter and registers it with the Default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// NewCounter makes a Counter registered with r.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := Counter{
+		desc:   desc{n: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(&c)
+	return &c
+}
+
+// Inc adds one to the series with the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series with the label values. Negative values are ignored
+// since counters never go down.
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+
+	k := c.key(values)
+
+	c.mu.Lock()
+	c.values[k] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.header(w)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.n, c.labelPairs(k), formatFloat(c.values[k]))
+	}
+}
+
+// =============================================================================
+
+// Gauge is a value that goes up and down, split in series by its labels.
+type Gauge struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewGauge makes a Gauge and registers it with the Default registry.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return Default.NewGauge(name, help, labels...)
+}
+
+// NewGauge makes a Gauge registered with r.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := Gauge{
+		desc:   desc{n: name, help: help, kind: "gauge", labels: labels},
+		values: make(map[string]float64),
+	}
+	r.register(&g)
+	return &g
+}
+
+// Set sets the series with the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	k := g.key(values)
+
+	g.mu.Lock()
+	g.values[k] = v
+	g.mu.Unlock()
+}
+
+// Add adds v, which may be negative, to the series with the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	k := g.key(values)
+
+	g.mu.Lock()
+	g.values[k] += v
+	g.mu.Unlock()
+}
+
+// Inc adds one to the series with the label values.
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+// Dec takes one from the series with the label values.
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.header(w)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, k := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.n, g.labelPairs(k), formatFloat(g.values[k]))
+	}
+}
+
+// =============================================================================
+
+// funcMetric is a single value read when the metrics are written. It is used
+// for values owned by something else such as the stats of a database pool.
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+// NewGaugeFunc registers with r a gauge whose value is given by fn.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{n: name, help: help, kind: "gauge"}, fn: fn})
+}
+
+// NewCounterFunc registers with r a counter whose value is given by fn.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc: desc{n: name, help: help, kind: "counter"}, fn: fn})
+}
+
+func (f *funcMetric) write(w io.Writer) {
+	f.header(w)
+	fmt.Fprintf(w, "%s %s\n", f.n, formatFloat(f.fn()))
+}
+
+// =============================================================================
+
+// Histogram counts observations in buckets, split in series by its labels.
+type Histogram struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram makes a Histogram and registers it with the Default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+// NewHistogram makes a Histogram registered with r. The buckets are the upper
+// bounds of each bucket; the +Inf bucket is added.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+
+	h := Histogram{
+		desc:    desc{n: name, help: help, kind: "histogram", labels: labels},
+		buckets: b,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(&h)
+	return &h
+}
+
+// Observe records v in the series with the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	k := h.key(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+
+	// Only the first bucket holding v is counted; buckets are made cumulative
+	// when written.
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.header(w)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, h.labelPairs(k, "le", formatFloat(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.n, h.labelPairs(k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.n, h.labelPairs(k), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.n, h.labelPairs(k), s.count)
+	}
+}
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("requests_total", "Requests served.", "route", "code")
+	c.Inc("/v1/products", "2xx")
+	c.Add(2, "/v1/products", "2xx")
+	c.Inc(`/v1/"odd"`, "5xx")
+
+	g := r.NewGauge("in_flight", "Requests being served.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+
+	h := r.NewHistogram("latency_seconds", "Request latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, "/a")
+	h.Observe(0.1, "/a")
+	h.Observe(3, "/a")
+
+	r.NewGaugeFunc("open_connections", "Open connections.", func() float64 { return 4 })
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("writing metrics: %s", err)
+	}
+
+	want := `# HELP in_flight Requests being served.
+# TYPE in_flight gauge
+in_flight 1
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/a",le="0.1"} 2
+latency_seconds_bucket{route="/a",le="1"} 2
+latency_seconds_bucket{route="/a",le="+Inf"} 3
+latency_seconds_sum{route="/a"} 3.15
+latency_seconds_count{route="/a"} 3
+# HELP open_connections Open connections.
+# TYPE open_connections gauge
+open_connections 4
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/v1/\"odd\"",code="5xx"} 1
+requests_total{route="/v1/products",code="2xx"} 3
+`
+
+	if got := buf.String(); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("dup", "A counter.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice should panic")
+		}
+	}()
+	r.NewGauge("dup", "A gauge.")
+}
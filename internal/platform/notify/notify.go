@@ -0,0 +1,94 @@
+// Package notify delivers messages such as password reset instructions to
+// users. Implementations backed by a real mail service can be plugged in
+// behind the Notifier interface; the ones in this package are meant for
+// development. File is the one to use when a message has to be acted upon,
+// such as to reset a password, since Log redacts the secrets it needs.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+)
+
+// Message is a single notification for a user. Secrets are values in the
+// Body, such as tokens, that only the recipient may see. Notifiers that write
+// messages anywhere else redact them.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+	Secrets []string
+}
+
+// Redacted gives the Body with every secret replaced.
+func (m Message) Redacted() string {
+	body := m.Body
+	for _, s := range m.Secrets {
+		if s != "" {
+			body = strings.Replace(body, s, "[REDACTED]", -1)
+		}
+	}
+	return body
+}
+
+// Notifier delivers messages.
+type Notifier interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// Log writes messages to a logger.
+type Log struct {
+	log *logger.Logger
+}
+
+// NewLog makes a Notifier that writes every message to l.
+func NewLog(l *logger.Logger) *Log {
+	return &Log{log: l}
+}
+
+// Send implements the Notifier interface. Secrets of the message are redacted
+// since logs are read by more than its recipient, so the message is only
+// good for seeing that it was sent.
+func (n *Log) Send(ctx context.Context, m Message) error {
+	n.log.Info("notify", "to", m.To, "subject", m.Subject, "body", m.Redacted())
+	return nil
+}
+
+// File writes every message to its own file in a directory.
+type File struct {
+	dir string
+}
+
+// NewFile makes a Notifier writing messages as files in dir. The directory is
+// created if it does not exist.
+func NewFile(dir string) (*File, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating notification directory")
+	}
+
+	return &File{dir: dir}, nil
+}
+
+// Send implements the Notifier interface. Files are named after the time the
+// message was sent so they list in order.
+func (n *File) Send(ctx context.Context, m Message) error {
+	name := time.Now().UTC().Format("20060102T150405.000000000") + "-" + uuid.New().String() + ".txt"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "To: %s\nSubject: %s\n\n%s\n", m.To, m.Subject, m.Body)
+
+	if err := ioutil.WriteFile(filepath.Join(n.dir, name), []byte(b.String()), 0600); err != nil {
+		return errors.Wrap(err, "writing notification")
+	}
+
+	return nil
+}
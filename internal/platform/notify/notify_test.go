@@ -0,0 +1,37 @@
+package notify_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+)
+
+func TestLogRedactsSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	log, err := logger.New(&buf, logger.LevelInfo, logger.FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := notify.Message{
+		To:      "user@example.com",
+		Subject: "Reset your password",
+		Body:    "Use this token:\n\nsecret-token\n",
+		Secrets: []string{"secret-token"},
+	}
+
+	if err := notify.NewLog(log).Send(context.Background(), m); err != nil {
+		t.Fatalf("sending: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "secret-token") {
+		t.Fatalf("expected the secret to be redacted, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "[REDACTED]") {
+		t.Fatalf("expected the body to be logged with the secret redacted, got %s", buf.String())
+	}
+}
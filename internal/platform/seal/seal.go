@@ -0,0 +1,108 @@
+// Package seal encrypts small secrets, such as TOTP secrets, that have to be
+// stored and later read back as they were. Values are sealed with AES-256-GCM
+// under a key kept outside of the database so a copy of the database alone
+// does not give them away.
+package seal
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeySize is the size of the keys in bytes.
+const KeySize = 32
+
+// prefix marks sealed values so they can be told apart from values stored
+// before they were sealed.
+const prefix = "v1:"
+
+// ErrMalformed occurs when opening a value that was not sealed, was changed or
+// was sealed with another key or for another owner.
+var ErrMalformed = errors.New("sealed value is malformed")
+
+// Box seals and opens values with a single key.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// NewBox makes a Box using a key of KeySize bytes.
+func NewBox(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, errors.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating gcm")
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// GenerateKey makes a new random key encoded as ParseKey reads it.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "generating key")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseKey decodes a key stored as base64 text, such as the content of a key
+// file. Surrounding white space is ignored.
+func ParseKey(data []byte) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding key")
+	}
+	return key, nil
+}
+
+// Seal encrypts value for owner. The owner, such as the id of the row the
+// value is stored in, must be given again to open it so sealed values can not
+// be moved from one owner to another.
+func (b *Box) Seal(value, owner string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "generating nonce")
+	}
+
+	data := b.aead.Seal(nonce, nonce, []byte(value), []byte(owner))
+	return prefix + base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+// Open decrypts a value sealed for owner.
+func (b *Box) Open(sealed, owner string) (string, error) {
+	if !Sealed(sealed) {
+		return "", ErrMalformed
+	}
+
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(sealed, prefix))
+	if err != nil || len(data) < b.aead.NonceSize() {
+		return "", ErrMalformed
+	}
+
+	n := b.aead.NonceSize()
+	value, err := b.aead.Open(nil, data[:n], data[n:], []byte(owner))
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	return string(value), nil
+}
+
+// Sealed tells if a stored value was sealed.
+func Sealed(s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
@@ -0,0 +1,58 @@
+package seal_test
+
+import (
+	"testing"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/seal"
+)
+
+func TestBox(t *testing.T) {
+	encoded, err := seal.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := seal.ParseKey([]byte(encoded + "\n"))
+	if err != nil {
+		t.Fatalf("parsing key: %v", err)
+	}
+
+	box, err := seal.NewBox(key)
+	if err != nil {
+		t.Fatalf("creating box: %v", err)
+	}
+
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP", "owner")
+	if err != nil {
+		t.Fatalf("sealing: %v", err)
+	}
+	if !seal.Sealed(sealed) {
+		t.Fatalf("expected %q to be marked as sealed", sealed)
+	}
+	if seal.Sealed("JBSWY3DPEHPK3PXP") {
+		t.Fatal("expected a plain value not to be marked as sealed")
+	}
+
+	value, err := box.Open(sealed, "owner")
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	if value != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("expected the sealed value back, got %q", value)
+	}
+
+	if _, err := box.Open(sealed, "someone else"); err != seal.ErrMalformed {
+		t.Fatalf("expected %v opening for another owner, got %v", seal.ErrMalformed, err)
+	}
+
+	other, err := seal.NewBox(make([]byte, seal.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(sealed, "owner"); err != seal.ErrMalformed {
+		t.Fatalf("expected %v opening with another key, got %v", seal.ErrMalformed, err)
+	}
+
+	if _, err := seal.NewBox(key[:16]); err == nil {
+		t.Fatal("expected an error for a short key")
+	}
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Local is a BlobStore keeping objects as files below a root directory. It is
+// meant for development and single instance deployments where the objects are
+// served back by the application itself.
+type Local struct {
+	root    string
+	baseURL string
+}
+
+// NewLocal creates a Local store rooted at dir. The directory is created if it
+// does not exist. Object URLs are formed by appending the key to baseURL.
+func NewLocal(dir, baseURL string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "creating storage directory %s", dir)
+	}
+
+	l := Local{
+		root:    dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+
+	return &l, nil
+}
+
+// Put stores the content of r under key. The content type is not kept as it
+// can be derived from the extension of the key.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return errors.Wrapf(err, "creating directory for %s", key)
+	}
+
+	// Write to a temporary file first so readers never see a partial object.
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "creating file for %s", key)
+	}
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "writing %s", key)
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "closing %s", key)
+	}
+
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return errors.Wrapf(err, "storing %s", key)
+	}
+
+	return nil
+}
+
+// Get opens the file stored under key.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "opening %s", key)
+	}
+
+	return f, nil
+}
+
+// Delete removes the file stored under key.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "deleting %s", key)
+	}
+
+	return nil
+}
+
+// URL returns the address of the object stored under key.
+func (l *Local) URL(key string) string {
+	return l.baseURL + "/" + key
+}
+
+// path maps a key to a file below the root directory. Keys escaping the root
+// directory are rejected.
+func (l *Local) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if key == "" || clean == "/" || clean[1:] != key {
+		return "", ErrInvalidKey
+	}
+
+	return filepath.Join(l.root, filepath.FromSlash(key)), nil
+}
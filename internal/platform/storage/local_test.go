@@ -0,0 +1,54 @@
+package storage_test
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
+)
+
+func TestLocal(t *testing.T) {
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/v1/images/")
+	if err != nil {
+		t.Fatalf("creating store: %v", err)
+	}
+
+	ctx := context.Background()
+	const key = "products/1/photo.jpg"
+
+	if err := store.Put(ctx, key, strings.NewReader("data"), "image/jpeg"); err != nil {
+		t.Fatalf("putting object: %v", err)
+	}
+
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("getting object: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatalf("reading object: %v", err)
+	}
+	if exp, got := "data", string(data); exp != got {
+		t.Fatalf("expected content %q, got %q", exp, got)
+	}
+
+	if exp, got := "http://localhost/v1/images/"+key, store.URL(key); exp != got {
+		t.Fatalf("expected url %q, got %q", exp, got)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("deleting object: %v", err)
+	}
+	if _, err := store.Get(ctx, key); err != storage.ErrNotFound {
+		t.Fatalf("expected %v after delete, got %v", storage.ErrNotFound, err)
+	}
+
+	for _, key := range []string{"", "../secret", "products/../../secret", "/etc/passwd"} {
+		if err := store.Put(ctx, key, strings.NewReader("x"), "text/plain"); err != storage.ErrInvalidKey {
+			t.Errorf("expected %v for key %q, got %v", storage.ErrInvalidKey, key, err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Package storage provides a way to keep binary objects such as uploaded
+// images outside of the database.
+package storage
+
+import (
+	"context"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrNotFound is returned when no object is stored under a key.
+	ErrNotFound = errors.New("object not found")
+
+	// ErrInvalidKey is returned for keys that can not be stored safely.
+	ErrInvalidKey = errors.New("invalid object key")
+)
+
+// BlobStore stores binary objects under slash separated keys such as
+// "products/<id>/<image>.jpg". Implementations must be safe for concurrent
+// use.
+type BlobStore interface {
+
+	// Put stores the content of r under key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+
+	// Get opens the object stored under key. The caller must close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete removes the object stored under key. Deleting a missing object
+	// is not an error.
+	Delete(ctx context.Context, key string) error
+
+	// URL returns the address clients can fetch the object from.
+	URL(key string) string
+}
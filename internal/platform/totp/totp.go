@@ -0,0 +1,116 @@
+// Package totp implements time-based one-time passwords (RFC 6238) as used by
+// authenticator apps. Codes have 6 digits, change every 30 seconds and are
+// computed with HMAC-SHA1, which is what every authenticator app supports.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec RFC 6238 uses HMAC-SHA1 and it is still sound for HMAC.
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Period is how long a code is valid for.
+	Period = 30 * time.Second
+
+	// Digits is the length of a code.
+	Digits = 6
+
+	// Skew is how many periods before and after the current one are accepted
+	// to allow for clocks that drift and codes typed in slowly.
+	Skew = 1
+)
+
+// encoding is how secrets are shown to users and put in otpauth URIs.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret makes a new random secret encoded in base32.
+func GenerateSecret() (string, error) {
+	data := make([]byte, 20)
+	if _, err := rand.Read(data); err != nil {
+		return "", errors.Wrap(err, "generating secret")
+	}
+	return encoding.EncodeToString(data), nil
+}
+
+// URI gives the otpauth URI authenticator apps read, usually from a QR code,
+// to add an account.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(Digits))
+	v.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+
+	return u.String()
+}
+
+// Step gives the number of the period t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code computes the code of a secret for a step.
+func Code(secret string, step int64) (string, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", errors.Wrap(err, "decoding secret")
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation (RFC 4226 section 5.3).
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", Digits, value%mod), nil
+}
+
+// Validate checks a code against a secret at time now. It gives back the step
+// the code belongs to so callers can refuse codes that were already used.
+func Validate(secret, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	current := Step(now)
+	for step := current - Skew; step <= current+Skew; step++ {
+		want, err := Code(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,64 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/totp"
+)
+
+// The SHA1 test vectors of RFC 6238 appendix B truncated to 6 digits.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		got, err := totp.Code(secret, totp.Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.code {
+			t.Errorf("at %d expected code %s, got %s", tt.unix, tt.code, got)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	code, err := totp.Code(secret, totp.Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := totp.Validate(secret, code, now.Add(totp.Period))
+	if !ok || step != totp.Step(now) {
+		t.Fatalf("expected the code of the previous period to be accepted")
+	}
+
+	if _, ok := totp.Validate(secret, code, now.Add(3*totp.Period)); ok {
+		t.Fatalf("expected a stale code to be rejected")
+	}
+
+	uri := totp.URI("garagesale", "bill@ardanlabs.com", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/garagesale:bill@ardanlabs.com?") || !strings.Contains(uri, "secret="+secret) {
+		t.Fatalf("unexpected otpauth URI %s", uri)
+	}
+}
@@ -0,0 +1,203 @@
+package web
+
+import (
+	"context"
+	"encoding"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CSVEncoder writes values of a struct type as the rows of a CSV document.
+// The columns are the exported fields of the struct in the order they are
+// declared, named after their json tag or their db tag when there is no json
+// tag. Fields tagged "-" in either tag are left out.
+type CSVEncoder struct {
+	w       *csv.Writer
+	typ     reflect.Type
+	fields  []int
+	columns []string
+}
+
+// NewCSVEncoder makes an encoder writing to w for values of the same struct
+// type as sample.
+func NewCSVEncoder(w io.Writer, sample interface{}) (*CSVEncoder, error) {
+	typ := reflect.TypeOf(sample)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, errors.Errorf("csv encoding needs a struct, got %v", typ)
+	}
+
+	e := CSVEncoder{
+		w:   csv.NewWriter(w),
+		typ: typ,
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := tagName(f.Tag.Get("json"))
+		dbName := tagName(f.Tag.Get("db"))
+		if name == "-" || dbName == "-" {
+			continue
+		}
+		if name == "" {
+			name = dbName
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		e.fields = append(e.fields, i)
+		e.columns = append(e.columns, name)
+	}
+
+	return &e, nil
+}
+
+// Columns gives the names of the columns in the order they are written.
+func (e *CSVEncoder) Columns() []string {
+	return e.columns
+}
+
+// WriteHeader writes the row naming the columns.
+func (e *CSVEncoder) WriteHeader() error {
+	return e.w.Write(e.columns)
+}
+
+// Encode writes v as a single row. It must be of the struct type the encoder
+// was made for or a pointer to it.
+func (e *CSVEncoder) Encode(v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if val.Type() != e.typ {
+		return errors.Errorf("csv encoder for %v can not encode %v", e.typ, val.Type())
+	}
+
+	record := make([]string, len(e.fields))
+	for i, idx := range e.fields {
+		s, err := csvValue(val.Field(idx))
+		if err != nil {
+			return errors.Wrapf(err, "encoding column %s", e.columns[i])
+		}
+		record[i] = s
+	}
+
+	return e.w.Write(record)
+}
+
+// Flush writes any buffered rows to the underlying writer.
+func (e *CSVEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// tagName gives the name part of a struct tag such as "name,omitempty".
+func tagName(tag string) string {
+	return strings.SplitN(tag, ",", 2)[0]
+}
+
+// csvValue formats a single field. Nil pointers are blank, values that can
+// marshal themselves to text such as times use that form and slices are
+// joined with semicolons.
+func csvValue(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	if m, ok := v.Interface().(encoding.TextMarshaler); ok {
+		data, err := m.MarshalText()
+		return string(data), err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()), nil
+	case reflect.Slice, reflect.Array:
+		items := make([]string, v.Len())
+		for i := range items {
+			s, err := csvValue(v.Index(i))
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ";"), nil
+	}
+
+	return fmt.Sprint(v.Interface()), nil
+}
+
+// RespondCSV streams rows to the client as a CSV document. The columns are
+// those of the struct type of sample. The rows are produced by calling write
+// with a function that encodes a single value.
+//
+// Nothing is sent until the first row is encoded, or write returns, so an
+// error found before any row is produced can still be responded to normally.
+func RespondCSV(ctx context.Context, writer http.ResponseWriter, sample interface{}, statusCode int, write func(encode func(interface{}) error) error) error {
+	v, ok := ctx.Value(KeyValues).(*Values)
+	if !ok {
+		return errors.New("web values missing from context")
+	}
+
+	enc, err := NewCSVEncoder(writer, sample)
+	if err != nil {
+		return err
+	}
+
+	started := false
+	start := func() error {
+		started = true
+		v.StatusCode, v.Written = statusCode, true
+
+		writer.Header().Set("content-type", "text/csv; charset=utf-8")
+		writer.WriteHeader(statusCode)
+
+		return errors.Wrap(enc.WriteHeader(), "writing to client")
+	}
+
+	encode := func(val interface{}) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return errors.Wrap(enc.Encode(val), "writing to client")
+	}
+
+	if err := write(encode); err != nil {
+		return err
+	}
+
+	if !started {
+		if err := start(); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(enc.Flush(), "writing to client")
+}
@@ -0,0 +1,56 @@
+package web_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+)
+
+func TestCSVEncoder(t *testing.T) {
+	type row struct {
+		ID      string    `db:"row_id" json:"id"`
+		Name    string    `db:"name"`
+		Tags    []string  `db:"tags" json:"tags"`
+		Parent  *string   `json:"parent_id,omitempty"`
+		Created time.Time `json:"date_created"`
+		Skipped []int     `db:"-" json:"skipped"`
+		hidden  int
+	}
+
+	var buf bytes.Buffer
+	enc, err := web.NewCSVEncoder(&buf, row{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := "p1"
+	rows := []row{
+		{ID: "r1", Name: "Comic, Books", Tags: []string{"a", "b"}, Created: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: "r2", Name: "Toys", Parent: &parent, Created: time.Date(2019, time.January, 2, 0, 0, 0, 0, time.UTC)},
+	}
+
+	if err := enc.WriteHeader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range rows {
+		if err := enc.Encode(&r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	exp := "id,name,tags,parent_id,date_created\n" +
+		"r1,\"Comic, Books\",a;b,,2019-01-01T00:00:00Z\n" +
+		"r2,Toys,,p1,2019-01-02T00:00:00Z\n"
+	if got := buf.String(); got != exp {
+		t.Fatalf("expected\n%s\ngot\n%s", exp, got)
+	}
+
+	if err := enc.Encode(struct{}{}); err == nil {
+		t.Fatal("expected an error encoding a value of another type")
+	}
+}
@@ -52,6 +52,12 @@ func Decode(request *http.Request, val interface{}) error {
 		return NewRequestError(err, http.StatusBadRequest)
 	}
 
+	return Validate(val)
+}
+
+// Validate checks the validation tags of a struct value. A failed check is
+// reported as an *Error listing the offending fields by their JSON names.
+func Validate(val interface{}) error {
 	if err := validate.Struct(val); err != nil {
 		// use a type assertion to get the real error value.
 		verrors, ok := err.(validator.ValidationErrors)
@@ -81,3 +87,17 @@ func Decode(request *http.Request, val interface{}) error {
 
 	return nil
 }
+
+// Accepts reports whether the Accept header of a request explicitly lists the
+// media type. Wildcards are not matched so JSON stays the default response.
+func Accepts(request *http.Request, mediaType string) bool {
+	for _, header := range request.Header.Values("Accept") {
+		for _, part := range strings.Split(header, ",") {
+			mt := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+			if strings.EqualFold(mt, mediaType) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -3,8 +3,10 @@ package web
 import (
 	"context"
 	"encoding/json"
-	"github.com/pkg/errors"
+	"io"
 	"net/http"
+
+	"github.com/pkg/errors"
 )
 
 // Respond marshals a value to JSON and sends it to the client.
@@ -14,9 +16,8 @@ func Respond(ctx context.Context, writer http.ResponseWriter, val interface{}, s
 		return errors.New("web values missing from context")
 	}
 
-	v.StatusCode = statusCode
-
 	if statusCode == http.StatusNoContent {
+		v.StatusCode, v.Written = statusCode, true
 		writer.WriteHeader(http.StatusNoContent)
 		return nil
 	}
@@ -27,6 +28,8 @@ func Respond(ctx context.Context, writer http.ResponseWriter, val interface{}, s
 		return errors.Wrap(err, "marshalling value to json")
 	}
 
+	v.StatusCode, v.Written = statusCode, true
+
 	writer.Header().Set("content-type", "application/json; charset=utf-8")
 	writer.WriteHeader(statusCode)
 
@@ -37,8 +40,34 @@ func Respond(ctx context.Context, writer http.ResponseWriter, val interface{}, s
 	return nil
 }
 
+// RespondStream copies the content of a reader to the client. It is meant for
+// content that is not JSON such as files.
+func RespondStream(ctx context.Context, writer http.ResponseWriter, r io.Reader, contentType string, statusCode int) error {
+	v, ok := ctx.Value(KeyValues).(*Values)
+	if !ok {
+		return errors.New("web values missing from context")
+	}
+
+	v.StatusCode, v.Written = statusCode, true
+
+	writer.Header().Set("content-type", contentType)
+	writer.WriteHeader(statusCode)
+
+	if _, err := io.Copy(writer, r); err != nil {
+		return errors.Wrap(err, "writing to client")
+	}
+
+	return nil
+}
+
 // RespondError knows how to handle errors going out to the client.
 func RespondError(ctx context.Context, writer http.ResponseWriter, err error) error {
+	// A streamed response may fail after its status was sent. The client
+	// can only see the document being cut short.
+	if v, ok := ctx.Value(KeyValues).(*Values); ok && v.Written {
+		return nil
+	}
+
 	// If the error was of the type *Error, the handler has
 	// a specific status code and error to return.
 	if webErr, ok := errors.Cause(err).(*Error); ok {
@@ -0,0 +1,30 @@
+package web_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+)
+
+func TestRespondMarshalError(t *testing.T) {
+	v := web.Values{}
+	ctx := context.WithValue(context.Background(), web.KeyValues, &v)
+	w := httptest.NewRecorder()
+
+	// Channels can not be marshalled so nothing is written.
+	err := web.Respond(ctx, w, make(chan int), http.StatusOK)
+	if err == nil {
+		t.Fatal("expected an error marshalling a channel")
+	}
+
+	if err := web.RespondError(ctx, w, err); err != nil {
+		t.Fatalf("responding with the error: %v", err)
+	}
+
+	if w.Code != http.StatusInternalServerError || v.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d recorded as %d", http.StatusInternalServerError, w.Code, v.StatusCode)
+	}
+}
@@ -2,14 +2,15 @@ package web
 
 import (
 	"context"
+	"fmt"
 	"go.opencensus.io/trace"
-	"log"
 	"net/http"
 	"os"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/wgarcia4190/garagesale/internal/platform/logger"
 	"go.opencensus.io/plugin/ochttp"
 	"go.opencensus.io/plugin/ochttp/propagation/tracecontext"
 )
@@ -20,11 +21,16 @@ type ctxKey int
 // KeyValues is how request values or stored/retrieved.
 const KeyValues ctxKey = 1
 
-// Values carries information about each request.
+// Values carries information about each request. Written is set once the
+// status of the response was sent so it can no longer be changed. Err holds
+// an unexpected error the request failed with so it is logged along with it.
 type Values struct {
 	StatusCode int
+	Written    bool
 	Start      time.Time
 	TraceID    string
+	UserID     string
+	Err        error
 }
 
 // Handler is the signature that all application handlers will implement.
@@ -33,16 +39,16 @@ type Handler func(ctx context.Context, w http.ResponseWriter, r *http.Request) e
 // App is the entry point for all web applications.
 type App struct {
 	mux      *chi.Mux
-	Log      *log.Logger
+	Log      *logger.Logger
 	mw       []Middleware
 	och      *ochttp.Handler
 	shutdown chan os.Signal
 }
 
 // NewApp knows how to construct internal state for an App.
-func NewApp(shutdown chan os.Signal, logger *log.Logger, mw ...Middleware) *App {
+func NewApp(shutdown chan os.Signal, log *logger.Logger, mw ...Middleware) *App {
 	app := App{
-		Log: logger,
+		Log: log,
 		mux: chi.NewRouter(),
 		mw:  mw,
 		shutdown: shutdown,
@@ -82,7 +88,7 @@ func (a *App) Handler(method, pattern string, h Handler, mw ...Middleware) {
 		ctx = context.WithValue(ctx, KeyValues, &v)
 
 		if err := h(ctx, w, r); err != nil {
-			a.Log.Printf("%s : Unhandled error %+v", v.TraceID, err)
+			a.Log.Error("unhandled error", "trace_id", v.TraceID, "error", fmt.Sprintf("%+v", err))
 			if IsShutdown(err) {
 				a.SignalShutdown()
 			}
@@ -98,6 +104,6 @@ func (a *App) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 // SignalShutdown is used to gracefully shutdown the app when an integrity
 // issue is identified.
 func (a *App) SignalShutdown() {
-	a.Log.Println("error returned from handler indicated integrity issue, shutting down service")
+	a.Log.Error("error returned from handler indicated integrity issue, shutting down service")
 	a.shutdown <- syscall.SIGSTOP
 }
@@ -0,0 +1,90 @@
+package product
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// cursor marks the last Product of a page. It is handed to clients as an
+// opaque string so the encoding can change without breaking them.
+type cursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// newCursor builds the cursor that resumes a listing after p.
+func newCursor(sort, order string, p Product) cursor {
+	c := cursor{
+		Sort:  sort,
+		Order: order,
+		ID:    p.ID,
+	}
+
+	switch sort {
+	case SortName:
+		c.Value = p.Name
+	case SortCost:
+		c.Value = strconv.Itoa(p.Cost)
+	case SortRevenue:
+		c.Value = strconv.Itoa(p.Revenue)
+	case SortDateCreated:
+		c.Value = p.DateCreated.UTC().Format(time.RFC3339Nano)
+	}
+
+	return c
+}
+
+// encode turns the cursor into the opaque string given to clients.
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// value converts the stored sort value back into the type of the column it
+// is compared against.
+func (c cursor) value() (interface{}, error) {
+	switch c.Sort {
+	case SortName:
+		return c.Value, nil
+	case SortCost, SortRevenue:
+		return strconv.Atoi(c.Value)
+	case SortDateCreated:
+		return time.Parse(time.RFC3339Nano, c.Value)
+	}
+
+	return nil, ErrInvalidCursor
+}
+
+// decodeCursor parses a cursor given back by a client. The cursor must have
+// been produced for the same sort key and direction as the current query.
+func decodeCursor(s, sort, order string) (cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	if c.Sort != sort || c.Order != order {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	if _, err := uuid.Parse(c.ID); err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	if _, err := c.value(); err != nil {
+		return cursor{}, ErrInvalidCursor
+	}
+
+	return c, nil
+}
@@ -0,0 +1,313 @@
+package product
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"time"
+
+	// Register the decoders of the image formats we accept.
+	_ "image/gif"
+	_ "image/png"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
+)
+
+// MaxImageSize is the largest image in bytes accepted by AddImage.
+const MaxImageSize = 5 << 20
+
+// DefaultMaxImagePixels is the largest number of pixels of an image accepted
+// by AddImage when ImageConfig does not set one.
+const DefaultMaxImagePixels = 40000000
+
+// thumbnailSize is the largest width or height of a generated thumbnail.
+const thumbnailSize = 256
+
+var (
+	ErrImageNotFound    = errors.New("Image not found")
+	ErrImageTooLarge    = errors.New("image exceeds the maximum size of 5MB")
+	ErrImageDimensions  = errors.New("image exceeds the maximum number of pixels")
+	ErrUnsupportedImage = errors.New("image must be a JPEG, PNG or GIF")
+)
+
+// ImageConfig sets the limits of images accepted by AddImage. MaxPixels caps
+// the width times the height of an image so a small but highly compressed
+// upload can not decode into gigabytes of memory.
+type ImageConfig struct {
+	MaxPixels int
+}
+
+// CleanupError is returned when a change was stored but some of the blobs it
+// left behind could not be removed from the blob store.
+type CleanupError struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *CleanupError) Error() string {
+	return "removing stored images: " + e.Err.Error()
+}
+
+// imageTypes maps the accepted content types to the extension of their keys.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// AddImage stores a photo of a Product along with a JPEG thumbnail of it. The
+// content type is detected from the data rather than trusted from the client.
+// Only users allowed to update the product can add photos to it.
+func AddImage(ctx context.Context, db *sqlx.DB, store storage.BlobStore, cfg ImageConfig, user auth.Claims, productID string, data []byte, now time.Time) (*Image, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	if len(data) > MaxImageSize {
+		return nil, ErrImageTooLarge
+	}
+
+	contentType := http.DetectContentType(data)
+	ext, ok := imageTypes[contentType]
+	if !ok {
+		return nil, ErrUnsupportedImage
+	}
+
+	// Check the dimensions from the header before decoding the pixels.
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	maxPixels := cfg.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxImagePixels
+	}
+	if conf.Width <= 0 || conf.Height <= 0 || conf.Width > maxPixels/conf.Height {
+		return nil, ErrImageDimensions
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	if err := canEditImages(ctx, db, user, productID); err != nil {
+		return nil, err
+	}
+
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, thumbnail(src, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, errors.Wrap(err, "encoding thumbnail")
+	}
+
+	bounds := src.Bounds()
+	img := Image{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		ContentType: contentType,
+		Size:        len(data),
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		DateCreated: now.UTC(),
+	}
+	img.Key = "products/" + productID + "/" + img.ID + ext
+	img.ThumbnailKey = "products/" + productID + "/" + img.ID + "_thumb.jpg"
+
+	if err := store.Put(ctx, img.Key, bytes.NewReader(data), contentType); err != nil {
+		return nil, errors.Wrap(err, "storing image")
+	}
+	if err := store.Put(ctx, img.ThumbnailKey, &thumb, "image/jpeg"); err != nil {
+		if delErr := deleteBlobs(ctx, store, img.Key); delErr != nil {
+			return nil, errors.Wrapf(err, "storing thumbnail: %v", delErr)
+		}
+		return nil, errors.Wrap(err, "storing thumbnail")
+	}
+
+	const q = `INSERT INTO product_images
+		(image_id, product_id, content_type, size, width, height, key, thumbnail_key, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = db.ExecContext(ctx, q,
+		img.ID, img.ProductID, img.ContentType, img.Size, img.Width, img.Height,
+		img.Key, img.ThumbnailKey, img.DateCreated)
+
+	if err != nil {
+		if delErr := deleteBlobs(ctx, store, img.Key, img.ThumbnailKey); delErr != nil {
+			return nil, errors.Wrapf(err, "inserting image: %v", delErr)
+		}
+		return nil, errors.Wrap(err, "inserting image")
+	}
+
+	img.setURLs(store)
+
+	return &img, nil
+}
+
+// DeleteImage removes a photo of a Product and its thumbnail. Only users
+// allowed to update the product can remove photos from it.
+func DeleteImage(ctx context.Context, db *sqlx.DB, store storage.BlobStore, user auth.Claims, productID, imageID string) error {
+	if _, err := uuid.Parse(productID); err != nil {
+		return ErrInvalidID
+	}
+	if _, err := uuid.Parse(imageID); err != nil {
+		return ErrInvalidID
+	}
+
+	if err := canEditImages(ctx, db, user, productID); err != nil {
+		return err
+	}
+
+	var img Image
+
+	const q = `DELETE FROM product_images
+		WHERE image_id = $1 AND product_id = $2
+		RETURNING *`
+
+	if err := db.GetContext(ctx, &img, q, imageID, productID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrImageNotFound
+		}
+		return errors.Wrapf(err, "deleting image %s", imageID)
+	}
+
+	if err := deleteBlobs(ctx, store, img.Key, img.ThumbnailKey); err != nil {
+		return &CleanupError{Err: err}
+	}
+
+	return nil
+}
+
+// SetImageURLs fills in the URLs of the images of the products from their
+// keys in store.
+func SetImageURLs(store storage.BlobStore, products ...*Product) {
+	for _, p := range products {
+		for i := range p.Images {
+			p.Images[i].setURLs(store)
+		}
+	}
+}
+
+// setURLs fills in the URLs of the image from its keys in store.
+func (img *Image) setURLs(store storage.BlobStore) {
+	img.URL = store.URL(img.Key)
+	img.ThumbnailURL = store.URL(img.ThumbnailKey)
+}
+
+// deleteBlobs removes every key from store. It carries on past failures and
+// reports all of them.
+func deleteBlobs(ctx context.Context, store storage.BlobStore, keys ...string) error {
+	var failed []string
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// canEditImages checks that the product exists and that the user is allowed
+// to change its photos.
+func canEditImages(ctx context.Context, db *sqlx.DB, user auth.Claims, productID string) error {
+	owner, err := ownerOf(ctx, db, productID)
+	if err != nil {
+		return err
+	}
+
+	return Authorize(user, ActionUpdate, owner)
+}
+
+// loadImages fills in the Images of each of the products.
+func loadImages(ctx context.Context, db *sqlx.DB, products []Product) error {
+	if len(products) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(products))
+	byID := make(map[string]*Product, len(products))
+	for i := range products {
+		ids[i] = products[i].ID
+		byID[products[i].ID] = &products[i]
+		products[i].Images = make([]Image, 0)
+	}
+
+	var images []Image
+
+	const q = `SELECT * FROM product_images
+		WHERE product_id = ANY($1)
+		ORDER BY date_created, image_id`
+
+	if err := db.SelectContext(ctx, &images, q, pq.Array(ids)); err != nil {
+		return errors.Wrap(err, "selecting images")
+	}
+
+	for _, img := range images {
+		p := byID[img.ProductID]
+		p.Images = append(p.Images, img)
+	}
+
+	return nil
+}
+
+// thumbnail scales src down to fit within a size by size square keeping its
+// aspect ratio. Each pixel of the thumbnail is the average of the pixels of
+// src it covers. Images that already fit are returned as is.
+func thumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,299 @@
+package product
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/web"
+)
+
+// Formats of the documents accepted by DecodeImport.
+const (
+	ImportCSV  = "csv"
+	ImportJSON = "json"
+)
+
+// MaxImportRows is the largest number of products a single import may hold.
+const MaxImportRows = 1000
+
+var (
+	// ErrInvalidImport occurs when an import document can not be read at
+	// all. Errors wrapping it describe what is wrong with the document.
+	ErrInvalidImport = errors.New("import document is not valid")
+
+	// ErrTooManyRows occurs when an import holds more than MaxImportRows.
+	ErrTooManyRows = errors.New("import holds too many products")
+
+	// errDryRun rolls back the transaction of a dry run.
+	errDryRun = errors.New("dry run")
+)
+
+// ImportRow is a single product of an import. Row counts the products of the
+// document starting at 1. Error is set when the row could not be read.
+type ImportRow struct {
+	Row        int
+	NewProduct NewProduct
+	Error      *ImportError
+}
+
+// ImportError tells why a row of an import was rejected. Fields lists the
+// fields that failed validation.
+type ImportError struct {
+	Row    int              `json:"row"`
+	Error  string           `json:"error"`
+	Fields []web.FieldError `json:"fields,omitempty"`
+}
+
+// ImportResult reports the outcome of an import. Products are those created,
+// or those that would have been created in a dry run.
+type ImportResult struct {
+	DryRun   bool          `json:"dry_run"`
+	Total    int           `json:"total"`
+	Imported int           `json:"imported"`
+	Products []Product     `json:"products"`
+	Errors   []ImportError `json:"errors"`
+}
+
+// csvColumns are the columns an import in CSV may have. Tags are separated
+// by semicolons as they are in exports.
+var csvColumns = map[string]bool{
+	"name":        true,
+	"cost":        true,
+	"quantity":    true,
+	"category_id": true,
+	"tags":        true,
+}
+
+// DecodeImport reads the products of an import document. A JSON document is
+// an array of NewProduct objects. A CSV document starts with a header naming
+// its columns. Rows that can not be read are returned with their Error set
+// so the rest of the document can still be checked.
+func DecodeImport(r io.Reader, format string) ([]ImportRow, error) {
+	switch format {
+	case ImportJSON:
+		return decodeJSONImport(r)
+	case ImportCSV:
+		return decodeCSVImport(r)
+	}
+
+	return nil, errors.Wrapf(ErrInvalidImport, "format %q is not supported", format)
+}
+
+func decodeJSONImport(r io.Reader) ([]ImportRow, error) {
+	var raw []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, errors.Wrap(ErrInvalidImport, err.Error())
+	}
+
+	if len(raw) > MaxImportRows {
+		return nil, ErrTooManyRows
+	}
+
+	rows := make([]ImportRow, len(raw))
+	for i, data := range raw {
+		rows[i].Row = i + 1
+
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rows[i].NewProduct); err != nil {
+			rows[i].Error = &ImportError{Row: i + 1, Error: err.Error()}
+		}
+	}
+
+	return rows, nil
+}
+
+func decodeCSVImport(r io.Reader) ([]ImportRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.Wrap(ErrInvalidImport, "missing header")
+		}
+		return nil, errors.Wrap(ErrInvalidImport, err.Error())
+	}
+
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !csvColumns[column] {
+			return nil, errors.Wrapf(ErrInvalidImport, "unknown column %q", column)
+		}
+		header[i] = column
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidImport, err.Error())
+		}
+
+		if len(rows) == MaxImportRows {
+			return nil, ErrTooManyRows
+		}
+
+		row := ImportRow{Row: len(rows) + 1}
+		var fields []web.FieldError
+
+		for i, column := range header {
+			v := strings.TrimSpace(record[i])
+
+			switch column {
+			case "name":
+				row.NewProduct.Name = v
+			case "cost", "quantity":
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					fields = append(fields, web.FieldError{Field: column, Error: column + " must be an integer"})
+					continue
+				}
+				if column == "cost" {
+					row.NewProduct.Cost = n
+				} else {
+					row.NewProduct.Quantity = n
+				}
+			case "category_id":
+				if v != "" {
+					row.NewProduct.CategoryID = &v
+				}
+			case "tags":
+				if v != "" {
+					row.NewProduct.Tags = strings.Split(v, ";")
+				}
+			}
+		}
+
+		if fields != nil {
+			row.Error = &ImportError{Row: row.Row, Error: "field validation error", Fields: fields}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// Import creates a Product for every valid row in a single transaction. Rows
+// failing validation, or naming a category that does not exist, are reported
+// in the result and skipped. In a dry run every check is made, including
+// inserting the products, but the transaction is rolled back.
+func Import(ctx context.Context, db *sqlx.DB, user auth.Claims, rows []ImportRow, dryRun bool, now time.Time) (*ImportResult, error) {
+	if len(rows) > MaxImportRows {
+		return nil, ErrTooManyRows
+	}
+
+	res := ImportResult{
+		DryRun:   dryRun,
+		Total:    len(rows),
+		Products: make([]Product, 0, len(rows)),
+		Errors:   make([]ImportError, 0),
+	}
+
+	// Rows are only inserted once they are all known to be good as a single
+	// failed statement aborts the whole transaction.
+	var (
+		valid      []Product
+		validRows  []int
+		categories []string
+	)
+	for _, row := range rows {
+		if row.Error != nil {
+			res.Errors = append(res.Errors, *row.Error)
+			continue
+		}
+
+		if err := web.Validate(row.NewProduct); err != nil {
+			ie := ImportError{Row: row.Row, Error: err.Error()}
+			if werr, ok := err.(*web.Error); ok {
+				ie.Fields = werr.Fields
+			}
+			res.Errors = append(res.Errors, ie)
+			continue
+		}
+
+		p := newProduct(user, row.NewProduct, now)
+		if p.CategoryID != nil {
+			categories = append(categories, *p.CategoryID)
+		}
+		valid = append(valid, p)
+		validRows = append(validRows, row.Row)
+	}
+
+	missing, err := missingCategories(ctx, db, categories)
+	if err != nil {
+		return nil, err
+	}
+
+	err = database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		for i, p := range valid {
+			if p.CategoryID != nil && missing[strings.ToLower(*p.CategoryID)] {
+				res.Errors = append(res.Errors, ImportError{
+					Row:    validRows[i],
+					Error:  ErrInvalidCategory.Error(),
+					Fields: []web.FieldError{{Field: "category_id", Error: ErrInvalidCategory.Error()}},
+				})
+				continue
+			}
+
+			if err := insertProduct(ctx, tx, p, now); err != nil {
+				return errors.Wrapf(err, "row %d", validRows[i])
+			}
+			res.Products = append(res.Products, p)
+		}
+
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && err != errDryRun {
+		return nil, err
+	}
+
+	res.Imported = len(res.Products)
+	sort.SliceStable(res.Errors, func(i, j int) bool {
+		return res.Errors[i].Row < res.Errors[j].Row
+	})
+
+	return &res, nil
+}
+
+// missingCategories gives the ids of those categories that do not exist.
+func missingCategories(ctx context.Context, db *sqlx.DB, ids []string) (map[string]bool, error) {
+	missing := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return missing, nil
+	}
+
+	for _, id := range ids {
+		missing[strings.ToLower(id)] = true
+	}
+
+	var found []string
+	const q = `SELECT category_id FROM categories WHERE category_id = ANY($1::uuid[])`
+	if err := db.SelectContext(ctx, &found, q, pq.Array(ids)); err != nil {
+		return nil, errors.Wrap(err, "selecting categories")
+	}
+
+	for _, id := range found {
+		delete(missing, id)
+	}
+
+	return missing, nil
+}
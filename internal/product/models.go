@@ -1,25 +1,37 @@
 package product
 
-import "time"
+import (
+	"time"
 
-// Product is something we sell.
+	"github.com/lib/pq"
+)
+
+// Product is something we sell. Archived products have a DeletedAt time and
+// are hidden from listings by default.
 type Product struct {
-	ID          string    `db:"product_id" json:"id"`
-	Name        string    `db:"name" json:"name"`
-	Cost        int       `db:"cost" json:"cost"`
-	Quantity    int       `db:"quantity" json:"quantity"`
-	Sold        int       `db:"sold" json:"sold"`
-	Revenue     int       `db:"revenue" json:"revenue"`
-	UserID      string    `db:"user_id" json:"user_id"`
-	DateCreated time.Time `db:"date_created" json:"date_created"`
-	DateUpdated time.Time `db:"date_updated" json:"date_updated"`
+	ID          string         `db:"product_id" json:"id"`
+	Name        string         `db:"name" json:"name"`
+	CategoryID  *string        `db:"category_id" json:"category_id,omitempty"`
+	Tags        pq.StringArray `db:"tags" json:"tags"`
+	Cost        int            `db:"cost" json:"cost"`
+	Quantity    int            `db:"quantity" json:"quantity"`
+	Sold        int            `db:"sold" json:"sold"`
+	Revenue     int            `db:"revenue" json:"revenue"`
+	UserID      string         `db:"user_id" json:"user_id"`
+	Version     int            `db:"version" json:"version"`
+	DateCreated time.Time      `db:"date_created" json:"date_created"`
+	DateUpdated time.Time      `db:"date_updated" json:"date_updated"`
+	DeletedAt   *time.Time     `db:"deleted_at" json:"deleted_at,omitempty"`
+	Images      []Image        `db:"-" json:"images"`
 }
 
 // NewProduct is what we require from clients to make a new Product.
 type NewProduct struct {
-	Name     string `json:"name" validate:"required"`
-	Cost     int    `json:"cost" validate:"gte=0"`
-	Quantity int    `json:"quantity" validate:"gte=1"`
+	Name       string   `json:"name" validate:"required"`
+	Cost       int      `json:"cost" validate:"gte=0"`
+	Quantity   int      `json:"quantity" validate:"gte=1"`
+	CategoryID *string  `json:"category_id" validate:"omitempty,uuid"`
+	Tags       []string `json:"tags" validate:"max=20,dive,required,max=50"`
 }
 
 // UpdateProduct defines what information may be provided to modify an
@@ -28,26 +40,175 @@ type NewProduct struct {
 // between a field that was not provided and a field that was provided as
 // explicitly blank. Normally we do not want to use pointers to basic types but
 // we make exceptions around marshalling/unmarshalling.
+//
+// When Version is provided the update is only applied if the Product is still
+// at that version. A blank CategoryID removes the Product from its category
+// and a nil Tags leaves the tags untouched.
 type UpdateProduct struct {
-	Name     *string `json:"name"`
-	Cost     *int    `json:"cost" validate:"omitempty,gte=0"`
-	Quantity *int    `json:"quantity" validate:"omitempty,gte=1"`
+	Name       *string  `json:"name"`
+	Cost       *int     `json:"cost" validate:"omitempty,gte=0"`
+	Quantity   *int     `json:"quantity" validate:"omitempty,gte=1"`
+	CategoryID *string  `json:"category_id" validate:"omitempty,uuid"`
+	Tags       []string `json:"tags" validate:"omitempty,max=20,dive,required,max=50"`
+	Version    *int     `json:"version" validate:"omitempty,gte=1"`
 }
 
 // Sale represents one item of a transaction where some amount of a product was
 // sold. Quantity is the number of units sold and Paid is the total price paid.
 // Note that due to haggling the Paid value might not equal Quantity sold *
-// Product cost.
+// Product cost. Sales recorded as part of an order reference it by OrderID.
 type Sale struct {
 	ID          string    `db:"sale_id" json:"id"`
 	ProductID   string    `db:"product_id" json:"product_id"`
+	OrderID     *string   `db:"order_id" json:"order_id,omitempty"`
 	Quantity    int       `db:"quantity" json:"quantity"`
 	Paid        int       `db:"paid" json:"paid"`
 	DateCreated time.Time `db:"date_created" json:"date_created"`
 }
 
+// SaleQuery narrows down a search of Sales across products. Sales are
+// matched when they were made at or after From and before To. A blank
+// ProductID matches every product and zero times leave the range open. Limit
+// and Cursor page through the Sales like they do for ListQuery.
+type SaleQuery struct {
+	ProductID string
+	From      time.Time
+	To        time.Time
+	Limit     int
+	Cursor    string
+}
+
+// SaleResult is a single page of Sales. NextCursor is blank when there are no
+// more Sales to fetch.
+type SaleResult struct {
+	Sales      []Sale `json:"sales"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
 // NewSale is what we require from clients for recording new transactions.
 type NewSale struct {
-	Quantity int `json:"quantity"`
-	Paid     int `json:"paid"`
+	Quantity int `json:"quantity" validate:"gte=1"`
+	Paid     int `json:"paid" validate:"gte=0"`
+}
+
+// These are the sort keys understood by ListQuery.Sort.
+const (
+	SortName        = "name"
+	SortCost        = "cost"
+	SortDateCreated = "date_created"
+	SortRevenue     = "revenue"
+)
+
+// These are the directions understood by ListQuery.Order.
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// These bound the number of Products returned in a single page.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// ListQuery describes which page of Products a caller wants. The zero value
+// is a valid query for the first page of every product sorted by name. Filter
+// fields that are pointers are only applied when they are provided. Archived
+// products are only listed when IncludeArchived is set. Products must carry
+// every one of the Tags to be listed.
+type ListQuery struct {
+	Limit           int
+	Cursor          string
+	Name            string
+	MinCost         *int
+	MaxCost         *int
+	UserID          string
+	CategoryID      string
+	Tags            []string
+	InStock         bool
+	IncludeArchived bool
+	Sort            string
+	Order           string
+}
+
+// ListResult is a single page of Products. NextCursor is blank when there are
+// no more Products to fetch.
+type ListResult struct {
+	Products   []Product `json:"products"`
+	Limit      int       `json:"limit"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// Refund gives back some of the units and/or money of a Sale. A sale can be
+// refunded several times as long as the refunds together do not exceed it.
+type Refund struct {
+	ID          string    `db:"refund_id" json:"id"`
+	SaleID      string    `db:"sale_id" json:"sale_id"`
+	ProductID   string    `db:"product_id" json:"product_id"`
+	Quantity    int       `db:"quantity" json:"quantity"`
+	Amount      int       `db:"amount" json:"amount"`
+	Reason      string    `db:"reason" json:"reason"`
+	UserID      string    `db:"user_id" json:"user_id"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// NewRefund is what we require from clients for refunding a Sale. Quantity is
+// the number of units returned to stock and Amount the money paid back.
+type NewRefund struct {
+	Quantity int    `json:"quantity" validate:"gte=0"`
+	Amount   int    `json:"amount" validate:"gte=0"`
+	Reason   string `json:"reason"`
+}
+
+// Image is a photo of a Product. The image and its thumbnail are kept in a
+// blob store and fetched by clients through their URLs. Only the keys are
+// stored so the URLs follow the store when its address changes; they are
+// filled in by SetImageURLs.
+type Image struct {
+	ID           string    `db:"image_id" json:"id"`
+	ProductID    string    `db:"product_id" json:"product_id"`
+	ContentType  string    `db:"content_type" json:"content_type"`
+	Size         int       `db:"size" json:"size"`
+	Width        int       `db:"width" json:"width"`
+	Height       int       `db:"height" json:"height"`
+	Key          string    `db:"key" json:"-"`
+	URL          string    `db:"-" json:"url"`
+	ThumbnailKey string    `db:"thumbnail_key" json:"-"`
+	ThumbnailURL string    `db:"-" json:"thumbnail_url"`
+	DateCreated  time.Time `db:"date_created" json:"date_created"`
+}
+
+// Price records a change of the cost of a Product. The first Price of a
+// product has no OldCost. Changes applied from a PriceSchedule reference it.
+type Price struct {
+	ID          string    `db:"price_id" json:"id"`
+	ProductID   string    `db:"product_id" json:"product_id"`
+	OldCost     *int      `db:"old_cost" json:"old_cost"`
+	NewCost     int       `db:"new_cost" json:"new_cost"`
+	UserID      string    `db:"user_id" json:"user_id"`
+	ScheduleID  *string   `db:"schedule_id" json:"schedule_id,omitempty"`
+	DateCreated time.Time `db:"date_created" json:"date_created"`
+}
+
+// PriceSchedule is a change of the cost of a Product to be applied at a later
+// time. It either sets a new Cost or takes a Discount in percent off the cost
+// the product has when the change is applied.
+type PriceSchedule struct {
+	ID          string     `db:"schedule_id" json:"id"`
+	ProductID   string     `db:"product_id" json:"product_id"`
+	Cost        *int       `db:"cost" json:"cost,omitempty"`
+	Discount    *int       `db:"discount" json:"discount,omitempty"`
+	EffectiveAt time.Time  `db:"effective_at" json:"effective_at"`
+	AppliedAt   *time.Time `db:"applied_at" json:"applied_at,omitempty"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+}
+
+// NewPriceSchedule is what we require from clients to schedule a price change.
+// Exactly one of Cost and Discount must be provided.
+type NewPriceSchedule struct {
+	Cost        *int      `json:"cost" validate:"omitempty,gte=0"`
+	Discount    *int      `json:"discount" validate:"omitempty,min=1,max=100"`
+	EffectiveAt time.Time `json:"effective_at" validate:"required"`
 }
@@ -0,0 +1,62 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+)
+
+// Actions on a Product decided by Authorize.
+const (
+	ActionUpdate     = "update"
+	ActionDelete     = "delete"
+	ActionRecordSale = "record_sale"
+)
+
+// Authorize decides whether the user may take an action on a product owned by
+// owner. Users with the products:manage permission may act on any product.
+// Other users may only act on the products they own and need products:write
+// to update them, products:delete to delete them and sales:record to record
+// their sales. It returns ErrForbidden when the action is not allowed.
+func Authorize(user auth.Claims, action, owner string) error {
+	var perm string
+	switch action {
+	case ActionUpdate:
+		perm = auth.PermProductsWrite
+	case ActionDelete:
+		perm = auth.PermProductsDelete
+	case ActionRecordSale:
+		perm = auth.PermSalesRecord
+	default:
+		return errors.Errorf("unknown product action %q", action)
+	}
+
+	if !user.HasPermission(perm) {
+		return ErrForbidden
+	}
+	owns := owner != "" && owner == user.Subject
+	if !owns && !user.HasPermission(auth.PermProductsManage) {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// ownerOf gives the id of the user owning a product. Archived products are
+// included. Products without an owner give a blank id.
+func ownerOf(ctx context.Context, db sqlx.QueryerContext, productID string) (string, error) {
+	var owner sql.NullString
+
+	const q = `SELECT user_id FROM products WHERE product_id = $1`
+	if err := sqlx.GetContext(ctx, db, &owner, q, productID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrNotFound
+		}
+		return "", errors.Wrapf(err, "checking product %s", productID)
+	}
+
+	return owner.String, nil
+}
@@ -0,0 +1,61 @@
+package product_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/product"
+)
+
+func TestAuthorize(t *testing.T) {
+	now := time.Now()
+
+	const owner = "718ffbea-f4a1-4667-8ae3-b349da52675e"
+	const stranger = "45b5fbd3-755f-4379-8f07-a58d4a30fa2f"
+
+	user := auth.NewClaims(owner, []string{auth.RoleUser}, now, time.Hour)
+	other := auth.NewClaims(stranger, []string{auth.RoleUser}, now, time.Hour)
+	admin := auth.NewClaims(stranger, []string{auth.RoleAdmin}, now, time.Hour)
+
+	reader := auth.NewClaims(owner, []string{auth.RoleUser}, now, time.Hour)
+	reader.Permissions = []string{auth.PermReportsRead}
+
+	// Sellers hold a custom role letting them delete and sell what they own.
+	seller := auth.NewClaims(owner, []string{"SELLER"}, now, time.Hour)
+	seller.Permissions = []string{auth.PermProductsWrite, auth.PermProductsDelete, auth.PermSalesRecord}
+
+	tests := []struct {
+		name    string
+		user    auth.Claims
+		action  string
+		owner   string
+		allowed bool
+	}{
+		{"owner updates", user, product.ActionUpdate, owner, true},
+		{"owner deletes", user, product.ActionDelete, owner, false},
+		{"owner records sale", user, product.ActionRecordSale, owner, false},
+		{"seller deletes", seller, product.ActionDelete, owner, true},
+		{"seller records sale", seller, product.ActionRecordSale, owner, true},
+		{"seller deletes unowned", seller, product.ActionDelete, stranger, false},
+		{"other updates", other, product.ActionUpdate, owner, false},
+		{"other records sale", other, product.ActionRecordSale, owner, false},
+		{"admin updates", admin, product.ActionUpdate, owner, true},
+		{"admin deletes", admin, product.ActionDelete, owner, true},
+		{"admin records sale", admin, product.ActionRecordSale, owner, true},
+		{"user updates unowned", user, product.ActionUpdate, "", false},
+		{"owner without permission", reader, product.ActionUpdate, owner, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := product.Authorize(tt.user, tt.action, tt.owner)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected the action to be allowed, got %v", err)
+			}
+			if !tt.allowed && err != product.ErrForbidden {
+				t.Fatalf("expected %v, got %v", product.ErrForbidden, err)
+			}
+		})
+	}
+}
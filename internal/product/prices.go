@@ -0,0 +1,251 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+)
+
+var (
+	ErrScheduleNotFound = errors.New("Price schedule not found")
+	ErrInvalidSchedule  = errors.New("price schedule must set either a cost or a discount")
+	ErrScheduleApplied  = errors.New("price schedule was already applied")
+)
+
+// ListPrices gives the price history of a Product, oldest first.
+func ListPrices(ctx context.Context, db *sqlx.DB, productID string) ([]Price, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	prices := make([]Price, 0)
+
+	const q = `SELECT * FROM price_history
+		WHERE product_id = $1
+		ORDER BY date_created, price_id`
+
+	if err := db.SelectContext(ctx, &prices, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting prices")
+	}
+
+	return prices, nil
+}
+
+// SchedulePrice plans a change of the cost of a Product. The change is made
+// by ApplyScheduledPrices once its effective time has passed. Only users
+// allowed to update the product can schedule changes.
+func SchedulePrice(ctx context.Context, db *sqlx.DB, user auth.Claims, productID string, nps NewPriceSchedule, now time.Time) (*PriceSchedule, error) {
+	if (nps.Cost == nil) == (nps.Discount == nil) {
+		return nil, ErrInvalidSchedule
+	}
+
+	p, err := Retrieve(ctx, db, productID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(user, ActionUpdate, p.UserID); err != nil {
+		return nil, err
+	}
+
+	ps := PriceSchedule{
+		ID:          uuid.New().String(),
+		ProductID:   productID,
+		Cost:        nps.Cost,
+		Discount:    nps.Discount,
+		EffectiveAt: nps.EffectiveAt.UTC(),
+		UserID:      user.Subject,
+		DateCreated: now.UTC(),
+	}
+
+	const q = `INSERT INTO price_schedules
+		(schedule_id, product_id, cost, discount, effective_at, user_id, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	if _, err := db.ExecContext(ctx, q, ps.ID, ps.ProductID, ps.Cost, ps.Discount, ps.EffectiveAt, ps.UserID, ps.DateCreated); err != nil {
+		return nil, errors.Wrap(err, "inserting price schedule")
+	}
+
+	return &ps, nil
+}
+
+// ListSchedules gives the scheduled price changes of a Product ordered by the
+// time they take effect.
+func ListSchedules(ctx context.Context, db *sqlx.DB, productID string) ([]PriceSchedule, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	schedules := make([]PriceSchedule, 0)
+
+	const q = `SELECT * FROM price_schedules
+		WHERE product_id = $1
+		ORDER BY effective_at, schedule_id`
+
+	if err := db.SelectContext(ctx, &schedules, q, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting price schedules")
+	}
+
+	return schedules, nil
+}
+
+// CancelSchedule removes a price change that was not applied yet. Only users
+// allowed to update the product can cancel changes.
+func CancelSchedule(ctx context.Context, db *sqlx.DB, user auth.Claims, productID, scheduleID string) error {
+	if _, err := uuid.Parse(scheduleID); err != nil {
+		return ErrInvalidID
+	}
+
+	p, err := Retrieve(ctx, db, productID)
+	if err != nil {
+		return err
+	}
+
+	if err := Authorize(user, ActionUpdate, p.UserID); err != nil {
+		return err
+	}
+
+	var applied bool
+
+	const q = `DELETE FROM price_schedules
+		WHERE schedule_id = $1 AND product_id = $2
+		RETURNING applied_at IS NOT NULL`
+
+	// Applied changes are part of the price history and are kept.
+	return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		if err := tx.GetContext(ctx, &applied, q, scheduleID, productID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrScheduleNotFound
+			}
+			return errors.Wrapf(err, "deleting price schedule %s", scheduleID)
+		}
+
+		if applied {
+			return ErrScheduleApplied
+		}
+
+		return nil
+	})
+}
+
+// ApplyScheduledPrices makes every scheduled price change whose effective
+// time has passed. Each change is recorded in the price history of its
+// product. Changes are applied in their own transaction so one that fails does
+// not hold back the others. Schedules being applied by another caller are
+// skipped so several instances of the service can run this concurrently.
+// Schedules of archived products wait until the product is restored. It
+// returns the number of changes applied along with the first error met.
+func ApplyScheduledPrices(ctx context.Context, db *sqlx.DB, now time.Time) (int, error) {
+	var applied int
+	var first error
+
+	// This is never nil since a nil array is NULL and would skip everything.
+	failed := make([]string, 0)
+
+	for i := 0; i < 100; i++ {
+		if err := ctx.Err(); err != nil {
+			return applied, err
+		}
+
+		id, err := applyScheduledPrice(ctx, db, failed, now)
+		switch {
+		case err != nil && id == "":
+			return applied, err
+		case err != nil:
+			failed = append(failed, id)
+			if first == nil {
+				first = err
+			}
+		case id == "":
+			return applied, first
+		default:
+			applied++
+		}
+	}
+
+	return applied, first
+}
+
+// applyScheduledPrice applies the next due price change not in skip. It gives
+// the id of the schedule it tried or an empty id when none is due.
+func applyScheduledPrice(ctx context.Context, db *sqlx.DB, skip []string, now time.Time) (string, error) {
+	var id string
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		var ps struct {
+			PriceSchedule
+			ProductCost int `db:"product_cost"`
+		}
+
+		// The product is locked along with the schedule so it can not be
+		// archived or changed while its cost is updated.
+		const q = `SELECT s.*, p.cost AS product_cost
+			FROM price_schedules AS s
+			JOIN products AS p ON p.product_id = s.product_id
+			WHERE s.applied_at IS NULL AND s.effective_at <= $1
+				AND p.deleted_at IS NULL AND s.schedule_id <> ALL($2)
+			ORDER BY s.effective_at, s.schedule_id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED`
+
+		if err := tx.GetContext(ctx, &ps, q, now.UTC(), pq.Array(skip)); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return errors.Wrap(err, "selecting due price schedule")
+		}
+		id = ps.ID
+
+		cost := ps.ProductCost
+		newCost := cost
+		switch {
+		case ps.Cost != nil:
+			newCost = *ps.Cost
+		case ps.Discount != nil:
+			newCost = cost * (100 - *ps.Discount) / 100
+		}
+
+		const update = `UPDATE products SET
+			"cost" = $2,
+			"date_updated" = $3,
+			"version" = version + 1
+			WHERE product_id = $1`
+
+		if _, err := tx.ExecContext(ctx, update, ps.ProductID, newCost, now.UTC()); err != nil {
+			return errors.Wrapf(err, "updating cost of product %s", ps.ProductID)
+		}
+
+		if err := recordPrice(ctx, tx, ps.ProductID, &cost, newCost, ps.UserID, &ps.ID, now); err != nil {
+			return err
+		}
+
+		const done = `UPDATE price_schedules SET applied_at = $2 WHERE schedule_id = $1`
+		if _, err := tx.ExecContext(ctx, done, ps.ID, now.UTC()); err != nil {
+			return errors.Wrapf(err, "marking price schedule %s applied", ps.ID)
+		}
+
+		return nil
+	})
+
+	return id, err
+}
+
+// recordPrice adds a change of cost to the price history of a product.
+func recordPrice(ctx context.Context, tx *sqlx.Tx, productID string, oldCost *int, newCost int, userID string, scheduleID *string, now time.Time) error {
+	const q = `INSERT INTO price_history
+		(price_id, product_id, old_cost, new_cost, user_id, schedule_id, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	if _, err := tx.ExecContext(ctx, q, uuid.New().String(), productID, oldCost, newCost, userID, scheduleID, now.UTC()); err != nil {
+		return errors.Wrap(err, "inserting price")
+	}
+
+	return nil
+}
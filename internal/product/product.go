@@ -3,41 +3,218 @@ package product
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/pkg/errors"
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
-	"time"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 var (
-	ErrNotFound  = errors.New("Product not found")
-	ErrInvalidID = errors.New("id provided was not a valid UUID")
-	ErrForbidden = errors.New("Attempted action is not allowed")
+	ErrNotFound      = errors.New("Product not found")
+	ErrInvalidID     = errors.New("id provided was not a valid UUID")
+	ErrForbidden     = errors.New("Attempted action is not allowed")
+	ErrInvalidCursor = errors.New("cursor provided is not valid for this query")
+	ErrInvalidSort   = errors.New("sort provided is not supported")
+
+	// ErrConflict occurs when a Product was changed by someone else since the
+	// version the caller based its change on.
+	ErrConflict = errors.New("Product was modified by another request")
+
+	// ErrHasSales occurs when purging a Product that still has sales recorded.
+	ErrHasSales = errors.New("Product has sales and can only be archived")
+
+	// ErrInvalidCategory occurs when a Product is assigned to a category that
+	// does not exist.
+	ErrInvalidCategory = errors.New("category does not exist")
 )
 
-// List return all known Products.
-func List(ctx context.Context, db *sqlx.DB) ([]Product, error) {
-	list := make([]Product, 0)
+// selectProducts is the base query used to read Products along with the
+// aggregated figures of their sales. Units and money given back by refunds
+// are deducted from the figures. Callers append their own WHERE clause.
+const selectProducts = `SELECT
+		p.product_id, p.name, p.category_id, p.tags, p.cost, p.quantity,
+		COALESCE(s.quantity, 0) - COALESCE(r.quantity, 0) AS sold,
+		COALESCE(s.paid, 0) - COALESCE(r.amount, 0) AS revenue,
+		p.user_id, p.version, p.date_created, p.date_updated, p.deleted_at
+	FROM products AS p
+	LEFT JOIN (
+		SELECT product_id, SUM(quantity) AS quantity, SUM(paid) AS paid
+		FROM sales
+		GROUP BY product_id
+	) AS s ON p.product_id = s.product_id
+	LEFT JOIN (
+		SELECT product_id, SUM(quantity) AS quantity, SUM(amount) AS amount
+		FROM refunds
+		GROUP BY product_id
+	) AS r ON p.product_id = r.product_id`
+
+// List returns a single page of Products matching the query. Use the
+// NextCursor of the result in a following query to fetch the next page.
+func List(ctx context.Context, db *sqlx.DB, lq ListQuery) (*ListResult, error) {
+	if lq.Limit <= 0 {
+		lq.Limit = DefaultLimit
+	}
+	if lq.Limit > MaxLimit {
+		lq.Limit = MaxLimit
+	}
+
+	// Ask for one extra row so we know if there is another page after this one.
+	q, args, err := listQuery(&lq, lq.Limit+1)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Product, 0, lq.Limit+1)
+	if err := db.SelectContext(ctx, &list, q, args...); err != nil {
+		return nil, errors.Wrap(err, "selecting products")
+	}
 
-	const q = `SELECT
-			p.product_id, p.name, p.cost, p.quantity,
-			COALESCE(SUM(s.quantity), 0) AS sold,
-			COALESCE(SUM(s.paid), 0) AS revenue,
-			p.date_created, p.date_updated
-		FROM products AS p
-		LEFT JOIN sales AS s On p.product_id = s.product_id
-		GROUP BY p.product_id`
+	res := ListResult{
+		Products: list,
+		Limit:    lq.Limit,
+	}
+
+	if len(list) > lq.Limit {
+		res.Products = list[:lq.Limit]
+		res.NextCursor = newCursor(lq.Sort, lq.Order, res.Products[lq.Limit-1]).encode()
+	}
 
-	if err := db.SelectContext(ctx, &list, q); err != nil {
+	if err := loadImages(ctx, db, res.Products); err != nil {
 		return nil, err
 	}
 
-	return list, nil
+	return &res, nil
+}
+
+// Export calls fn for every Product matching the query, in the same order as
+// List would give them. The limit of the query is ignored and products are
+// read from the database one at a time so the whole listing is never held in
+// memory. Images are not loaded. Iteration stops at the first error returned
+// by fn.
+func Export(ctx context.Context, db *sqlx.DB, lq ListQuery, fn func(Product) error) error {
+	q, args, err := listQuery(&lq, 0)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return errors.Wrap(err, "selecting products")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Product
+		if err := rows.StructScan(&p); err != nil {
+			return errors.Wrap(err, "scanning product")
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "iterating products")
 }
 
-// Retrieve returns a single Product.
+// listQuery builds the SQL statement and its arguments for a listing. It
+// fills in the default sort and order of lq. A limit of zero returns every
+// matching row.
+func listQuery(lq *ListQuery, limit int) (string, []interface{}, error) {
+	if lq.Sort == "" {
+		lq.Sort = SortName
+	}
+	if lq.Order == "" {
+		lq.Order = OrderAsc
+	}
+
+	switch lq.Sort {
+	case SortName, SortCost, SortDateCreated, SortRevenue:
+	default:
+		return "", nil, ErrInvalidSort
+	}
+
+	dir, cmp := "ASC", ">"
+	switch lq.Order {
+	case OrderAsc:
+	case OrderDesc:
+		dir, cmp = "DESC", "<"
+	default:
+		return "", nil, ErrInvalidSort
+	}
+
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	// Filters on the product row itself are applied in the inner query so
+	// they can make use of the indexes of the products table.
+	var filters []string
+	if !lq.IncludeArchived {
+		filters = append(filters, "p.deleted_at IS NULL")
+	}
+	if lq.Name != "" {
+		filters = append(filters, "p.name ILIKE '%' || "+arg(escapeLike(lq.Name))+" || '%'")
+	}
+	if lq.MinCost != nil {
+		filters = append(filters, "p.cost >= "+arg(*lq.MinCost))
+	}
+	if lq.MaxCost != nil {
+		filters = append(filters, "p.cost <= "+arg(*lq.MaxCost))
+	}
+	if lq.UserID != "" {
+		if _, err := uuid.Parse(lq.UserID); err != nil {
+			return "", nil, ErrInvalidID
+		}
+		filters = append(filters, "p.user_id = "+arg(lq.UserID))
+	}
+	if lq.CategoryID != "" {
+		if _, err := uuid.Parse(lq.CategoryID); err != nil {
+			return "", nil, ErrInvalidID
+		}
+		filters = append(filters, "p.category_id = "+arg(lq.CategoryID))
+	}
+	if len(lq.Tags) > 0 {
+		filters = append(filters, "p.tags @> "+arg(pq.Array(normalizeTags(lq.Tags))))
+	}
+
+	// Filters on the aggregated figures and the cursor position are applied
+	// to the rows of the inner query.
+	var conditions []string
+	if lq.InStock {
+		conditions = append(conditions, "p.quantity > p.sold")
+	}
+	if lq.Cursor != "" {
+		c, err := decodeCursor(lq.Cursor, lq.Sort, lq.Order)
+		if err != nil {
+			return "", nil, err
+		}
+		v, _ := c.value()
+		conditions = append(conditions, fmt.Sprintf("(p.%s, p.product_id) %s (%s, %s)", lq.Sort, cmp, arg(v), arg(c.ID)))
+	}
+
+	q := "SELECT * FROM (" + selectProducts + where(filters) + `
+	) AS p` + where(conditions) + fmt.Sprintf(`
+	ORDER BY p.%s %s, p.product_id %s`, lq.Sort, dir, dir)
+
+	if limit > 0 {
+		q += "\n\tLIMIT " + arg(limit)
+	}
+
+	return q, args, nil
+}
+
+// Retrieve returns a single Product. Archived products are returned as well.
 func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Product, error) {
 
 	if _, err := uuid.Parse(id); err != nil {
@@ -46,15 +223,8 @@ func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Product, error) {
 
 	var p Product
 
-	const q = `SELECT
-			p.product_id, p.name, p.cost, p.quantity,
-			COALESCE(SUM(s.quantity), 0) AS sold,
-			COALESCE(SUM(s.paid), 0) AS revenue,
-			p.date_created, p.date_updated
-		FROM products AS p
-		LEFT JOIN sales AS s On p.product_id = s.product_id
-		WHERE p.product_id = $1
-		GROUP BY p.product_id`
+	const q = selectProducts + `
+		WHERE p.product_id = $1`
 
 	if err := db.GetContext(ctx, &p, q, id); err != nil {
 		if err == sql.ErrNoRows {
@@ -63,47 +233,94 @@ func Retrieve(ctx context.Context, db *sqlx.DB, id string) (*Product, error) {
 		return nil, err
 	}
 
-	return &p, nil
+	ps := []Product{p}
+	if err := loadImages(ctx, db, ps); err != nil {
+		return nil, err
+	}
+
+	return &ps[0], nil
 }
 
 // Create makes a new Product.
 func Create(ctx context.Context, db *sqlx.DB, user auth.Claims, np NewProduct, now time.Time) (*Product, error) {
+	p := newProduct(user, np, now)
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		return insertProduct(ctx, tx, p, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// newProduct builds the Product made from np for the user.
+func newProduct(user auth.Claims, np NewProduct, now time.Time) Product {
 	p := Product{
 		ID:          uuid.New().String(),
 		Name:        np.Name,
+		CategoryID:  np.CategoryID,
+		Tags:        normalizeTags(np.Tags),
 		Cost:        np.Cost,
 		Quantity:    np.Quantity,
 		UserID:      user.Subject,
+		Version:     1,
 		DateCreated: now.UTC(),
 		DateUpdated: now.UTC(),
+		Images:      make([]Image, 0),
+	}
+
+	if p.CategoryID != nil && *p.CategoryID == "" {
+		p.CategoryID = nil
 	}
 
+	return p
+}
+
+// insertProduct stores a new Product as part of the transaction tx.
+func insertProduct(ctx context.Context, tx *sqlx.Tx, p Product, now time.Time) error {
 	const q = `INSERT INTO products
-	(product_id, name, cost, quantity, user_id, date_created, date_updated)
-	VALUES($1, $2, $3, $4, $5, $6, $7)`
+	(product_id, name, category_id, tags, cost, quantity, user_id, date_created, date_updated)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`
 
-	if _, err := db.ExecContext(ctx, q, p.ID, p.Name, p.Cost, p.Quantity, p.UserID, p.DateCreated, p.DateUpdated); err != nil {
-		return nil, errors.Wrapf(err, "inserting products %v", np)
+	if _, err := tx.ExecContext(ctx, q, p.ID, p.Name, p.CategoryID, p.Tags, p.Cost, p.Quantity, p.UserID, p.DateCreated, p.DateUpdated); err != nil {
+		if isForeignKeyViolation(err) {
+			return ErrInvalidCategory
+		}
+		return errors.Wrapf(err, "inserting product %q", p.Name)
 	}
 
-	return &p, nil
+	// The initial price starts the price history of the product.
+	return recordPrice(ctx, tx, p.ID, nil, p.Cost, p.UserID, nil, now)
 }
 
-// Update modifies data about a Product. It will error if the specified ID is
-// invalid or does not reference an existing product.
-func Update(ctx context.Context, db *sqlx.DB, user auth.Claims, id string, update UpdateProduct, now time.Time) error {
+// Update modifies data about a Product and gives it back as updated. It will
+// error if the specified ID is invalid or does not reference an existing
+// product. Archived products give ErrNotFound until they are restored. It
+// returns ErrConflict if the Product is not at the version given in the update
+// or if it was changed by someone else while being updated.
+func Update(ctx context.Context, db *sqlx.DB, user auth.Claims, id string, update UpdateProduct, now time.Time) (*Product, error) {
 	p, err := Retrieve(ctx, db, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// If you do not have the admin role...
-	// and you are not the owner of this product...
-	// then get outta here!
-	if !user.HasRole(auth.RoleAdmin) && p.UserID != user.Subject {
-		return ErrForbidden
+	if err := Authorize(user, ActionUpdate, p.UserID); err != nil {
+		return nil, err
+	}
+
+	// Archived products can not be changed until they are restored.
+	if p.DeletedAt != nil {
+		return nil, ErrNotFound
+	}
+
+	if update.Version != nil && *update.Version != p.Version {
+		return nil, ErrConflict
 	}
 
+	oldCost := p.Cost
+
 	if update.Name != nil {
 		p.Name = *update.Name
 	}
@@ -113,34 +330,236 @@ func Update(ctx context.Context, db *sqlx.DB, user auth.Claims, id string, updat
 	if update.Quantity != nil {
 		p.Quantity = *update.Quantity
 	}
+	if update.CategoryID != nil {
+		p.CategoryID = update.CategoryID
+		if *update.CategoryID == "" {
+			p.CategoryID = nil
+		}
+	}
+	if update.Tags != nil {
+		p.Tags = normalizeTags(update.Tags)
+	}
 	p.DateUpdated = now
 
 	const q = `UPDATE products SET
-		"name" = $2,
-		"cost" = $3,
-		"quantity" = $4,
-		"date_updated" = $5
+		"name" = $3,
+		"category_id" = $4,
+		"tags" = $5,
+		"cost" = $6,
+		"quantity" = $7,
+		"date_updated" = $8,
+		"version" = version + 1
+		WHERE product_id = $1 AND version = $2 AND deleted_at IS NULL`
+
+	err = database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		res, err := tx.ExecContext(ctx, q, id, p.Version, p.Name, p.CategoryID, p.Tags, p.Cost, p.Quantity, p.DateUpdated)
+		if err != nil {
+			if isForeignKeyViolation(err) {
+				return ErrInvalidCategory
+			}
+			return errors.Wrap(err, "updating product")
+		}
+
+		// No row was updated when the version changed or the product was
+		// archived since we read it.
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "checking updated product")
+		}
+		if n == 0 {
+			return ErrConflict
+		}
+
+		if p.Cost == oldCost {
+			return nil
+		}
+
+		return recordPrice(ctx, tx, id, &oldCost, p.Cost, user.Subject, nil, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p.Version++
+
+	return p, nil
+}
+
+// Archive hides the product identified by a given ID from listings and stops
+// it from being sold. Its sales are kept. When version is not zero the
+// product is only archived if it is still at that version, otherwise
+// ErrConflict is returned. The user must be allowed to delete the product.
+func Archive(ctx context.Context, db *sqlx.DB, user auth.Claims, id string, version int, now time.Time) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		// The product is locked so its owner and version can not change
+		// between the checks below and archiving it.
+		var p struct {
+			UserID    sql.NullString `db:"user_id"`
+			Version   int            `db:"version"`
+			DeletedAt *time.Time     `db:"deleted_at"`
+		}
+
+		const lock = `SELECT user_id, version, deleted_at FROM products WHERE product_id = $1 FOR UPDATE`
+		if err := tx.GetContext(ctx, &p, lock, id); err != nil {
+			// Archiving a product that does not exist is not an error.
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return errors.Wrapf(err, "locking product %s", id)
+		}
+
+		if err := Authorize(user, ActionDelete, p.UserID.String); err != nil {
+			return err
+		}
+
+		// Archiving a product that is already archived is not an error either
+		// but archiving one that is at another version is.
+		if p.DeletedAt != nil {
+			return nil
+		}
+		if version != 0 && version != p.Version {
+			return ErrConflict
+		}
+
+		const q = `UPDATE products SET
+			"deleted_at" = $2,
+			"date_updated" = $2,
+			"version" = version + 1
+			WHERE product_id = $1`
+
+		if _, err := tx.ExecContext(ctx, q, id, now.UTC()); err != nil {
+			return errors.Wrapf(err, "archiving product %s", id)
+		}
+
+		return nil
+	})
+}
+
+// Restore makes an archived product visible and sellable again.
+func Restore(ctx context.Context, db *sqlx.DB, id string, now time.Time) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	const q = `UPDATE products SET
+		"deleted_at" = NULL,
+		"date_updated" = $2,
+		"version" = CASE WHEN deleted_at IS NULL THEN version ELSE version + 1 END
 		WHERE product_id = $1`
 
-	_, err = db.ExecContext(ctx, q, id, p.Name, p.Cost, p.Quantity, p.DateUpdated)
+	res, err := db.ExecContext(ctx, q, id, now.UTC())
+	if err != nil {
+		return errors.Wrapf(err, "restoring product %s", id)
+	}
+
+	n, err := res.RowsAffected()
 	if err != nil {
-		return errors.Wrap(err, "updating product")
+		return errors.Wrapf(err, "checking restored product %s", id)
+	}
+	if n == 0 {
+		return ErrNotFound
 	}
 
 	return nil
 }
 
-// Delete removes the product identified by a given ID
-func Delete(ctx context.Context, db *sqlx.DB, id string) error {
+// Purge permanently removes the product identified by a given ID along with
+// its images in store. Only products without any sales can be purged so no
+// revenue history is lost. A *CleanupError is returned when the product was
+// purged but some of its images could not be removed from store.
+func Purge(ctx context.Context, db *sqlx.DB, store storage.BlobStore, id string) error {
 	if _, err := uuid.Parse(id); err != nil {
 		return ErrInvalidID
 	}
 
-	const q = `DELETE FROM products WHERE product_id = $1`
+	var keys []string
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		// Lock the product so no image is added while its keys are collected.
+		var hasSales bool
+
+		const lock = `SELECT EXISTS (SELECT 1 FROM sales WHERE product_id = $1)
+			FROM products WHERE product_id = $1 FOR UPDATE`
+		if err := tx.GetContext(ctx, &hasSales, lock, id); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return errors.Wrapf(err, "checking product %s", id)
+		}
+		if hasSales {
+			return ErrHasSales
+		}
+
+		var images []Image
+
+		const list = `SELECT * FROM product_images WHERE product_id = $1`
+		if err := tx.SelectContext(ctx, &images, list, id); err != nil {
+			return errors.Wrapf(err, "selecting images of product %s", id)
+		}
+		for _, img := range images {
+			keys = append(keys, img.Key, img.ThumbnailKey)
+		}
 
-	if _, err := db.ExecContext(ctx, q, id); err != nil {
-		return errors.Wrapf(err, "deleting product %s", id)
+		// The images are removed along with the product.
+		const q = `DELETE FROM products WHERE product_id = $1`
+		if _, err := tx.ExecContext(ctx, q, id); err != nil {
+			return errors.Wrapf(err, "purging product %s", id)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := deleteBlobs(ctx, store, keys...); err != nil {
+		return &CleanupError{Err: err}
 	}
 
 	return nil
 }
+
+// where joins conditions into a WHERE clause. It returns an empty string when
+// there are no conditions.
+func where(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "\n\tWHERE " + strings.Join(conditions, " AND ")
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern so user input
+// is matched literally.
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
+
+// normalizeTags lower cases and trims tags and drops blank and duplicate ones
+// so tags differing only in spelling are matched by listing filters.
+func normalizeTags(tags []string) pq.StringArray {
+	seen := make(map[string]bool, len(tags))
+	out := make(pq.StringArray, 0, len(tags))
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+
+	return out
+}
+
+// isForeignKeyViolation reports whether err was caused by a row referencing
+// another row that does not exist.
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
@@ -1,14 +1,20 @@
 package product_test
 
 import (
+	"bytes"
 	"context"
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
 	"github.com/wgarcia4190/garagesale/internal/schema"
+	"image"
+	"image/png"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
 	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/platform/storage"
 	"github.com/wgarcia4190/garagesale/internal/product"
 )
 
@@ -57,12 +63,508 @@ func TestList(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ps, err := product.List(ctx, db)
+	ps, err := product.List(ctx, db, product.ListQuery{})
 	if err != nil {
 		t.Fatalf("listing products: %v", err)
 	}
 
-	if exp, got := 2, len(ps); exp != got {
+	if exp, got := 2, len(ps.Products); exp != got {
 		t.Fatalf("expected product list size %v, got %v", exp, got)
 	}
 }
+
+func TestListPaging(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	lq := product.ListQuery{Limit: 1, Sort: product.SortCost, Order: product.OrderDesc}
+
+	first, err := product.List(ctx, db, lq)
+	if err != nil {
+		t.Fatalf("listing first page: %v", err)
+	}
+
+	if exp, got := "McDonalds Toys", first.Products[0].Name; exp != got {
+		t.Fatalf("expected first product %q, got %q", exp, got)
+	}
+	if first.NextCursor == "" {
+		t.Fatal("expected a cursor for the second page")
+	}
+
+	lq.Cursor = first.NextCursor
+	second, err := product.List(ctx, db, lq)
+	if err != nil {
+		t.Fatalf("listing second page: %v", err)
+	}
+
+	if exp, got := "Comic Books", second.Products[0].Name; exp != got {
+		t.Fatalf("expected second product %q, got %q", exp, got)
+	}
+	if second.NextCursor != "" {
+		t.Fatalf("expected no cursor after the last page, got %q", second.NextCursor)
+	}
+
+	lq.Sort = product.SortName
+	if _, err := product.List(ctx, db, lq); err != product.ErrInvalidCursor {
+		t.Fatalf("expected %v for a cursor of another sort, got %v", product.ErrInvalidCursor, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit is ignored so every product is exported in listing order.
+	lq := product.ListQuery{Limit: 1, Sort: product.SortCost, Order: product.OrderDesc}
+
+	var names []string
+	err := product.Export(ctx, db, lq, func(p product.Product) error {
+		names = append(names, p.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("exporting products: %v", err)
+	}
+
+	if diff := cmp.Diff([]string{"McDonalds Toys", "Comic Books"}, names); diff != "" {
+		t.Fatalf("exported products did not match:\n%s", diff)
+	}
+
+	sq := product.SaleQuery{
+		From: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2019, time.January, 2, 0, 0, 0, 0, time.UTC),
+	}
+	sales, err := product.SearchSales(ctx, db, sq)
+	if err != nil {
+		t.Fatalf("searching sales: %v", err)
+	}
+	if exp, got := 3, len(sales.Sales); exp != got {
+		t.Fatalf("expected %d sales, got %d", exp, got)
+	}
+	if sales.NextCursor != "" {
+		t.Fatalf("expected no next cursor on the last page, got %q", sales.NextCursor)
+	}
+
+	// Page through the same sales two at a time.
+	sq.Limit = 2
+	first, err := product.SearchSales(ctx, db, sq)
+	if err != nil {
+		t.Fatalf("searching first page of sales: %v", err)
+	}
+	if len(first.Sales) != 2 || first.NextCursor == "" {
+		t.Fatalf("expected 2 sales and a next cursor, got %d and %q", len(first.Sales), first.NextCursor)
+	}
+
+	sq.Cursor = first.NextCursor
+	second, err := product.SearchSales(ctx, db, sq)
+	if err != nil {
+		t.Fatalf("searching second page of sales: %v", err)
+	}
+	if len(second.Sales) != 1 || second.NextCursor != "" {
+		t.Fatalf("expected 1 sale and no next cursor, got %d and %q", len(second.Sales), second.NextCursor)
+	}
+	if second.Sales[0].ID != sales.Sales[2].ID {
+		t.Fatalf("expected the second page to hold sale %s, got %s", sales.Sales[2].ID, second.Sales[0].ID)
+	}
+
+	_, err = product.SearchSales(ctx, db, product.SaleQuery{
+		From: time.Date(2019, time.January, 2, 0, 0, 0, 0, time.UTC),
+		To:   time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != product.ErrInvalidRange {
+		t.Fatalf("expected %v, got %v", product.ErrInvalidRange, err)
+	}
+}
+
+func TestAddSale(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	// The seeded Comic Books have 42 units of which 7 were already sold.
+	const id = "a2b0639f-2cc6-44b8-b97b-15d69dbb511e"
+
+	admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+	other := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+
+	if _, err := product.AddSale(ctx, db, other, product.NewSale{Quantity: 1, Paid: 50}, id, now); err != product.ErrForbidden {
+		t.Fatalf("expected %v selling a product of someone else, got %v", product.ErrForbidden, err)
+	}
+
+	if _, err := product.AddSale(ctx, db, admin, product.NewSale{Quantity: 35, Paid: 1000}, id, now); err != nil {
+		t.Fatalf("selling remaining stock: %v", err)
+	}
+
+	_, err := product.AddSale(ctx, db, admin, product.NewSale{Quantity: 1, Paid: 50}, id, now)
+	if _, ok := err.(*product.StockError); !ok {
+		t.Fatalf("expected a *product.StockError when overselling, got %v", err)
+	}
+
+	_, err = product.AddSale(ctx, db, admin, product.NewSale{Quantity: 1, Paid: 50}, "5b3d5d1a-5e3c-4f25-b3f4-000000000000", now)
+	if err != product.ErrNotFound {
+		t.Fatalf("expected %v for an unknown product, got %v", product.ErrNotFound, err)
+	}
+}
+
+func TestRefunds(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	claims := auth.NewClaims(
+		"5cf37266-3473-4006-984f-9325122678b7", // This is the seeded admin user.
+		[]string{auth.RoleAdmin, auth.RoleUser},
+		now, time.Hour,
+	)
+
+	// The seeded sale of 5 Comic Books for 250.
+	const (
+		productID = "a2b0639f-2cc6-44b8-b97b-15d69dbb511e"
+		saleID    = "85f6fb09-eb05-4874-ae39-82d1a30fe0d7"
+	)
+
+	nr := product.NewRefund{Quantity: 2, Amount: 100}
+	if _, err := product.AddRefund(ctx, db, claims, productID, saleID, nr, now); err != nil {
+		t.Fatalf("refunding sale: %v", err)
+	}
+
+	p, err := product.Retrieve(ctx, db, productID)
+	if err != nil {
+		t.Fatalf("retrieving product: %v", err)
+	}
+
+	if exp, got := 5, p.Sold; exp != got {
+		t.Fatalf("expected %d units sold net of refunds, got %d", exp, got)
+	}
+	if exp, got := 250, p.Revenue; exp != got {
+		t.Fatalf("expected revenue %d net of refunds, got %d", exp, got)
+	}
+
+	nr = product.NewRefund{Quantity: 4}
+	if _, err := product.AddRefund(ctx, db, claims, productID, saleID, nr, now); err != product.ErrRefundExceedsSale {
+		t.Fatalf("expected %v, got %v", product.ErrRefundExceedsSale, err)
+	}
+}
+
+func TestUpdateVersion(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	claims := auth.NewClaims(
+		"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+		[]string{auth.RoleUser},
+		now, time.Hour,
+	)
+
+	p, err := product.Create(ctx, db, claims, product.NewProduct{Name: "Lamp", Cost: 10, Quantity: 1}, now)
+	if err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+
+	cost := 8
+	update := product.UpdateProduct{Cost: &cost, Version: &p.Version}
+	updated, err := product.Update(ctx, db, claims, p.ID, update, now)
+	if err != nil {
+		t.Fatalf("updating product: %v", err)
+	}
+	if exp, got := p.Version+1, updated.Version; exp != got {
+		t.Fatalf("expected version %d after updating, got %d", exp, got)
+	}
+
+	// The same update is now based on a stale version.
+	if _, err := product.Update(ctx, db, claims, p.ID, update, now); err != product.ErrConflict {
+		t.Fatalf("expected %v for a stale version, got %v", product.ErrConflict, err)
+	}
+
+	// Owners need a role granting products:delete to archive what they own.
+	claims.Permissions = []string{auth.PermProductsWrite, auth.PermProductsDelete}
+	if err := product.Archive(ctx, db, claims, p.ID, p.Version, now); err != product.ErrConflict {
+		t.Fatalf("expected %v archiving a stale version, got %v", product.ErrConflict, err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	const id = "a2b0639f-2cc6-44b8-b97b-15d69dbb511e"
+
+	admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+	if err := product.Archive(ctx, db, admin, id, 0, now); err != nil {
+		t.Fatalf("archiving product: %v", err)
+	}
+
+	ps, err := product.List(ctx, db, product.ListQuery{})
+	if err != nil {
+		t.Fatalf("listing products: %v", err)
+	}
+	if exp, got := 1, len(ps.Products); exp != got {
+		t.Fatalf("expected %d product once archived, got %d", exp, got)
+	}
+
+	if _, err := product.AddSale(ctx, db, admin, product.NewSale{Quantity: 1}, id, now); err != product.ErrNotFound {
+		t.Fatalf("expected %v selling an archived product, got %v", product.ErrNotFound, err)
+	}
+
+	cost := 60
+	if _, err := product.Update(ctx, db, admin, id, product.UpdateProduct{Cost: &cost}, now); err != product.ErrNotFound {
+		t.Fatalf("expected %v updating an archived product, got %v", product.ErrNotFound, err)
+	}
+
+	archived, err := product.Retrieve(ctx, db, id)
+	if err != nil {
+		t.Fatalf("retrieving product: %v", err)
+	}
+	if !archived.DateUpdated.Equal(now) {
+		t.Fatalf("expected the archived product to be updated at %v, got %v", now, archived.DateUpdated)
+	}
+
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/v1/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := product.Purge(ctx, db, store, id); err != product.ErrHasSales {
+		t.Fatalf("expected %v purging a product with sales, got %v", product.ErrHasSales, err)
+	}
+
+	if err := product.Restore(ctx, db, id, now); err != nil {
+		t.Fatalf("restoring product: %v", err)
+	}
+
+	saved, err := product.Retrieve(ctx, db, id)
+	if err != nil {
+		t.Fatalf("retrieving product: %v", err)
+	}
+	if saved.DeletedAt != nil {
+		t.Fatalf("expected restored product to not be archived, got %v", saved.DeletedAt)
+	}
+}
+
+func TestImages(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	store, err := storage.NewLocal(t.TempDir(), "http://localhost/v1/images")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+	p, err := product.Create(ctx, db, admin, product.NewProduct{Name: "Lamp", Cost: 10, Quantity: 1}, now)
+	if err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+
+	var data bytes.Buffer
+	if err := png.Encode(&data, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	small := product.ImageConfig{MaxPixels: 15}
+	if _, err := product.AddImage(ctx, db, store, small, admin, p.ID, data.Bytes(), now); err != product.ErrImageDimensions {
+		t.Fatalf("expected %v for too many pixels, got %v", product.ErrImageDimensions, err)
+	}
+
+	img, err := product.AddImage(ctx, db, store, product.ImageConfig{}, admin, p.ID, data.Bytes(), now)
+	if err != nil {
+		t.Fatalf("adding image: %v", err)
+	}
+
+	saved, err := product.Retrieve(ctx, db, p.ID)
+	if err != nil {
+		t.Fatalf("retrieving product: %v", err)
+	}
+	product.SetImageURLs(store, saved)
+	if exp, got := store.URL(img.Key), saved.Images[0].URL; exp != got {
+		t.Fatalf("expected image url %q, got %q", exp, got)
+	}
+
+	if err := product.Purge(ctx, db, store, p.ID); err != nil {
+		t.Fatalf("purging product: %v", err)
+	}
+	if _, err := store.Get(ctx, img.Key); err != storage.ErrNotFound {
+		t.Fatalf("expected the image to be removed with its product, got %v", err)
+	}
+}
+
+func TestPrices(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	now := time.Date(2020, time.September, 1, 10, 0, 0, 0, time.UTC)
+
+	claims := auth.NewClaims(
+		"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+		[]string{auth.RoleUser},
+		now, time.Hour,
+	)
+
+	p, err := product.Create(ctx, db, claims, product.NewProduct{Name: "Chair", Cost: 40, Quantity: 4}, now)
+	if err != nil {
+		t.Fatalf("creating product: %v", err)
+	}
+
+	discount := 50
+	nps := product.NewPriceSchedule{Discount: &discount, EffectiveAt: now.Add(4 * time.Hour)}
+	if _, err := product.SchedulePrice(ctx, db, claims, p.ID, nps, now); err != nil {
+		t.Fatalf("scheduling price: %v", err)
+	}
+
+	if n, err := product.ApplyScheduledPrices(ctx, db, now.Add(time.Hour)); err != nil || n != 0 {
+		t.Fatalf("expected no price applied before its time, got %d: %v", n, err)
+	}
+
+	if n, err := product.ApplyScheduledPrices(ctx, db, now.Add(5*time.Hour)); err != nil || n != 1 {
+		t.Fatalf("expected one price applied after its time, got %d: %v", n, err)
+	}
+
+	saved, err := product.Retrieve(ctx, db, p.ID)
+	if err != nil {
+		t.Fatalf("retrieving product: %v", err)
+	}
+	if exp, got := 20, saved.Cost; exp != got {
+		t.Fatalf("expected discounted cost %d, got %d", exp, got)
+	}
+
+	prices, err := product.ListPrices(ctx, db, p.ID)
+	if err != nil {
+		t.Fatalf("listing prices: %v", err)
+	}
+	if exp, got := 2, len(prices); exp != got {
+		t.Fatalf("expected %d prices in history, got %d", exp, got)
+	}
+	if prices[1].ScheduleID == nil {
+		t.Fatal("expected the applied price to reference its schedule")
+	}
+
+	// Schedules of archived products wait until they are restored.
+	nps.EffectiveAt = now.Add(6 * time.Hour)
+	if _, err := product.SchedulePrice(ctx, db, claims, p.ID, nps, now); err != nil {
+		t.Fatalf("scheduling price: %v", err)
+	}
+
+	claims.Permissions = []string{auth.PermProductsDelete}
+	if err := product.Archive(ctx, db, claims, p.ID, 0, now); err != nil {
+		t.Fatalf("archiving product: %v", err)
+	}
+	if n, err := product.ApplyScheduledPrices(ctx, db, now.Add(7*time.Hour)); err != nil || n != 0 {
+		t.Fatalf("expected no price applied to an archived product, got %d: %v", n, err)
+	}
+
+	if err := product.Restore(ctx, db, p.ID, now); err != nil {
+		t.Fatalf("restoring product: %v", err)
+	}
+	if n, err := product.ApplyScheduledPrices(ctx, db, now.Add(7*time.Hour)); err != nil || n != 1 {
+		t.Fatalf("expected the price applied once restored, got %d: %v", n, err)
+	}
+}
+
+func TestImport(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	claims := auth.NewClaims(
+		"718ffbea-f4a1-4667-8ae3-b349da52675e", // This is just some random UUID.
+		[]string{auth.RoleUser},
+		now, time.Hour,
+	)
+
+	const doc = `name,cost,quantity,tags
+Comic Books,10,20,paper;kids
+Yo-Yo,lots,5,
+,5,5,
+Puzzles,15,3,`
+
+	rows, err := product.DecodeImport(strings.NewReader(doc), product.ImportCSV)
+	if err != nil {
+		t.Fatalf("decoding import: %v", err)
+	}
+
+	dry, err := product.Import(ctx, db, claims, rows, true, now)
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if dry.Imported != 2 || len(dry.Errors) != 2 {
+		t.Fatalf("expected 2 products and 2 errors in the dry run, got %d and %d", dry.Imported, len(dry.Errors))
+	}
+	if exp, got := []int{2, 3}, []int{dry.Errors[0].Row, dry.Errors[1].Row}; !cmp.Equal(exp, got) {
+		t.Fatalf("expected errors for rows %v, got %v", exp, got)
+	}
+
+	list, err := product.List(ctx, db, product.ListQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Products) != 0 {
+		t.Fatalf("expected the dry run to create nothing, found %d products", len(list.Products))
+	}
+
+	res, err := product.Import(ctx, db, claims, rows, false, now)
+	if err != nil {
+		t.Fatalf("importing: %v", err)
+	}
+	if res.Imported != 2 {
+		t.Fatalf("expected 2 products imported, got %d", res.Imported)
+	}
+
+	list, err = product.List(ctx, db, product.ListQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Products) != 2 {
+		t.Fatalf("expected 2 products after importing, found %d", len(list.Products))
+	}
+
+	if _, err := product.DecodeImport(strings.NewReader("name,price\nToys,5"), product.ImportCSV); errors.Cause(err) != product.ErrInvalidImport {
+		t.Fatalf("expected %v for an unknown column, got %v", product.ErrInvalidImport, err)
+	}
+}
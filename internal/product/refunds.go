@@ -0,0 +1,119 @@
+package product
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+)
+
+var (
+	ErrSaleNotFound      = errors.New("Sale not found")
+	ErrEmptyRefund       = errors.New("refund must return units or money")
+	ErrRefundExceedsSale = errors.New("refund exceeds what is left of the sale")
+)
+
+// AddRefund records a refund against a Sale of a Product. The sale row is
+// locked while the refund is recorded so concurrent refunds can not give back
+// more units or money than the sale was for.
+func AddRefund(ctx context.Context, db *sqlx.DB, user auth.Claims, productID, saleID string, nr NewRefund, now time.Time) (*Refund, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(saleID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	if nr.Quantity == 0 && nr.Amount == 0 {
+		return nil, ErrEmptyRefund
+	}
+
+	r := Refund{
+		ID:          uuid.New().String(),
+		SaleID:      saleID,
+		ProductID:   productID,
+		Quantity:    nr.Quantity,
+		Amount:      nr.Amount,
+		Reason:      nr.Reason,
+		UserID:      user.Subject,
+		DateCreated: now.UTC(),
+	}
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		var sale struct {
+			Quantity int `db:"quantity"`
+			Paid     int `db:"paid"`
+		}
+
+		const lock = `SELECT quantity, paid FROM sales
+			WHERE sale_id = $1 AND product_id = $2
+			FOR UPDATE`
+
+		if err := tx.GetContext(ctx, &sale, lock, saleID, productID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrSaleNotFound
+			}
+			return errors.Wrap(err, "locking sale")
+		}
+
+		var refunded struct {
+			Quantity int `db:"quantity"`
+			Amount   int `db:"amount"`
+		}
+
+		const sum = `SELECT
+				COALESCE(SUM(quantity), 0) AS quantity,
+				COALESCE(SUM(amount), 0) AS amount
+			FROM refunds WHERE sale_id = $1`
+
+		if err := tx.GetContext(ctx, &refunded, sum, saleID); err != nil {
+			return errors.Wrap(err, "summing refunds")
+		}
+
+		if refunded.Quantity+r.Quantity > sale.Quantity || refunded.Amount+r.Amount > sale.Paid {
+			return ErrRefundExceedsSale
+		}
+
+		const q = `INSERT INTO refunds
+			(refund_id, sale_id, product_id, quantity, amount, reason, user_id, date_created)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+
+		if _, err := tx.ExecContext(ctx, q, r.ID, r.SaleID, r.ProductID, r.Quantity, r.Amount, r.Reason, r.UserID, r.DateCreated); err != nil {
+			return errors.Wrap(err, "inserting refund")
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// ListRefunds gives all Refunds of a Sale of a Product.
+func ListRefunds(ctx context.Context, db *sqlx.DB, productID, saleID string) ([]Refund, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+	if _, err := uuid.Parse(saleID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	refunds := make([]Refund, 0)
+
+	const q = `SELECT * FROM refunds
+		WHERE sale_id = $1 AND product_id = $2
+		ORDER BY date_created`
+
+	if err := db.SelectContext(ctx, &refunds, q, saleID, productID); err != nil {
+		return nil, errors.Wrap(err, "selecting refunds")
+	}
+
+	return refunds, nil
+}
@@ -2,29 +2,120 @@ package product
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/pkg/errors"
-	"time"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
 )
 
-// AddSale records a sales transaction for a single Product.
-func AddSale(ctx context.Context, db *sqlx.DB, ns NewSale, productID string, now time.Time) (*Sale, error) {
+// ErrInvalidRange occurs when searching for sales that end before they start.
+var ErrInvalidRange = errors.New("to must be after from")
+
+// StockError is returned when a sale asks for more units of a Product than
+// are left in stock.
+type StockError struct {
+	ProductID string
+	Requested int
+	Available int
+}
+
+// Error implements the error interface.
+func (e *StockError) Error() string {
+	return fmt.Sprintf("product %s has %d units left, cannot sell %d", e.ProductID, e.Available, e.Requested)
+}
+
+// AddSale records a sales transaction for a single Product. The product row
+// is locked while the sale is recorded so concurrent sales can not sell more
+// units than are in stock. It returns a *StockError if the sale asks for more
+// units than are left. The user must be allowed to record sales of the
+// product.
+func AddSale(ctx context.Context, db *sqlx.DB, user auth.Claims, ns NewSale, productID string, now time.Time) (*Sale, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	owner, err := ownerOf(ctx, db, productID)
+	if err != nil {
+		return nil, err
+	}
+	if err := Authorize(user, ActionRecordSale, owner); err != nil {
+		return nil, err
+	}
+
+	var s *Sale
+
+	err = database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		var err error
+		s, err = RecordSale(ctx, tx, ns, productID, "", now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// RecordSale checks the remaining stock of a Product and records a sale for
+// it as part of the transaction tx. The product row stays locked until tx
+// ends so callers recording several sales can check all of them before
+// committing. The orderID links the sale to an order and may be blank.
+func RecordSale(ctx context.Context, tx *sqlx.Tx, ns NewSale, productID, orderID string, now time.Time) (*Sale, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
 	s := Sale{
 		ID:          uuid.New().String(),
 		ProductID:   productID,
 		Quantity:    ns.Quantity,
 		Paid:        ns.Paid,
-		DateCreated: now,
+		DateCreated: now.UTC(),
+	}
+	if orderID != "" {
+		s.OrderID = &orderID
 	}
 
-	const q = `INSERT INTO sales
-		(sale_id, product_id, quantity, paid, date_created)
-		VALUES ($1, $2, $3, $4, $5)`
+	var quantity int
 
-	_, err := db.ExecContext(ctx, q, s.ID, s.ProductID, s.Quantity, s.Paid, s.DateCreated)
+	// Archived products can not be sold.
+	const lock = `SELECT quantity FROM products WHERE product_id = $1 AND deleted_at IS NULL FOR UPDATE`
+	if err := tx.GetContext(ctx, &quantity, lock, s.ProductID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "locking product")
+	}
 
-	if err != nil {
+	// Units given back by refunds are available to be sold again.
+	var sold int
+
+	const sum = `SELECT
+		(SELECT COALESCE(SUM(quantity), 0) FROM sales WHERE product_id = $1) -
+		(SELECT COALESCE(SUM(quantity), 0) FROM refunds WHERE product_id = $1)`
+	if err := tx.GetContext(ctx, &sold, sum, s.ProductID); err != nil {
+		return nil, errors.Wrap(err, "counting units sold")
+	}
+
+	if available := quantity - sold; s.Quantity > available {
+		return nil, &StockError{
+			ProductID: s.ProductID,
+			Requested: s.Quantity,
+			Available: available,
+		}
+	}
+
+	const q = `INSERT INTO sales
+		(sale_id, product_id, order_id, quantity, paid, date_created)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	if _, err := tx.ExecContext(ctx, q, s.ID, s.ProductID, s.OrderID, s.Quantity, s.Paid, s.DateCreated); err != nil {
 		return nil, errors.Wrap(err, "inserting sale")
 	}
 
@@ -33,6 +124,10 @@ func AddSale(ctx context.Context, db *sqlx.DB, ns NewSale, productID string, now
 
 // ListSales gives all Sales for a Product.
 func ListSales(ctx context.Context, db *sqlx.DB, productID string) ([]Sale, error) {
+	if _, err := uuid.Parse(productID); err != nil {
+		return nil, ErrInvalidID
+	}
+
 	sales := make([]Sale, 0)
 
 	const q = `SELECT * FROM sales WHERE product_id = $1`
@@ -42,3 +137,113 @@ func ListSales(ctx context.Context, db *sqlx.DB, productID string) ([]Sale, erro
 
 	return sales, nil
 }
+
+// SearchSales gives a single page of the Sales matching the query ordered by
+// the time they were made. Use the NextCursor of the result in a following
+// query to fetch the next page.
+func SearchSales(ctx context.Context, db *sqlx.DB, sq SaleQuery) (*SaleResult, error) {
+	if sq.Limit <= 0 {
+		sq.Limit = DefaultLimit
+	}
+	if sq.Limit > MaxLimit {
+		sq.Limit = MaxLimit
+	}
+
+	// Ask for one extra row so we know if there is another page after this one.
+	limit := sq.Limit
+	sq.Limit++
+
+	sales := make([]Sale, 0, sq.Limit)
+	err := EachSale(ctx, db, sq, func(s Sale) error {
+		sales = append(sales, s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res := SaleResult{
+		Sales: sales,
+		Limit: limit,
+	}
+
+	if len(sales) > limit {
+		res.Sales = sales[:limit]
+		last := res.Sales[limit-1]
+		c := cursor{
+			Sort:  SortDateCreated,
+			Order: OrderAsc,
+			Value: last.DateCreated.UTC().Format(time.RFC3339Nano),
+			ID:    last.ID,
+		}
+		res.NextCursor = c.encode()
+	}
+
+	return &res, nil
+}
+
+// EachSale calls fn for every Sale matching the query ordered by the time they
+// were made. Sales are read from the database one at a time so large ranges
+// can be streamed without holding them in memory. A zero Limit reads every
+// matching sale. Iteration stops at the first error returned by fn.
+func EachSale(ctx context.Context, db *sqlx.DB, sq SaleQuery, fn func(Sale) error) error {
+	if !sq.From.IsZero() && !sq.To.IsZero() && !sq.To.After(sq.From) {
+		return ErrInvalidRange
+	}
+
+	var (
+		args       []interface{}
+		conditions []string
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if sq.ProductID != "" {
+		if _, err := uuid.Parse(sq.ProductID); err != nil {
+			return ErrInvalidID
+		}
+		conditions = append(conditions, "product_id = "+arg(sq.ProductID))
+	}
+	if !sq.From.IsZero() {
+		conditions = append(conditions, "date_created >= "+arg(sq.From.UTC()))
+	}
+	if !sq.To.IsZero() {
+		conditions = append(conditions, "date_created < "+arg(sq.To.UTC()))
+	}
+
+	if sq.Cursor != "" {
+		c, err := decodeCursor(sq.Cursor, SortDateCreated, OrderAsc)
+		if err != nil {
+			return err
+		}
+		v, _ := c.value()
+		conditions = append(conditions, fmt.Sprintf("(date_created, sale_id) > (%s, %s)", arg(v), arg(c.ID)))
+	}
+
+	q := `SELECT * FROM sales` + where(conditions) + `
+	ORDER BY date_created, sale_id`
+
+	if sq.Limit > 0 {
+		q += "\n\tLIMIT " + arg(sq.Limit)
+	}
+
+	rows, err := db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return errors.Wrap(err, "selecting sales")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s Sale
+		if err := rows.StructScan(&s); err != nil {
+			return errors.Wrap(err, "scanning sale")
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+
+	return errors.Wrap(rows.Err(), "iterating sales")
+}
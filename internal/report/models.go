@@ -0,0 +1,50 @@
+package report
+
+import "time"
+
+// These are the bucket sizes understood by SalesQuery.Bucket.
+const (
+	BucketHour  = "hour"
+	BucketDay   = "day"
+	BucketWeek  = "week"
+	BucketMonth = "month"
+)
+
+// These are the groupings understood by SalesQuery.GroupBy.
+const (
+	GroupNone    = ""
+	GroupProduct = "product"
+	GroupSeller  = "seller"
+)
+
+// SalesQuery describes the sales report a caller wants. Sales made from From
+// up to but excluding To are counted in buckets of the given size. When
+// GroupBy is set every bucket is further split by product or seller.
+type SalesQuery struct {
+	Bucket  string
+	From    time.Time
+	To      time.Time
+	GroupBy string
+}
+
+// SalesBucket holds the figures of the sales made within a bucket of time.
+// Units and Revenue are net of refunds. GroupID and GroupName identify the
+// product or seller of the figures for grouped reports.
+type SalesBucket struct {
+	Start     time.Time `db:"bucket" json:"start"`
+	GroupID   *string   `db:"group_id" json:"group_id,omitempty"`
+	GroupName *string   `db:"group_name" json:"group_name,omitempty"`
+	Sales     int       `db:"sales" json:"sales"`
+	Units     int       `db:"units" json:"units"`
+	Revenue   int       `db:"revenue" json:"revenue"`
+}
+
+// SalesReport is the answer to a SalesQuery. Buckets without any sales are
+// left out.
+type SalesReport struct {
+	Bucket  string        `json:"bucket"`
+	GroupBy string        `json:"group_by,omitempty"`
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Buckets []SalesBucket `json:"buckets"`
+}
@@ -0,0 +1,92 @@
+package report
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// DefaultRange is how far back a report goes when no From time is given.
+const DefaultRange = 30 * 24 * time.Hour
+
+var (
+	ErrInvalidBucket = errors.New("bucket must be one of hour, day, week or month")
+	ErrInvalidGroup  = errors.New("group_by must be one of product or seller")
+	ErrInvalidRange  = errors.New("from must be before to")
+)
+
+// Sales reports the sales made over a range of time bucketed by the size
+// asked for. A zero To means now and a zero From means DefaultRange before
+// To. The aggregation is done by the database.
+func Sales(ctx context.Context, db *sqlx.DB, sq SalesQuery, now time.Time) (*SalesReport, error) {
+	if sq.Bucket == "" {
+		sq.Bucket = BucketDay
+	}
+
+	switch sq.Bucket {
+	case BucketHour, BucketDay, BucketWeek, BucketMonth:
+	default:
+		return nil, ErrInvalidBucket
+	}
+
+	// The grouping expressions are picked from a fixed set, never taken from
+	// the caller, so they are safe to put in the query.
+	var groupID, groupName string
+	switch sq.GroupBy {
+	case GroupNone:
+		groupID, groupName = "NULL::TEXT", "NULL::TEXT"
+	case GroupProduct:
+		groupID, groupName = "s.product_id::TEXT", "MAX(p.name)"
+	case GroupSeller:
+		groupID, groupName = "p.user_id::TEXT", "MAX(u.name)"
+	default:
+		return nil, ErrInvalidGroup
+	}
+
+	if sq.To.IsZero() {
+		sq.To = now
+	}
+	if sq.From.IsZero() {
+		sq.From = sq.To.Add(-DefaultRange)
+	}
+	sq.From, sq.To = sq.From.UTC(), sq.To.UTC()
+
+	if !sq.From.Before(sq.To) {
+		return nil, ErrInvalidRange
+	}
+
+	q := `SELECT
+			date_trunc($1, s.date_created) AS bucket,
+			` + groupID + ` AS group_id,
+			` + groupName + ` AS group_name,
+			COUNT(*) AS sales,
+			SUM(s.quantity - COALESCE(r.quantity, 0)) AS units,
+			SUM(s.paid - COALESCE(r.amount, 0)) AS revenue
+		FROM sales AS s
+		JOIN products AS p ON p.product_id = s.product_id
+		LEFT JOIN users AS u ON u.user_id = p.user_id
+		LEFT JOIN (
+			SELECT sale_id, SUM(quantity) AS quantity, SUM(amount) AS amount
+			FROM refunds
+			GROUP BY sale_id
+		) AS r ON r.sale_id = s.sale_id
+		WHERE s.date_created >= $2 AND s.date_created < $3
+		GROUP BY 1, 2
+		ORDER BY 1, 2`
+
+	rep := SalesReport{
+		Bucket:  sq.Bucket,
+		GroupBy: sq.GroupBy,
+		From:    sq.From,
+		To:      sq.To,
+		Buckets: make([]SalesBucket, 0),
+	}
+
+	if err := db.SelectContext(ctx, &rep.Buckets, q, sq.Bucket, sq.From, sq.To); err != nil {
+		return nil, errors.Wrap(err, "selecting sales report")
+	}
+
+	return &rep, nil
+}
@@ -0,0 +1,55 @@
+package report_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/report"
+	"github.com/wgarcia4190/garagesale/internal/schema"
+)
+
+func TestSales(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// All seeded sales were made in the first seconds of 2019.
+	sq := report.SalesQuery{
+		Bucket:  report.BucketDay,
+		From:    time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC),
+		To:      time.Date(2019, time.January, 2, 0, 0, 0, 0, time.UTC),
+		GroupBy: report.GroupProduct,
+	}
+
+	rep, err := report.Sales(ctx, db, sq, time.Now())
+	if err != nil {
+		t.Fatalf("reporting sales: %v", err)
+	}
+
+	if exp, got := 2, len(rep.Buckets); exp != got {
+		t.Fatalf("expected %d buckets, one per product, got %d", exp, got)
+	}
+
+	var revenue, units, sales int
+	for _, b := range rep.Buckets {
+		revenue += b.Revenue
+		units += b.Units
+		sales += b.Sales
+	}
+
+	if revenue != 575 || units != 10 || sales != 3 {
+		t.Fatalf("expected revenue 575, units 10 and 3 sales, got %d, %d and %d", revenue, units, sales)
+	}
+
+	sq.Bucket = "year"
+	if _, err := report.Sales(ctx, db, sq, time.Now()); err != report.ErrInvalidBucket {
+		t.Fatalf("expected %v, got %v", report.ErrInvalidBucket, err)
+	}
+}
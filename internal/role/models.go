@@ -0,0 +1,26 @@
+package role
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Role is a named set of permissions users are given through their roles.
+// Users holding a role with RequireMFA set must use two-factor authentication
+// to log in.
+type Role struct {
+	Name        string         `db:"name" json:"name"`
+	Permissions pq.StringArray `db:"permissions" json:"permissions"`
+	RequireMFA  bool           `db:"require_mfa" json:"require_mfa"`
+	DateCreated time.Time      `db:"date_created" json:"date_created"`
+	DateUpdated time.Time      `db:"date_updated" json:"date_updated"`
+}
+
+// UpdateRole defines what may be changed about a Role. A nil Permissions
+// leaves the permissions untouched, otherwise they are replaced. It uses a
+// pointer for RequireMFA so we can tell when it was not provided.
+type UpdateRole struct {
+	Permissions []string `json:"permissions" validate:"omitempty,dive,required"`
+	RequireMFA  *bool    `json:"require_mfa"`
+}
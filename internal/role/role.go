@@ -0,0 +1,228 @@
+package role
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+)
+
+var (
+	// ErrNotFound is used when a specific Role is requested but does not exist.
+	ErrNotFound = errors.New("role not found")
+
+	// ErrUnknownPermission occurs when a Role is given a permission that does
+	// not exist.
+	ErrUnknownPermission = errors.New("unknown permission")
+
+	// ErrNoRoleManager occurs when a change would leave no Role able to
+	// manage roles, so nobody could ever change them again.
+	ErrNoRoleManager = errors.New("at least one role must keep the " + auth.PermRolesManage + " permission")
+)
+
+// List gets all Roles from the database.
+func List(ctx context.Context, db *sqlx.DB) ([]Role, error) {
+	roles := make([]Role, 0)
+
+	const q = `SELECT * FROM roles ORDER BY name`
+	if err := db.SelectContext(ctx, &roles, q); err != nil {
+		return nil, errors.Wrap(err, "selecting roles")
+	}
+
+	return roles, nil
+}
+
+// Retrieve finds the Role with the given name.
+func Retrieve(ctx context.Context, db *sqlx.DB, name string) (*Role, error) {
+	var r Role
+
+	const q = `SELECT * FROM roles WHERE name = $1`
+	if err := db.GetContext(ctx, &r, q, name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting role %q", name)
+	}
+
+	return &r, nil
+}
+
+// Update changes the permissions or the two-factor policy of the Role with
+// the given name.
+func Update(ctx context.Context, db *sqlx.DB, name string, update UpdateRole, now time.Time) (*Role, error) {
+	for _, perm := range update.Permissions {
+		if !auth.IsPermission(perm) {
+			return nil, errors.Wrap(ErrUnknownPermission, perm)
+		}
+	}
+
+	var perms interface{}
+	if update.Permissions != nil {
+		perms = pq.Array(dedupe(update.Permissions))
+	}
+
+	var r Role
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		// Lock every role so concurrent changes can not each remove the
+		// permission from a different role.
+		if _, err := tx.ExecContext(ctx, `SELECT name FROM roles FOR UPDATE`); err != nil {
+			return errors.Wrap(err, "locking roles")
+		}
+
+		const q = `UPDATE roles SET
+			"permissions" = COALESCE($2, permissions),
+			"require_mfa" = COALESCE($3, require_mfa),
+			"date_updated" = $4
+			WHERE name = $1
+			RETURNING *`
+
+		if err := tx.GetContext(ctx, &r, q, name, perms, update.RequireMFA, now.UTC()); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			return errors.Wrapf(err, "updating role %q", name)
+		}
+
+		var managed bool
+
+		const check = `SELECT EXISTS (SELECT 1 FROM roles WHERE $1 = ANY(permissions))`
+		if err := tx.GetContext(ctx, &managed, check, auth.PermRolesManage); err != nil {
+			return errors.Wrap(err, "checking role managers")
+		}
+		if !managed {
+			return ErrNoRoleManager
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// RequiresMFA tells if any of the roles makes two-factor authentication
+// mandatory.
+func RequiresMFA(ctx context.Context, db *sqlx.DB, roles []string) (bool, error) {
+	var required bool
+
+	const q = `SELECT EXISTS (SELECT 1 FROM roles WHERE name = ANY($1) AND require_mfa)`
+	if err := db.GetContext(ctx, &required, q, pq.Array(roles)); err != nil {
+		return false, errors.Wrap(err, "checking two-factor policy")
+	}
+
+	return required, nil
+}
+
+// dedupe removes repeated permissions keeping the first of each.
+func dedupe(perms []string) []string {
+	seen := make(map[string]bool, len(perms))
+	out := make([]string, 0, len(perms))
+
+	for _, p := range perms {
+		if !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+// Cache holds the permissions of every Role. It implements
+// auth.PermissionResolver. The cache is reloaded from the database once it is
+// older than the refresh interval so changes made through other instances of
+// the service are picked up.
+type Cache struct {
+	db      *sqlx.DB
+	refresh time.Duration
+
+	mu       sync.RWMutex
+	loaded   time.Time
+	perms    map[string][]string
+	loadLock sync.Mutex
+}
+
+// NewCache makes a Cache reloading from db every refresh interval.
+func NewCache(db *sqlx.DB, refresh time.Duration) *Cache {
+	return &Cache{
+		db:      db,
+		refresh: refresh,
+		perms:   make(map[string][]string),
+	}
+}
+
+// Resolve implements the auth.PermissionResolver interface. It gives the
+// permissions granted by any of the roles. Unknown roles grant nothing.
+func (c *Cache) Resolve(ctx context.Context, roles []string) ([]string, error) {
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var perms []string
+	for _, r := range roles {
+		perms = append(perms, c.perms[r]...)
+	}
+
+	return dedupe(perms), nil
+}
+
+// Invalidate makes the next call to Resolve reload the cache. It is used after
+// a Role changes so this instance does not wait for the next reload.
+func (c *Cache) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.loaded = time.Time{}
+}
+
+// load reloads the cache when it is stale.
+func (c *Cache) load(ctx context.Context) error {
+	c.mu.RLock()
+	fresh := time.Since(c.loaded) < c.refresh
+	c.mu.RUnlock()
+
+	if fresh {
+		return nil
+	}
+
+	// Only one request reloads the cache while the others wait for it.
+	c.loadLock.Lock()
+	defer c.loadLock.Unlock()
+
+	c.mu.RLock()
+	fresh = time.Since(c.loaded) < c.refresh
+	c.mu.RUnlock()
+
+	if fresh {
+		return nil
+	}
+
+	roles, err := List(ctx, c.db)
+	if err != nil {
+		return err
+	}
+
+	perms := make(map[string][]string, len(roles))
+	for _, r := range roles {
+		perms[r.Name] = r.Permissions
+	}
+
+	c.mu.Lock()
+	c.perms = perms
+	c.loaded = time.Now()
+	c.mu.Unlock()
+
+	return nil
+}
@@ -1,8 +1,11 @@
 package schema
 
 import (
+	"context"
+
 	"github.com/GuiaBolso/darwin"
 	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
 )
 
 // migrations contains the queries needed to construct the database schema.
@@ -66,6 +69,291 @@ CREATE TABLE users (
 		Script: `
 ALTER TABLE products
 	ADD COLUMN user_id UUID DEFAULT '00000000-0000-0000-0000-000000000000'
+`,
+	},
+	{
+		Version:     5,
+		Description: "Add orders",
+		Script: `
+CREATE TABLE orders (
+	order_id     UUID,
+	user_id      UUID,
+	customer     TEXT,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (order_id)
+);
+
+ALTER TABLE sales
+	ADD COLUMN order_id UUID REFERENCES orders(order_id) ON DELETE CASCADE;
+
+CREATE INDEX sales_order_id_idx ON sales (order_id);
+`,
+	},
+	{
+		Version:     6,
+		Description: "Add refunds",
+		Script: `
+CREATE TABLE refunds (
+	refund_id    UUID,
+	sale_id      UUID,
+	product_id   UUID,
+	quantity     INT,
+	amount       INT,
+	reason       TEXT,
+	user_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (refund_id),
+	FOREIGN KEY (sale_id) REFERENCES sales(sale_id) ON DELETE CASCADE,
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+
+CREATE INDEX refunds_sale_id_idx ON refunds (sale_id);
+CREATE INDEX refunds_product_id_idx ON refunds (product_id);
+`,
+	},
+	{
+		Version:     7,
+		Description: "Add version column to products",
+		Script: `
+ALTER TABLE products
+	ADD COLUMN version INT NOT NULL DEFAULT 1
+`,
+	},
+	{
+		Version:     8,
+		Description: "Archive products instead of deleting their sales",
+		Script: `
+ALTER TABLE products
+	ADD COLUMN deleted_at TIMESTAMP;
+
+ALTER TABLE sales
+	DROP CONSTRAINT sales_product_id_fkey,
+	ADD CONSTRAINT sales_product_id_fkey
+		FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE RESTRICT;
+`,
+	},
+	{
+		Version:     9,
+		Description: "Add categories and tags",
+		Script: `
+CREATE TABLE categories (
+	category_id  UUID,
+	name         TEXT UNIQUE,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (category_id)
+);
+
+ALTER TABLE products
+	ADD COLUMN category_id UUID REFERENCES categories(category_id) ON DELETE SET NULL,
+	ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX products_category_id_idx ON products (category_id);
+CREATE INDEX products_tags_idx ON products USING GIN (tags);
+`,
+	},
+	{
+		Version:     10,
+		Description: "Add product images",
+		Script: `
+CREATE TABLE product_images (
+	image_id      UUID,
+	product_id    UUID,
+	content_type  TEXT,
+	size          INT,
+	width         INT,
+	height        INT,
+	key           TEXT,
+	thumbnail_key TEXT,
+	date_created  TIMESTAMP,
+
+	PRIMARY KEY (image_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+
+CREATE INDEX product_images_product_id_idx ON product_images (product_id);
+`,
+	},
+	{
+		Version:     11,
+		Description: "Add price history and scheduled price changes",
+		Script: `
+CREATE TABLE price_schedules (
+	schedule_id  UUID,
+	product_id   UUID,
+	cost         INT,
+	discount     INT,
+	effective_at TIMESTAMP,
+	applied_at   TIMESTAMP,
+	user_id      UUID,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (schedule_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+
+CREATE INDEX price_schedules_product_id_idx ON price_schedules (product_id);
+CREATE INDEX price_schedules_pending_idx ON price_schedules (effective_at) WHERE applied_at IS NULL;
+
+CREATE TABLE price_history (
+	price_id     UUID,
+	product_id   UUID,
+	old_cost     INT,
+	new_cost     INT,
+	user_id      UUID,
+	schedule_id  UUID REFERENCES price_schedules(schedule_id) ON DELETE SET NULL,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (price_id),
+	FOREIGN KEY (product_id) REFERENCES products(product_id) ON DELETE CASCADE
+);
+
+CREATE INDEX price_history_product_id_idx ON price_history (product_id);
+`,
+	},
+	{
+		Version:     12,
+		Description: "Add password resets",
+		Script: `
+CREATE TABLE password_resets (
+	reset_id     UUID,
+	user_id      UUID,
+	token_hash   TEXT UNIQUE,
+	expires_at   TIMESTAMP,
+	used_at      TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (reset_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
+`,
+	},
+	{
+		Version:     13,
+		Description: "Add sessions and token revocations",
+		Script: `
+CREATE TABLE sessions (
+	session_id   UUID,
+	user_id      UUID,
+	refresh_hash TEXT UNIQUE,
+	expires_at   TIMESTAMP,
+	revoked_at   TIMESTAMP,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (session_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+CREATE TABLE token_revocations (
+	token_id     TEXT,
+	expires_at   TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (token_id)
+);
+
+CREATE INDEX token_revocations_expires_at_idx ON token_revocations (expires_at);
+`,
+	},
+	{
+		Version:     14,
+		Description: "Add login failures",
+		Script: `
+CREATE TABLE login_failures (
+	key          TEXT,
+	failures     INT,
+	last_failure TIMESTAMP,
+	locked_until TIMESTAMP,
+
+	PRIMARY KEY (key)
+);
+`,
+	},
+	{
+		Version:     15,
+		Description: "Add api keys",
+		Script: `
+CREATE TABLE api_keys (
+	key_id       UUID,
+	user_id      UUID,
+	name         TEXT,
+	prefix       TEXT,
+	key_hash     TEXT UNIQUE,
+	roles        TEXT[],
+	expires_at   TIMESTAMP,
+	last_used    TIMESTAMP,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (key_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+`,
+	},
+	{
+		Version:     16,
+		Description: "Add roles",
+		Script: `
+CREATE TABLE roles (
+	name         TEXT,
+	permissions  TEXT[],
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (name)
+);
+
+INSERT INTO roles (name, permissions, date_created, date_updated) VALUES
+	('ADMIN', '{products:write,products:delete,products:manage,sales:record,sales:read,sales:refund,orders:write,orders:read,categories:write,reports:read,users:manage,apikeys:manage,roles:manage}', NOW(), NOW()),
+	('USER', '{products:write}', NOW(), NOW());
+`,
+	},
+	{
+		Version:     17,
+		Description: "Add two-factor authentication",
+		Script: `
+ALTER TABLE roles ADD COLUMN require_mfa BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE mfa_enrollments (
+	user_id      UUID,
+	secret       TEXT,
+	last_step    BIGINT,
+	confirmed_at TIMESTAMP,
+	date_created TIMESTAMP,
+	date_updated TIMESTAMP,
+
+	PRIMARY KEY (user_id),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+CREATE TABLE mfa_recovery_codes (
+	code_hash    TEXT,
+	user_id      UUID,
+	used_at      TIMESTAMP,
+	date_created TIMESTAMP,
+
+	PRIMARY KEY (user_id, code_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
+
+CREATE TABLE mfa_challenges (
+	challenge_hash TEXT,
+	user_id        UUID,
+	attempts       INT,
+	expires_at     TIMESTAMP,
+	date_created   TIMESTAMP,
+
+	PRIMARY KEY (challenge_hash),
+	FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+);
 `,
 	},
 }
@@ -80,3 +368,26 @@ func Migrate(db *sqlx.DB) error {
 
 	return d.Migrate()
 }
+
+// Latest gives the version of the newest migration in this package.
+func Latest() float64 {
+	var latest float64
+	for _, m := range migrations {
+		if m.Version > latest {
+			latest = m.Version
+		}
+	}
+	return latest
+}
+
+// Version gives the version of the newest migration applied to db.
+func Version(ctx context.Context, db *sqlx.DB) (float64, error) {
+	var version float64
+
+	const q = `SELECT COALESCE(MAX(version), 0) FROM darwin_migrations`
+	if err := db.GetContext(ctx, &version, q); err != nil {
+		return 0, errors.Wrap(err, "selecting schema version")
+	}
+
+	return version, nil
+}
@@ -0,0 +1,207 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+)
+
+// LockoutConfig sets how failed logins are throttled. Once Threshold logins
+// in a row have failed for an email or a client IP, further attempts are
+// refused for Delay. Every failure after that doubles the delay up to
+// MaxDelay. Failures older than Window are forgotten. A zero Threshold turns
+// throttling off.
+type LockoutConfig struct {
+	Threshold int
+	Delay     time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+// LockedError is returned when logins are refused because of too many failed
+// attempts. RetryAfter is how long until they are allowed again.
+type LockedError struct {
+	RetryAfter time.Duration
+}
+
+// Error implements the error interface.
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// lockoutKeys gives the keys failures are tracked under for an attempt.
+func lockoutKeys(email, ip string) []string {
+	keys := []string{"email:" + strings.ToLower(email)}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+// attemptKeys gives the keys failures are tracked under for an attempt made as
+// the User with the given id.
+func attemptKeys(ctx context.Context, db *sqlx.DB, userID, ip string) ([]string, error) {
+	var email string
+	if err := db.GetContext(ctx, &email, `SELECT email FROM users WHERE user_id = $1`, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "selecting user email")
+	}
+
+	return lockoutKeys(email, ip), nil
+}
+
+// mfaKeys gives the keys failures are tracked under for a two-factor code
+// given by the User with the given id. Codes are also tracked under a key of
+// their own since giving the right password clears the failures of the email
+// and would otherwise let someone knowing it guess codes without end.
+func mfaKeys(ctx context.Context, db *sqlx.DB, userID, ip string) ([]string, error) {
+	keys, err := attemptKeys(ctx, db, userID, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(keys, "mfa:"+userID), nil
+}
+
+// attempt runs check as an attempt counted under keys following lc. A
+// *LockedError is returned without running check once any key is locked. A
+// failed check stays counted. When it succeeds the failures of the account
+// are cleared. A success from an ip does not excuse the failures it made
+// guessing other accounts so only this attempt is given back for it.
+func attempt(ctx context.Context, db *sqlx.DB, lc LockoutConfig, keys []string, now time.Time, check func() error) error {
+	if lc.Threshold <= 0 {
+		return check()
+	}
+
+	if err := reserveAttempt(ctx, db, lc, keys, now); err != nil {
+		return err
+	}
+
+	if err := check(); err != nil {
+		return err
+	}
+
+	var clear, release []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, "ip:") {
+			release = append(release, key)
+			continue
+		}
+		clear = append(clear, key)
+	}
+
+	if err := clearFailures(ctx, db, clear); err != nil {
+		return err
+	}
+	return releaseAttempt(ctx, db, lc, release)
+}
+
+// reserveAttempt counts a login attempt against every key before the password
+// is checked. The attempt reaching the threshold locks the key right away so
+// concurrent guesses can not all slip past the threshold while the password is
+// being compared. A *LockedError is returned, and nothing is counted, when any
+// of the keys is locked. Attempts that succeed are given back with
+// releaseAttempt.
+func reserveAttempt(ctx context.Context, db *sqlx.DB, lc LockoutConfig, keys []string, now time.Time) error {
+	const q = `INSERT INTO login_failures (key, failures, last_failure)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_failures.last_failure < $3 THEN 1 ELSE login_failures.failures + 1 END,
+			last_failure = EXCLUDED.last_failure
+		WHERE login_failures.locked_until IS NULL OR login_failures.locked_until <= $2
+		RETURNING failures`
+
+	const locked = `SELECT locked_until FROM login_failures WHERE key = $1`
+
+	const lock = `UPDATE login_failures SET locked_until = $2 WHERE key = $1`
+
+	return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		for _, key := range keys {
+			var failures int
+			err := tx.GetContext(ctx, &failures, q, key, now.UTC(), now.Add(-lc.Window).UTC())
+			if err == sql.ErrNoRows {
+				var until time.Time
+				if err := tx.GetContext(ctx, &until, locked, key); err != nil {
+					return errors.Wrap(err, "checking lockout")
+				}
+				return &LockedError{RetryAfter: until.Sub(now.UTC())}
+			}
+			if err != nil {
+				return errors.Wrap(err, "recording login attempt")
+			}
+
+			if failures < lc.Threshold {
+				continue
+			}
+
+			if _, err := tx.ExecContext(ctx, lock, key, now.Add(lockDelay(lc, failures)).UTC()); err != nil {
+				return errors.Wrap(err, "locking logins")
+			}
+		}
+		return nil
+	})
+}
+
+// releaseAttempt gives back an attempt reserved against the keys once it
+// succeeded. The lock it may have taken is lifted when the failures left are
+// below the threshold.
+func releaseAttempt(ctx context.Context, db *sqlx.DB, lc LockoutConfig, keys []string) error {
+	const q = `UPDATE login_failures SET
+			failures = GREATEST(failures - 1, 0),
+			locked_until = CASE WHEN failures - 1 < $2 THEN NULL ELSE locked_until END
+		WHERE key = ANY($1)`
+
+	if _, err := db.ExecContext(ctx, q, pq.Array(keys), lc.Threshold); err != nil {
+		return errors.Wrap(err, "releasing login attempt")
+	}
+	return nil
+}
+
+// lockDelay gives how long logins are refused after the given number of
+// failures in a row.
+func lockDelay(lc LockoutConfig, failures int) time.Duration {
+	d := lc.Delay
+	for i := lc.Threshold; i < failures && d < lc.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > lc.MaxDelay {
+		d = lc.MaxDelay
+	}
+	return d
+}
+
+// clearFailures forgets the failed logins tracked under the keys.
+func clearFailures(ctx context.Context, db *sqlx.DB, keys []string) error {
+	const q = `DELETE FROM login_failures WHERE key = ANY($1)`
+	if _, err := db.ExecContext(ctx, q, pq.Array(keys)); err != nil {
+		return errors.Wrap(err, "clearing login failures")
+	}
+	return nil
+}
+
+// Unlock forgets the failed logins and two-factor codes of an email so its
+// owner can log in again right away. Failures tracked for client IPs are left
+// alone.
+func Unlock(ctx context.Context, db *sqlx.DB, email string) error {
+	keys := lockoutKeys(email, "")
+
+	u, err := RetrieveByEmail(ctx, db, email)
+	switch err {
+	case nil:
+		keys = append(keys, "mfa:"+u.ID)
+	case ErrNotFound:
+	default:
+		return err
+	}
+
+	return clearFailures(ctx, db, keys)
+}
@@ -0,0 +1,436 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/seal"
+	"github.com/wgarcia4190/garagesale/internal/platform/totp"
+)
+
+// ChallengeTTL is how long a User has to give their second factor after
+// giving their password.
+const ChallengeTTL = 5 * time.Minute
+
+// maxChallengeAttempts is how many codes may be tried against a challenge
+// before it stops working.
+const maxChallengeAttempts = 5
+
+// recoveryCodeCount is how many recovery codes a User is given.
+const recoveryCodeCount = 10
+
+var (
+	// ErrMFAEnrolled occurs when enrolling a User who already uses two-factor
+	// authentication.
+	ErrMFAEnrolled = errors.New("two-factor authentication is already enabled")
+
+	// ErrMFANotEnrolled occurs when a User has not started enrolling.
+	ErrMFANotEnrolled = errors.New("two-factor authentication is not enabled")
+
+	// ErrInvalidMFACode occurs when a code is wrong, was already used or has
+	// expired.
+	ErrInvalidMFACode = errors.New("two-factor code is not valid")
+
+	// ErrInvalidChallenge occurs when a login challenge is unknown, has
+	// expired or was tried too many times.
+	ErrInvalidChallenge = errors.New("two-factor challenge is not valid")
+)
+
+// MFAConfig sets how two-factor authentication works. Issuer names the
+// service in authenticator apps. Secrets seals the TOTP secrets so a copy of
+// the database is not enough to compute codes. Wrong codes count toward the
+// lockout of the User following Lockout.
+type MFAConfig struct {
+	Issuer  string
+	Secrets *seal.Box
+	Lockout LockoutConfig
+}
+
+// Enrollment is what a User adds to their authenticator app. The URI is
+// usually shown as a QR code.
+type Enrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// mfaEnrollment is the stored TOTP secret of a User. The secret has to be
+// read back to compute codes so it is sealed rather than hashed. LastStep is
+// the period of the last code used so codes can not be replayed.
+type mfaEnrollment struct {
+	UserID      string     `db:"user_id"`
+	Secret      string     `db:"secret"`
+	LastStep    *int64     `db:"last_step"`
+	ConfirmedAt *time.Time `db:"confirmed_at"`
+	DateCreated time.Time  `db:"date_created"`
+	DateUpdated time.Time  `db:"date_updated"`
+}
+
+// MFAEnabled tells if a User has confirmed their two-factor enrollment.
+func MFAEnabled(ctx context.Context, db *sqlx.DB, userID string) (bool, error) {
+	var enabled bool
+
+	const q = `SELECT EXISTS (SELECT 1 FROM mfa_enrollments WHERE user_id = $1 AND confirmed_at IS NOT NULL)`
+	if err := db.GetContext(ctx, &enabled, q, userID); err != nil {
+		return false, errors.Wrap(err, "checking two-factor enrollment")
+	}
+
+	return enabled, nil
+}
+
+// Enroll starts two-factor authentication for a User by generating a new
+// secret. It only takes effect once confirmed with a code from the secret.
+// Enrolling again before confirming replaces the secret.
+func Enroll(ctx context.Context, db *sqlx.DB, mc MFAConfig, userID string, now time.Time) (*Enrollment, error) {
+	var email string
+	if err := db.GetContext(ctx, &email, `SELECT email FROM users WHERE user_id = $1`, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "selecting user")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := mc.Secrets.Seal(secret, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "sealing two-factor secret")
+	}
+
+	const q = `INSERT INTO mfa_enrollments
+		(user_id, secret, date_created, date_updated)
+		VALUES ($1, $2, $3, $3)
+		ON CONFLICT (user_id) DO UPDATE SET
+			secret = EXCLUDED.secret,
+			last_step = NULL,
+			date_updated = EXCLUDED.date_updated
+		WHERE mfa_enrollments.confirmed_at IS NULL`
+
+	res, err := db.ExecContext(ctx, q, userID, sealed, now.UTC())
+	if err != nil {
+		return nil, errors.Wrap(err, "storing two-factor secret")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, errors.Wrap(err, "checking two-factor secret")
+	}
+	if n == 0 {
+		return nil, ErrMFAEnrolled
+	}
+
+	e := Enrollment{
+		Secret: secret,
+		URI:    totp.URI(mc.Issuer, email, secret),
+	}
+
+	return &e, nil
+}
+
+// ConfirmMFA turns on two-factor authentication for a User once they prove
+// their app has the secret. It gives back the recovery codes of the User
+// which are only shown this once. Wrong codes count toward the lockout of the
+// User.
+func ConfirmMFA(ctx context.Context, db *sqlx.DB, mc MFAConfig, userID, code, ip string, now time.Time) ([]string, error) {
+	keys, err := mfaKeys(ctx, db, userID, ip)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+
+	err = attempt(ctx, db, mc.Lockout, keys, now, func() error {
+		return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+			e, err := enrollment(ctx, tx, mc.Secrets, userID)
+			if err != nil {
+				return err
+			}
+			if e.ConfirmedAt != nil {
+				return ErrMFAEnrolled
+			}
+
+			if err := useTOTP(ctx, tx, e, code, now); err != nil {
+				return err
+			}
+
+			const q = `UPDATE mfa_enrollments SET confirmed_at = $2, date_updated = $2 WHERE user_id = $1`
+			if _, err := tx.ExecContext(ctx, q, userID, now.UTC()); err != nil {
+				return errors.Wrap(err, "confirming two-factor enrollment")
+			}
+
+			codes, err = newRecoveryCodes(ctx, tx, userID, now)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableMFA turns off two-factor authentication for a User. A current code
+// or a recovery code must be given. Wrong codes count toward the lockout of
+// the User.
+func DisableMFA(ctx context.Context, db *sqlx.DB, mc MFAConfig, userID, code, ip string, now time.Time) error {
+	keys, err := mfaKeys(ctx, db, userID, ip)
+	if err != nil {
+		return err
+	}
+
+	return attempt(ctx, db, mc.Lockout, keys, now, func() error {
+		return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+			e, err := enrollment(ctx, tx, mc.Secrets, userID)
+			if err != nil {
+				return err
+			}
+			if e.ConfirmedAt == nil {
+				return ErrMFANotEnrolled
+			}
+
+			if err := verifyCode(ctx, tx, e, code, now); err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+				return errors.Wrap(err, "deleting recovery codes")
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_enrollments WHERE user_id = $1`, userID); err != nil {
+				return errors.Wrap(err, "deleting two-factor enrollment")
+			}
+
+			return nil
+		})
+	})
+}
+
+// StartChallenge records that a User gave the right password and must now
+// give their second factor. It gives back the challenge the client completes
+// the login with and when it expires.
+func StartChallenge(ctx context.Context, db *sqlx.DB, userID string, now time.Time) (string, time.Time, error) {
+	challenge, err := newRefreshToken()
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "generating challenge")
+	}
+
+	expires := now.Add(ChallengeTTL).UTC()
+
+	const q = `INSERT INTO mfa_challenges
+		(challenge_hash, user_id, attempts, expires_at, date_created)
+		VALUES ($1, $2, 0, $3, $4)`
+
+	if _, err := db.ExecContext(ctx, q, hashToken(challenge), userID, expires, now.UTC()); err != nil {
+		return "", time.Time{}, errors.Wrap(err, "inserting challenge")
+	}
+
+	return challenge, expires, nil
+}
+
+// ChallengeUser gives the id of the User a challenge was started for.
+func ChallengeUser(ctx context.Context, db *sqlx.DB, challenge string, now time.Time) (string, error) {
+	var userID string
+
+	const q = `SELECT user_id FROM mfa_challenges
+		WHERE challenge_hash = $1 AND expires_at > $2 AND attempts < $3`
+
+	if err := db.GetContext(ctx, &userID, q, hashToken(challenge), now.UTC(), maxChallengeAttempts); err != nil {
+		if err == sql.ErrNoRows {
+			return "", ErrInvalidChallenge
+		}
+		return "", errors.Wrap(err, "selecting challenge")
+	}
+
+	return userID, nil
+}
+
+// CompleteChallenge finishes a login with the second factor of the User. A
+// User who has not confirmed their enrollment yet, because their role makes
+// two-factor authentication mandatory, confirms it here and is given their
+// recovery codes. Wrong codes count toward the lockout of the User as well as
+// against the challenge. It gives back the User so a session can be started
+// for them with StartSession.
+func CompleteChallenge(ctx context.Context, db *sqlx.DB, mc MFAConfig, challenge, code, ip string, now time.Time) (*User, []string, error) {
+	// The attempt is counted before the code is checked, outside of the
+	// transaction, so failures can not be rolled back.
+	var userID string
+
+	const q = `UPDATE mfa_challenges SET attempts = attempts + 1
+		WHERE challenge_hash = $1 AND expires_at > $2 AND attempts < $3
+		RETURNING user_id`
+
+	if err := db.GetContext(ctx, &userID, q, hashToken(challenge), now.UTC(), maxChallengeAttempts); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, ErrInvalidChallenge
+		}
+		return nil, nil, errors.Wrap(err, "counting challenge attempt")
+	}
+
+	keys, err := mfaKeys(ctx, db, userID, ip)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, nil, ErrInvalidChallenge
+		}
+		return nil, nil, err
+	}
+
+	var (
+		u     User
+		codes []string
+	)
+
+	err = attempt(ctx, db, mc.Lockout, keys, now, func() error {
+		return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+			e, err := enrollment(ctx, tx, mc.Secrets, userID)
+			if err != nil {
+				return err
+			}
+
+			if e.ConfirmedAt != nil {
+				if err := verifyCode(ctx, tx, e, code, now); err != nil {
+					return err
+				}
+			} else {
+				if err := useTOTP(ctx, tx, e, code, now); err != nil {
+					return err
+				}
+
+				const q = `UPDATE mfa_enrollments SET confirmed_at = $2, date_updated = $2 WHERE user_id = $1`
+				if _, err := tx.ExecContext(ctx, q, userID, now.UTC()); err != nil {
+					return errors.Wrap(err, "confirming two-factor enrollment")
+				}
+
+				if codes, err = newRecoveryCodes(ctx, tx, userID, now); err != nil {
+					return err
+				}
+			}
+
+			if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_challenges WHERE challenge_hash = $1`, hashToken(challenge)); err != nil {
+				return errors.Wrap(err, "deleting challenge")
+			}
+
+			if err := tx.GetContext(ctx, &u, `SELECT * FROM users WHERE user_id = $1`, userID); err != nil {
+				if err == sql.ErrNoRows {
+					return ErrInvalidChallenge
+				}
+				return errors.Wrap(err, "selecting challenge user")
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &u, codes, nil
+}
+
+// enrollment reads the two-factor enrollment of a User locking it until the
+// transaction ends. Its secret is given opened.
+func enrollment(ctx context.Context, tx *sqlx.Tx, secrets *seal.Box, userID string) (*mfaEnrollment, error) {
+	var e mfaEnrollment
+
+	const q = `SELECT * FROM mfa_enrollments WHERE user_id = $1 FOR UPDATE`
+	if err := tx.GetContext(ctx, &e, q, userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrMFANotEnrolled
+		}
+		return nil, errors.Wrap(err, "selecting two-factor enrollment")
+	}
+
+	secret, err := secrets.Open(e.Secret, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening two-factor secret")
+	}
+	e.Secret = secret
+
+	return &e, nil
+}
+
+// verifyCode accepts either a current TOTP code or an unused recovery code.
+func verifyCode(ctx context.Context, tx *sqlx.Tx, e *mfaEnrollment, code string, now time.Time) error {
+	if len(strings.TrimSpace(code)) == totp.Digits {
+		return useTOTP(ctx, tx, e, code, now)
+	}
+
+	const q = `UPDATE mfa_recovery_codes SET used_at = $3
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+
+	res, err := tx.ExecContext(ctx, q, e.UserID, hashToken(normalizeRecoveryCode(code)), now.UTC())
+	if err != nil {
+		return errors.Wrap(err, "using recovery code")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "checking recovery code")
+	}
+	if n == 0 {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// useTOTP checks a TOTP code and records its period so it can not be used a
+// second time.
+func useTOTP(ctx context.Context, tx *sqlx.Tx, e *mfaEnrollment, code string, now time.Time) error {
+	step, ok := totp.Validate(e.Secret, code, now)
+	if !ok {
+		return ErrInvalidMFACode
+	}
+	if e.LastStep != nil && step <= *e.LastStep {
+		return ErrInvalidMFACode
+	}
+
+	const q = `UPDATE mfa_enrollments SET last_step = $2 WHERE user_id = $1`
+	if _, err := tx.ExecContext(ctx, q, e.UserID, step); err != nil {
+		return errors.Wrap(err, "recording two-factor code")
+	}
+	e.LastStep = &step
+
+	return nil
+}
+
+// newRecoveryCodes replaces the recovery codes of a User. Only their hashes
+// are stored.
+func newRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID string, now time.Time) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, errors.Wrap(err, "deleting recovery codes")
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		data := make([]byte, 5)
+		if _, err := rand.Read(data); err != nil {
+			return nil, errors.Wrap(err, "generating recovery code")
+		}
+		code := strings.ToLower(encoding.EncodeToString(data))
+		codes[i] = code[:4] + "-" + code[4:]
+
+		const q = `INSERT INTO mfa_recovery_codes (code_hash, user_id, date_created) VALUES ($1, $2, $3)`
+		if _, err := tx.ExecContext(ctx, q, hashToken(normalizeRecoveryCode(code)), userID, now.UTC()); err != nil {
+			return nil, errors.Wrap(err, "inserting recovery code")
+		}
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode lets recovery codes be typed in any case and with or
+// without the dash.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
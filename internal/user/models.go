@@ -20,8 +20,71 @@ type User struct {
 // NewUser contains information needed to create a new User.
 type NewUser struct {
 	Name            string   `json:"name" validate:"required"`
-	Email           string   `json:"email" validate:"required"`
-	Roles           []string `json:"roles" validate:"required"`
+	Email           string   `json:"email" validate:"required,email"`
+	Roles           []string `json:"roles" validate:"required,dive,oneof=ADMIN USER"`
 	Password        string   `json:"password" validate:"required"`
 	PasswordConfirm string   `json:"password_confirm" validate:"eqfield=Password"`
 }
+
+// UpdateUser defines what information may be provided to modify an existing
+// User. All fields are optional so clients can send just the fields they want
+// changed. It uses pointer fields so we can differentiate between a field that
+// was not provided and a field that was provided as explicitly blank. A nil
+// Roles leaves the roles untouched.
+type UpdateUser struct {
+	Name  *string  `json:"name"`
+	Email *string  `json:"email" validate:"omitempty,email"`
+	Roles []string `json:"roles" validate:"omitempty,dive,oneof=ADMIN USER"`
+}
+
+// PasswordChange is what a User provides to replace their password.
+type PasswordChange struct {
+	Current         string `json:"current" validate:"required"`
+	Password        string `json:"password" validate:"required,min=8"`
+	PasswordConfirm string `json:"password_confirm" validate:"eqfield=Password"`
+}
+
+// ResetRequest is what a User provides to be sent a password reset token.
+type ResetRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// PasswordReset is what a User provides to redeem a password reset token.
+type PasswordReset struct {
+	Token           string `json:"token" validate:"required"`
+	Password        string `json:"password" validate:"required,min=8"`
+	PasswordConfirm string `json:"password_confirm" validate:"eqfield=Password"`
+}
+
+// MFACode is what a User provides to turn off two-factor authentication.
+// Code is either a code from their app or a recovery code.
+type MFACode struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// MFASetup is what a User provides to enroll in two-factor authentication.
+// The current password is asked for again so a stolen token is not enough to
+// take over the second factor.
+type MFASetup struct {
+	Password string `json:"password" validate:"required"`
+}
+
+// MFAConfirm is what a User provides to turn on two-factor authentication.
+// Code is from the app they added their new secret to.
+type MFAConfirm struct {
+	Password string `json:"password" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// MFALogin is what a User provides to complete a login with their second
+// factor.
+type MFALogin struct {
+	Challenge string `json:"challenge" validate:"required"`
+	Code      string `json:"code" validate:"required"`
+}
+
+// MFAEnroll is what a User provides to enroll in two-factor authentication
+// while logging in when their role makes it mandatory.
+type MFAEnroll struct {
+	Challenge string `json:"challenge" validate:"required"`
+}
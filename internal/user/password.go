@@ -0,0 +1,160 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ResetTTL is how long a password reset token can be redeemed for.
+const ResetTTL = time.Hour
+
+// ErrInvalidResetToken occurs when a password reset token is unknown, was
+// already used or has expired.
+var ErrInvalidResetToken = errors.New("reset token is not valid")
+
+// ChangePassword replaces the password of a User after checking their
+// current one. The check counts toward the lockout of the User like a login
+// so a stolen token can not be used to guess the password. Outstanding reset tokens of the User are invalidated and every
+// session of the User is ended, including the one making the change. The
+// revocations are given back so they can be honoured right away.
+func ChangePassword(ctx context.Context, db *sqlx.DB, lc LockoutConfig, claims auth.Claims, id string, cp PasswordChange, ip string, now time.Time) ([]Revocation, error) {
+	u, err := Retrieve(ctx, db, claims, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := CheckPassword(ctx, db, lc, u.ID, cp.Current, ip, now); err != nil {
+		return nil, err
+	}
+
+	var revoked []Revocation
+	err = database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		var err error
+		revoked, err = setPassword(ctx, tx, u.ID, cp.Password, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revoked, nil
+}
+
+// RequestReset sends a single use token to the User with the given email so
+// they can set a new password. Only a hash of the token is stored. Nothing is
+// sent when no User has the email, and no error is returned either, so the
+// caller can not learn which emails are in the system.
+func RequestReset(ctx context.Context, db *sqlx.DB, n notify.Notifier, email string, now time.Time) error {
+	u, err := RetrieveByEmail(ctx, db, email)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil
+		}
+		return err
+	}
+
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return errors.Wrap(err, "generating reset token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(data)
+
+	expires := now.Add(ResetTTL).UTC()
+
+	const q = `INSERT INTO password_resets
+		(reset_id, user_id, token_hash, expires_at, date_created)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	if _, err := db.ExecContext(ctx, q, uuid.New().String(), u.ID, hashToken(token), expires, now.UTC()); err != nil {
+		return errors.Wrap(err, "inserting password reset")
+	}
+
+	m := notify.Message{
+		To:      u.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use this token to set a new password before %s:\n\n%s\n\nIf you did not ask to reset your password you can ignore this message.",
+			expires.Format(time.RFC1123), token),
+		Secrets: []string{token},
+	}
+
+	if err := n.Send(ctx, m); err != nil {
+		return errors.Wrap(err, "sending reset token")
+	}
+
+	return nil
+}
+
+// ResetPassword redeems a reset token to set a new password for the User it
+// was sent to. Every outstanding token of the User is invalidated and every
+// session of the User is ended. The revocations are given back so they can be
+// honoured right away.
+func ResetPassword(ctx context.Context, db *sqlx.DB, rp PasswordReset, now time.Time) ([]Revocation, error) {
+	var revoked []Revocation
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		var userID string
+
+		const q = `SELECT user_id FROM password_resets
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+			FOR UPDATE`
+
+		if err := tx.GetContext(ctx, &userID, q, hashToken(rp.Token), now.UTC()); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidResetToken
+			}
+			return errors.Wrap(err, "selecting password reset")
+		}
+
+		var err error
+		revoked, err = setPassword(ctx, tx, userID, rp.Password, now)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return revoked, nil
+}
+
+// setPassword stores the hash of a new password for a User, marks their
+// outstanding reset tokens as used and ends their sessions so tokens obtained
+// with the old password stop working.
+func setPassword(ctx context.Context, tx *sqlx.Tx, id, password string, now time.Time) ([]Revocation, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, errors.Wrap(err, "generating password hash")
+	}
+
+	const q = `UPDATE users SET password_hash = $2, date_updated = $3 WHERE user_id = $1`
+	if _, err := tx.ExecContext(ctx, q, id, hash, now.UTC()); err != nil {
+		return nil, errors.Wrap(err, "updating password")
+	}
+
+	const used = `UPDATE password_resets SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`
+	if _, err := tx.ExecContext(ctx, used, id, now.UTC()); err != nil {
+		return nil, errors.Wrap(err, "invalidating password resets")
+	}
+
+	return endSessions(ctx, tx, id, now)
+}
+
+// hashToken gives the form a reset token is stored in. Tokens are random
+// enough that a fast hash is safe to use.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,313 @@
+package user
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
+)
+
+// ErrInvalidRefreshToken occurs when a refresh token is unknown, was already
+// rotated, or belongs to a session that expired or was ended.
+var ErrInvalidRefreshToken = errors.New("refresh token is not valid")
+
+// SessionConfig sets how long the tokens of a session last. Access tokens are
+// short lived JWTs. Refresh tokens are opaque and renew the session every
+// time they are used.
+type SessionConfig struct {
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+}
+
+// Session is a login of a User that can be renewed with a refresh token.
+// Only a hash of the refresh token is stored.
+type Session struct {
+	ID          string     `db:"session_id" json:"id"`
+	UserID      string     `db:"user_id" json:"user_id"`
+	RefreshHash string     `db:"refresh_hash" json:"-"`
+	ExpiresAt   time.Time  `db:"expires_at" json:"expires_at"`
+	RevokedAt   *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+	DateCreated time.Time  `db:"date_created" json:"date_created"`
+	DateUpdated time.Time  `db:"date_updated" json:"date_updated"`
+}
+
+// StartSession begins a login session for an authenticated User. It gives
+// back the claims for the first access token of the session and the refresh
+// token used to renew it.
+func StartSession(ctx context.Context, db *sqlx.DB, u *User, cfg SessionConfig, now time.Time) (auth.Claims, string, error) {
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+
+	s := Session{
+		ID:          uuid.New().String(),
+		UserID:      u.ID,
+		RefreshHash: hashToken(refresh),
+		ExpiresAt:   now.Add(cfg.RefreshTTL).UTC(),
+		DateCreated: now.UTC(),
+		DateUpdated: now.UTC(),
+	}
+
+	const q = `INSERT INTO sessions
+		(session_id, user_id, refresh_hash, expires_at, date_created, date_updated)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+
+	if _, err := db.ExecContext(ctx, q, s.ID, s.UserID, s.RefreshHash, s.ExpiresAt, s.DateCreated, s.DateUpdated); err != nil {
+		return auth.Claims{}, "", errors.Wrap(err, "inserting session")
+	}
+
+	claims := auth.NewClaims(u.ID, u.Roles, now, cfg.AccessTTL)
+	claims.Session = s.ID
+
+	return claims, refresh, nil
+}
+
+// RefreshSession renews the session of a refresh token. The token is rotated
+// so it can only be used once. The claims of the new access token are built
+// from the current roles of the User.
+func RefreshSession(ctx context.Context, db *sqlx.DB, refresh string, cfg SessionConfig, now time.Time) (auth.Claims, string, error) {
+	next, err := newRefreshToken()
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+
+	var claims auth.Claims
+
+	err = database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		var s Session
+
+		const q = `SELECT * FROM sessions
+			WHERE refresh_hash = $1 AND revoked_at IS NULL AND expires_at > $2
+			FOR UPDATE`
+
+		if err := tx.GetContext(ctx, &s, q, hashToken(refresh), now.UTC()); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidRefreshToken
+			}
+			return errors.Wrap(err, "selecting session")
+		}
+
+		var u User
+		if err := tx.GetContext(ctx, &u, `SELECT * FROM users WHERE user_id = $1`, s.UserID); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrInvalidRefreshToken
+			}
+			return errors.Wrap(err, "selecting session user")
+		}
+
+		const rotate = `UPDATE sessions SET
+			refresh_hash = $2,
+			expires_at = $3,
+			date_updated = $4
+			WHERE session_id = $1`
+
+		if _, err := tx.ExecContext(ctx, rotate, s.ID, hashToken(next), now.Add(cfg.RefreshTTL).UTC(), now.UTC()); err != nil {
+			return errors.Wrap(err, "rotating refresh token")
+		}
+
+		claims = auth.NewClaims(u.ID, u.Roles, now, cfg.AccessTTL)
+		claims.Session = s.ID
+
+		return nil
+	})
+	if err != nil {
+		return auth.Claims{}, "", err
+	}
+
+	return claims, next, nil
+}
+
+// EndSession ends the session the claims were issued for so its refresh
+// token stops working. The session id is added to the revoked tokens so the
+// access tokens issued for it are rejected as well. Tokens issued outside of
+// a session have their own id revoked. It gives back the time the revocation
+// can be forgotten since the revoked tokens will have expired by then.
+func EndSession(ctx context.Context, db *sqlx.DB, claims auth.Claims, now time.Time) (string, time.Time, error) {
+	id := claims.Session
+	until := time.Unix(claims.ExpiresAt, 0).UTC()
+
+	err := database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		if claims.Session == "" {
+			id = claims.Id
+			return revoke(ctx, tx, id, until, now)
+		}
+
+		// Access tokens never outlive the session they were issued for.
+		const q = `UPDATE sessions SET revoked_at = $3, date_updated = $3
+			WHERE session_id = $1 AND user_id = $2
+			RETURNING expires_at`
+
+		if err := tx.GetContext(ctx, &until, q, claims.Session, claims.Subject, now.UTC()); err != nil {
+			if err != sql.ErrNoRows {
+				return errors.Wrap(err, "revoking session")
+			}
+		}
+
+		return revoke(ctx, tx, id, until, now)
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return id, until, nil
+}
+
+// Revocation is the id of a token or session that is revoked until Until.
+type Revocation struct {
+	ID    string    `db:"session_id"`
+	Until time.Time `db:"expires_at"`
+}
+
+// endSessions ends every live session of a User and revokes the access tokens
+// issued for them.
+func endSessions(ctx context.Context, tx *sqlx.Tx, userID string, now time.Time) ([]Revocation, error) {
+	const q = `UPDATE sessions SET revoked_at = $2, date_updated = $2
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		RETURNING session_id, expires_at`
+
+	var revoked []Revocation
+	if err := tx.SelectContext(ctx, &revoked, q, userID, now.UTC()); err != nil {
+		return nil, errors.Wrap(err, "revoking sessions")
+	}
+
+	for _, r := range revoked {
+		if err := revoke(ctx, tx, r.ID, r.Until, now); err != nil {
+			return nil, err
+		}
+	}
+
+	return revoked, nil
+}
+
+// revoke records the id of a token or session as revoked until the time the
+// tokens it covers expire.
+func revoke(ctx context.Context, tx *sqlx.Tx, id string, until, now time.Time) error {
+	if id == "" {
+		return nil
+	}
+
+	const q = `INSERT INTO token_revocations (token_id, expires_at, date_created)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (token_id) DO UPDATE SET expires_at = GREATEST(token_revocations.expires_at, EXCLUDED.expires_at)`
+
+	if _, err := tx.ExecContext(ctx, q, id, until.UTC(), now.UTC()); err != nil {
+		return errors.Wrap(err, "inserting token revocation")
+	}
+
+	return nil
+}
+
+// newRefreshToken generates a random opaque refresh token.
+func newRefreshToken() (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", errors.Wrap(err, "generating refresh token")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DenyList is a cache of the revoked tokens and sessions that have not yet
+// expired. It implements auth.Revocations. The cache is reloaded from the
+// database once it is older than the refresh interval so revocations made by
+// other instances of the service are picked up.
+type DenyList struct {
+	db      *sqlx.DB
+	refresh time.Duration
+
+	mu       sync.RWMutex
+	loaded   time.Time
+	revoked  map[string]time.Time
+	loadLock sync.Mutex
+}
+
+// NewDenyList makes a DenyList reloading from db every refresh interval.
+func NewDenyList(db *sqlx.DB, refresh time.Duration) *DenyList {
+	return &DenyList{
+		db:      db,
+		refresh: refresh,
+		revoked: make(map[string]time.Time),
+	}
+}
+
+// Revoked implements the auth.Revocations interface. Claims are revoked when
+// either their token id or their session id was revoked.
+func (d *DenyList) Revoked(ctx context.Context, claims auth.Claims) (bool, error) {
+	if err := d.load(ctx); err != nil {
+		return false, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	now := time.Now()
+	for _, id := range []string{claims.Id, claims.Session} {
+		if until, ok := d.revoked[id]; ok && id != "" && now.Before(until) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Add records a revocation in the cache right away so this instance does not
+// wait for the next reload to honour it.
+func (d *DenyList) Add(id string, until time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.revoked[id] = until
+}
+
+// load reloads the cache when it is stale.
+func (d *DenyList) load(ctx context.Context) error {
+	d.mu.RLock()
+	fresh := time.Since(d.loaded) < d.refresh
+	d.mu.RUnlock()
+
+	if fresh {
+		return nil
+	}
+
+	// Only one request reloads the cache while the others wait for it.
+	d.loadLock.Lock()
+	defer d.loadLock.Unlock()
+
+	d.mu.RLock()
+	fresh = time.Since(d.loaded) < d.refresh
+	d.mu.RUnlock()
+
+	if fresh {
+		return nil
+	}
+
+	var rows []struct {
+		ID        string    `db:"token_id"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+
+	const q = `SELECT token_id, expires_at FROM token_revocations WHERE expires_at > $1`
+	if err := d.db.SelectContext(ctx, &rows, q, time.Now().UTC()); err != nil {
+		return errors.Wrap(err, "selecting token revocations")
+	}
+
+	revoked := make(map[string]time.Time, len(rows))
+	for _, r := range rows {
+		revoked[r.ID] = r.ExpiresAt
+	}
+
+	d.mu.Lock()
+	d.revoked = revoked
+	d.loaded = time.Now()
+	d.mu.Unlock()
+
+	return nil
+}
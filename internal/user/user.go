@@ -5,9 +5,11 @@ import (
 	"database/sql"
 	"github.com/google/uuid"
 	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database"
 	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -16,8 +18,63 @@ var (
 	// ErrAuthenticationFailure occurs when a user attempts to authenticate but
 	// anything goes wrong
 	ErrAuthenticationFailure = errors.New("Authentication failed")
+
+	// ErrNotFound is used when a specific User is requested but does not exist.
+	ErrNotFound = errors.New("User not found")
+
+	// ErrInvalidID occurs when an ID is not in a valid form.
+	ErrInvalidID = errors.New("ID is not in its proper form")
+
+	// ErrForbidden occurs when a user tries to do something that is forbidden to
+	// them according to our access control policies.
+	ErrForbidden = errors.New("Attempted action is not allowed")
+
+	// ErrDuplicateEmail occurs when a User is given an email another User has.
+	ErrDuplicateEmail = errors.New("email is already in use")
+
+	// ErrDeleteSelf occurs when a User tries to delete themselves.
+	ErrDeleteSelf = errors.New("users can not delete themselves")
+
+	// ErrLastAdmin occurs when deleting or demoting the only User left with
+	// the admin role, which would leave nobody to manage the users.
+	ErrLastAdmin = errors.New("the last admin can not be deleted")
 )
 
+// List retrieves a list of existing users from the database.
+func List(ctx context.Context, db *sqlx.DB) ([]User, error) {
+	users := make([]User, 0)
+
+	const q = `SELECT * FROM users ORDER BY email`
+	if err := db.SelectContext(ctx, &users, q); err != nil {
+		return nil, errors.Wrap(err, "selecting users")
+	}
+
+	return users, nil
+}
+
+// Retrieve gets the specified user from the database. Users without the
+// permission to manage users may only retrieve themselves.
+func Retrieve(ctx context.Context, db *sqlx.DB, claims auth.Claims, id string) (*User, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrInvalidID
+	}
+
+	if !claims.HasPermission(auth.PermUsersManage) && claims.Subject != id {
+		return nil, ErrForbidden
+	}
+
+	var u User
+	const q = `SELECT * FROM users WHERE user_id = $1`
+	if err := db.GetContext(ctx, &u, q, id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrapf(err, "selecting user %q", id)
+	}
+
+	return &u, nil
+}
+
 // Create inserts a new user into the database.
 func Create(ctx context.Context, db *sqlx.DB, user NewUser, now time.Time) (*User, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
@@ -46,16 +103,178 @@ func Create(ctx context.Context, db *sqlx.DB, user NewUser, now time.Time) (*Use
 		u.DataCreated, u.DataUpdated)
 
 	if err != nil {
+		if isUniqueViolation(err) {
+			return nil, ErrDuplicateEmail
+		}
 		return nil, errors.Wrap(err, "inserting user")
 	}
 
 	return &u, nil
 }
 
+// Update replaces a user document in the database. Users without the
+// permission to manage users may only update themselves and can not change
+// their roles. The last admin
+// can not lose the admin role.
+func Update(ctx context.Context, db *sqlx.DB, claims auth.Claims, id string, upd UpdateUser, now time.Time) error {
+	u, err := Retrieve(ctx, db, claims, id)
+	if err != nil {
+		return err
+	}
+
+	if upd.Name != nil {
+		u.Name = *upd.Name
+	}
+	if upd.Email != nil {
+		u.Email = *upd.Email
+	}
+	var demoted bool
+	if upd.Roles != nil {
+		if !claims.HasPermission(auth.PermUsersManage) {
+			return ErrForbidden
+		}
+		held, given := auth.Claims{Roles: u.Roles}, auth.Claims{Roles: upd.Roles}
+		demoted = held.HasRole(auth.RoleAdmin) && !given.HasRole(auth.RoleAdmin)
+		u.Roles = upd.Roles
+	}
+	u.DataUpdated = now.UTC()
+
+	return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		if demoted {
+			if err := keepAdmin(ctx, tx, id); err != nil {
+				return err
+			}
+		}
+
+		const q = `UPDATE users SET
+			name = $2,
+			email = $3,
+			roles = $4,
+			date_updated = $5
+			WHERE user_id = $1`
+
+		if _, err := tx.ExecContext(ctx, q, id, u.Name, u.Email, u.Roles, u.DataUpdated); err != nil {
+			if isUniqueViolation(err) {
+				return ErrDuplicateEmail
+			}
+			return errors.Wrap(err, "updating user")
+		}
+
+		return nil
+	})
+}
+
+// Delete removes a user from the database. Users can not delete themselves
+// and the last admin can not be deleted.
+func Delete(ctx context.Context, db *sqlx.DB, claims auth.Claims, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrInvalidID
+	}
+
+	if claims.Subject == id {
+		return ErrDeleteSelf
+	}
+
+	return database.WithTx(ctx, db, func(tx *sqlx.Tx) error {
+		if err := keepAdmin(ctx, tx, id); err != nil {
+			return err
+		}
+
+		const q = `DELETE FROM users WHERE user_id = $1`
+
+		res, err := tx.ExecContext(ctx, q, id)
+		if err != nil {
+			return errors.Wrapf(err, "deleting user %s", id)
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "counting deleted users")
+		}
+		if n == 0 {
+			return ErrNotFound
+		}
+
+		return nil
+	})
+}
+
+// keepAdmin returns ErrLastAdmin when the User with the id is the only admin.
+// The admins are locked so concurrent changes can not remove all of them.
+func keepAdmin(ctx context.Context, tx *sqlx.Tx, id string) error {
+	var admins []string
+
+	const q = `SELECT user_id FROM users WHERE $1 = ANY(roles) FOR UPDATE`
+	if err := tx.SelectContext(ctx, &admins, q, auth.RoleAdmin); err != nil {
+		return errors.Wrap(err, "locking admins")
+	}
+	if len(admins) == 1 && admins[0] == id {
+		return ErrLastAdmin
+	}
+
+	return nil
+}
+
+// RetrieveByEmail finds the User with the given email.
+func RetrieveByEmail(ctx context.Context, db *sqlx.DB, email string) (*User, error) {
+	const q = `SELECT * FROM users WHERE email = $1`
+
+	var u User
+	if err := db.GetContext(ctx, &u, q, email); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNotFound
+		}
+		return nil, errors.Wrap(err, "selecting user by email")
+	}
+
+	return &u, nil
+}
+
 // Authenticate finds a user by their email and verifies their password. On
-// success it returns a Claims value representing this user. The claims can be
-// used to generate a token for future authentication.
-func Authenticate(ctx context.Context, db *sqlx.DB, now time.Time, email, password string) (auth.Claims, error) {
+// success it returns the User so a session can be started for them with
+// StartSession, which issues their token.
+//
+// Attempts are counted per email and per client ip following lc before the
+// password is checked. Once either is locked a *LockedError is returned
+// without checking the password.
+func Authenticate(ctx context.Context, db *sqlx.DB, lc LockoutConfig, now time.Time, email, password, ip string) (*User, error) {
+	var u *User
+	err := attempt(ctx, db, lc, lockoutKeys(email, ip), now, func() error {
+		var err error
+		u, err = verifyPassword(ctx, db, email, password)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// CheckPassword verifies the password of the User with the given id, such as
+// before a change to how they log in. Attempts are counted like logins so
+// the check can not be used to guess passwords with a stolen token.
+func CheckPassword(ctx context.Context, db *sqlx.DB, lc LockoutConfig, userID, password, ip string, now time.Time) error {
+	keys, err := attemptKeys(ctx, db, userID, ip)
+	if err != nil {
+		return err
+	}
+
+	return attempt(ctx, db, lc, keys, now, func() error {
+		var hash []byte
+		if err := db.GetContext(ctx, &hash, `SELECT password_hash FROM users WHERE user_id = $1`, userID); err != nil {
+			return errors.Wrap(err, "selecting password hash")
+		}
+
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+			return ErrAuthenticationFailure
+		}
+		return nil
+	})
+}
+
+// verifyPassword finds a user by their email and checks their password.
+func verifyPassword(ctx context.Context, db *sqlx.DB, email, password string) (*User, error) {
 	const q = `SELECT * FROM users WHERE email = $1`
 
 	var u User
@@ -63,20 +282,24 @@ func Authenticate(ctx context.Context, db *sqlx.DB, now time.Time, email, passwo
 		// Normally we would return ErrNotFound in this scenario but we do not want
 		// to leak to an unauthenticated user which emails are in the system.
 		if err == sql.ErrNoRows {
-			return auth.Claims{}, ErrAuthenticationFailure
+			return nil, ErrAuthenticationFailure
 		}
 
-		return auth.Claims{}, errors.Wrap(err, "selecting single user")
+		return nil, errors.Wrap(err, "selecting single user")
 	}
 
 	// Compare the provided password with the saved hash. Use the bcrypt
 	// comparison function so it is cryptographically secure.
 	if err := bcrypt.CompareHashAndPassword(u.PasswordHash, []byte(password)); err != nil {
-		return auth.Claims{}, ErrAuthenticationFailure
+		return nil, ErrAuthenticationFailure
 	}
 
-	// If we are this far the request is valid. Create some claims fro the user
-	// and generate their token.
-	claims := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
-	return claims, nil
+	return &u, nil
+}
+
+// isUniqueViolation reports whether err was caused by a unique constraint,
+// which for users means the email is already taken.
+func isUniqueViolation(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	return ok && pqErr.Code == "23505"
 }
@@ -0,0 +1,460 @@
+package user_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wgarcia4190/garagesale/internal/platform/auth"
+	"github.com/wgarcia4190/garagesale/internal/platform/database/databasetest"
+	"github.com/wgarcia4190/garagesale/internal/platform/notify"
+	"github.com/wgarcia4190/garagesale/internal/platform/seal"
+	"github.com/wgarcia4190/garagesale/internal/platform/totp"
+	"github.com/wgarcia4190/garagesale/internal/schema"
+	"github.com/wgarcia4190/garagesale/internal/user"
+)
+
+// gopher gives a new user holding the role, named like the users of the seed
+// data. Admins are "Admin Gopher" and everyone else is "User Gopher".
+func gopher(role string) user.NewUser {
+	name := "User Gopher"
+	if role == auth.RoleAdmin {
+		name = "Admin Gopher"
+	}
+
+	return user.NewUser{
+		Name:            name,
+		Email:           strings.ToLower(role) + "@example.com",
+		Roles:           []string{role},
+		Password:        "gophers",
+		PasswordConfirm: "gophers",
+	}
+}
+
+func TestUser(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	nu := gopher(auth.RoleUser)
+
+	u, err := user.Create(ctx, db, nu, now)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	if _, err := user.Create(ctx, db, nu, now); err != user.ErrDuplicateEmail {
+		t.Fatalf("expected %v creating a user with the same email, got %v", user.ErrDuplicateEmail, err)
+	}
+
+	self := auth.NewClaims(u.ID, u.Roles, now, time.Hour)
+	other := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleUser}, now, time.Hour)
+	admin := auth.NewClaims("718ffbea-f4a1-4667-8ae3-b349da52675e", []string{auth.RoleAdmin}, now, time.Hour)
+
+	if _, err := user.Retrieve(ctx, db, other, u.ID); err != user.ErrForbidden {
+		t.Fatalf("expected %v retrieving another user, got %v", user.ErrForbidden, err)
+	}
+
+	// Managing users is up to the permissions of the roles, not their names.
+	manager := other
+	manager.Permissions = []string{auth.PermUsersManage}
+	if _, err := user.Retrieve(ctx, db, manager, u.ID); err != nil {
+		t.Fatalf("retrieving another user with %s: %v", auth.PermUsersManage, err)
+	}
+	revoked := admin
+	revoked.Permissions = []string{auth.PermProductsWrite}
+	if _, err := user.Retrieve(ctx, db, revoked, u.ID); err != user.ErrForbidden {
+		t.Fatalf("expected %v retrieving another user without %s, got %v", user.ErrForbidden, auth.PermUsersManage, err)
+	}
+
+	name := "Renamed Gopher"
+	if err := user.Update(ctx, db, self, u.ID, user.UpdateUser{Name: &name}, now); err != nil {
+		t.Fatalf("updating own name: %v", err)
+	}
+
+	upd := user.UpdateUser{Roles: []string{auth.RoleAdmin}}
+	if err := user.Update(ctx, db, self, u.ID, upd, now); err != user.ErrForbidden {
+		t.Fatalf("expected %v granting own roles, got %v", user.ErrForbidden, err)
+	}
+	if err := user.Update(ctx, db, admin, u.ID, upd, now); err != nil {
+		t.Fatalf("updating roles as admin: %v", err)
+	}
+
+	saved, err := user.Retrieve(ctx, db, self, u.ID)
+	if err != nil {
+		t.Fatalf("retrieving user: %v", err)
+	}
+	if saved.Name != name || len(saved.Roles) != 1 || saved.Roles[0] != auth.RoleAdmin {
+		t.Fatalf("expected updated name and roles, got %q and %v", saved.Name, saved.Roles)
+	}
+
+	demote := user.UpdateUser{Roles: []string{auth.RoleUser}}
+	if err := user.Update(ctx, db, admin, u.ID, demote, now); err != user.ErrLastAdmin {
+		t.Fatalf("expected %v demoting the last admin, got %v", user.ErrLastAdmin, err)
+	}
+
+	if err := user.Delete(ctx, db, self, u.ID); err != user.ErrDeleteSelf {
+		t.Fatalf("expected %v deleting oneself, got %v", user.ErrDeleteSelf, err)
+	}
+	if err := user.Delete(ctx, db, admin, u.ID); err != user.ErrLastAdmin {
+		t.Fatalf("expected %v deleting the last admin, got %v", user.ErrLastAdmin, err)
+	}
+
+	if _, err := user.Create(ctx, db, gopher(auth.RoleAdmin), now); err != nil {
+		t.Fatalf("creating another admin: %v", err)
+	}
+	if err := user.Delete(ctx, db, admin, u.ID); err != nil {
+		t.Fatalf("deleting user: %v", err)
+	}
+	if _, err := user.Retrieve(ctx, db, admin, u.ID); err != user.ErrNotFound {
+		t.Fatalf("expected %v after deleting, got %v", user.ErrNotFound, err)
+	}
+}
+
+// outbox keeps the messages sent to it.
+type outbox []notify.Message
+
+func (o *outbox) Send(ctx context.Context, m notify.Message) error {
+	*o = append(*o, m)
+	return nil
+}
+
+func TestPassword(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	nu := gopher(auth.RoleUser)
+
+	u, err := user.Create(ctx, db, nu, now)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	cfg := user.SessionConfig{AccessTTL: time.Minute, RefreshTTL: time.Hour}
+	claims, refresh, err := user.StartSession(ctx, db, u, cfg, now)
+	if err != nil {
+		t.Fatalf("starting session: %v", err)
+	}
+
+	cp := user.PasswordChange{Current: "wrong", Password: "gophers2", PasswordConfirm: "gophers2"}
+	if _, err := user.ChangePassword(ctx, db, user.LockoutConfig{}, claims, u.ID, cp, "", now); err != user.ErrAuthenticationFailure {
+		t.Fatalf("expected %v with the wrong current password, got %v", user.ErrAuthenticationFailure, err)
+	}
+
+	// Wrong guesses count toward the lockout like failed logins.
+	lc := user.LockoutConfig{Threshold: 1, Delay: time.Minute, MaxDelay: time.Minute, Window: time.Hour}
+	if _, err := user.ChangePassword(ctx, db, lc, claims, u.ID, cp, "10.0.0.1", now); err != user.ErrAuthenticationFailure {
+		t.Fatalf("expected %v with the wrong current password, got %v", user.ErrAuthenticationFailure, err)
+	}
+	if _, err := user.ChangePassword(ctx, db, lc, claims, u.ID, cp, "10.0.0.1", now); err == nil {
+		t.Fatal("expected the password change to be locked")
+	} else if _, ok := err.(*user.LockedError); !ok {
+		t.Fatalf("expected a *user.LockedError, got %v", err)
+	}
+
+	cp.Current = "gophers"
+	revoked, err := user.ChangePassword(ctx, db, user.LockoutConfig{}, claims, u.ID, cp, "", now)
+	if err != nil {
+		t.Fatalf("changing password: %v", err)
+	}
+	if len(revoked) != 1 || revoked[0].ID != claims.Session {
+		t.Fatalf("expected session %s to be revoked, got %v", claims.Session, revoked)
+	}
+
+	// Sessions started with the old password can not be used anymore.
+	if _, _, err := user.RefreshSession(ctx, db, refresh, cfg, now); err != user.ErrInvalidRefreshToken {
+		t.Fatalf("expected %v refreshing a session after a password change, got %v", user.ErrInvalidRefreshToken, err)
+	}
+	if _, err := user.Authenticate(ctx, db, user.LockoutConfig{}, now, nu.Email, "gophers2", ""); err != nil {
+		t.Fatalf("authenticating with the new password: %v", err)
+	}
+
+	var sent outbox
+	if err := user.RequestReset(ctx, db, &sent, "nobody@example.com", now); err != nil || len(sent) != 0 {
+		t.Fatalf("expected nothing sent for an unknown email, got %d messages and %v", len(sent), err)
+	}
+	if err := user.RequestReset(ctx, db, &sent, nu.Email, now); err != nil {
+		t.Fatalf("requesting reset: %v", err)
+	}
+	if len(sent) != 1 {
+		t.Fatalf("expected one message, got %d", len(sent))
+	}
+
+	// The token is the paragraph of the message on a line of its own.
+	lines := strings.Split(sent[0].Body, "\n")
+	token := lines[2]
+
+	pr := user.PasswordReset{Token: token, Password: "gophers3", PasswordConfirm: "gophers3"}
+	if _, err := user.ResetPassword(ctx, db, pr, now.Add(2*user.ResetTTL)); err != user.ErrInvalidResetToken {
+		t.Fatalf("expected %v for an expired token, got %v", user.ErrInvalidResetToken, err)
+	}
+	if _, err := user.ResetPassword(ctx, db, pr, now); err != nil {
+		t.Fatalf("resetting password: %v", err)
+	}
+	if _, err := user.ResetPassword(ctx, db, pr, now); err != user.ErrInvalidResetToken {
+		t.Fatalf("expected %v for a used token, got %v", user.ErrInvalidResetToken, err)
+	}
+	if _, err := user.Authenticate(ctx, db, user.LockoutConfig{}, now, nu.Email, "gophers3", ""); err != nil {
+		t.Fatalf("authenticating with the reset password: %v", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now()
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := user.Authenticate(ctx, db, user.LockoutConfig{}, now, "admin@example.com", "gophers", "")
+	if err != nil {
+		t.Fatalf("authenticating: %v", err)
+	}
+
+	cfg := user.SessionConfig{AccessTTL: time.Minute, RefreshTTL: time.Hour}
+
+	first, refresh, err := user.StartSession(ctx, db, u, cfg, now)
+	if err != nil {
+		t.Fatalf("starting session: %v", err)
+	}
+	if first.Session == "" || first.Id == "" {
+		t.Fatal("expected the claims to carry a session and token id")
+	}
+
+	second, rotated, err := user.RefreshSession(ctx, db, refresh, cfg, now)
+	if err != nil {
+		t.Fatalf("refreshing session: %v", err)
+	}
+	if second.Session != first.Session || second.Id == first.Id {
+		t.Fatal("expected a new token for the same session")
+	}
+
+	if _, _, err := user.RefreshSession(ctx, db, refresh, cfg, now); err != user.ErrInvalidRefreshToken {
+		t.Fatalf("expected %v reusing a rotated token, got %v", user.ErrInvalidRefreshToken, err)
+	}
+
+	denyList := user.NewDenyList(db, 0)
+
+	if revoked, err := denyList.Revoked(ctx, first); err != nil || revoked {
+		t.Fatalf("expected the token to be valid before logging out, got %t and %v", revoked, err)
+	}
+
+	if _, _, err := user.EndSession(ctx, db, second, now); err != nil {
+		t.Fatalf("ending session: %v", err)
+	}
+
+	// Every token issued for the session is revoked, not just the one used.
+	if revoked, err := denyList.Revoked(ctx, first); err != nil || !revoked {
+		t.Fatalf("expected the token to be revoked after logging out, got %t and %v", revoked, err)
+	}
+	if _, _, err := user.RefreshSession(ctx, db, rotated, cfg, now); err != user.ErrInvalidRefreshToken {
+		t.Fatalf("expected %v refreshing an ended session, got %v", user.ErrInvalidRefreshToken, err)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Now().Truncate(time.Second)
+
+	if err := schema.Seed(db); err != nil {
+		t.Fatal(err)
+	}
+
+	lc := user.LockoutConfig{Threshold: 3, Delay: time.Minute, MaxDelay: 10 * time.Minute, Window: time.Hour}
+	const email, ip = "admin@example.com", "10.0.0.1"
+
+	for i := 0; i < lc.Threshold; i++ {
+		if _, err := user.Authenticate(ctx, db, lc, now, email, "wrong", ip); err != user.ErrAuthenticationFailure {
+			t.Fatalf("attempt %d: expected %v, got %v", i+1, user.ErrAuthenticationFailure, err)
+		}
+	}
+
+	// Even the right password is refused while locked.
+	_, err := user.Authenticate(ctx, db, lc, now, email, "gophers", "10.0.0.2")
+	lerr, ok := err.(*user.LockedError)
+	if !ok {
+		t.Fatalf("expected a *user.LockedError, got %v", err)
+	}
+	if lerr.RetryAfter != lc.Delay {
+		t.Fatalf("expected to retry after %v, got %v", lc.Delay, lerr.RetryAfter)
+	}
+
+	// The ip that made the failures stays locked for other accounts.
+	if _, err := user.Authenticate(ctx, db, lc, now, "user@example.com", "gophers", ip); err == nil {
+		t.Fatal("expected logins from the ip to be locked")
+	}
+
+	if err := user.Unlock(ctx, db, email); err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+	if _, err := user.Authenticate(ctx, db, lc, now, email, "gophers", "10.0.0.2"); err != nil {
+		t.Fatalf("authenticating after unlock: %v", err)
+	}
+
+	// Concurrent guesses can not get more than the threshold of passwords
+	// checked.
+	const guesses = 10
+	errs := make(chan error, guesses)
+	for i := 0; i < guesses; i++ {
+		go func(i int) {
+			_, err := user.Authenticate(ctx, db, lc, now, "user@example.com", "wrong", fmt.Sprintf("10.0.1.%d", i))
+			errs <- err
+		}(i)
+	}
+
+	var checked int
+	for i := 0; i < guesses; i++ {
+		if err := <-errs; err == user.ErrAuthenticationFailure {
+			checked++
+		}
+	}
+	if checked != lc.Threshold {
+		t.Fatalf("expected %d passwords checked, got %d", lc.Threshold, checked)
+	}
+}
+
+func TestMFA(t *testing.T) {
+	db, cleanup := databasetest.Setup(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	now := time.Date(2020, time.September, 1, 0, 0, 0, 0, time.UTC)
+
+	nu := gopher(auth.RoleAdmin)
+	u, err := user.Create(ctx, db, nu, now)
+	if err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+
+	secrets, err := seal.NewBox(make([]byte, seal.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc := user.MFAConfig{Issuer: "garagesale", Secrets: secrets}
+
+	if err := user.CheckPassword(ctx, db, mc.Lockout, u.ID, "wrong", "", now); err != user.ErrAuthenticationFailure {
+		t.Fatalf("expected %v checking the wrong password, got %v", user.ErrAuthenticationFailure, err)
+	}
+	if err := user.CheckPassword(ctx, db, mc.Lockout, u.ID, "gophers", "", now); err != nil {
+		t.Fatalf("checking password: %v", err)
+	}
+
+	e, err := user.Enroll(ctx, db, mc, u.ID, now)
+	if err != nil {
+		t.Fatalf("enrolling: %v", err)
+	}
+
+	var stored string
+	if err := db.GetContext(ctx, &stored, `SELECT secret FROM mfa_enrollments WHERE user_id = $1`, u.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !seal.Sealed(stored) || strings.Contains(stored, e.Secret) {
+		t.Fatalf("expected the secret to be stored sealed, got %q", stored)
+	}
+	if enabled, err := user.MFAEnabled(ctx, db, u.ID); err != nil || enabled {
+		t.Fatalf("expected two-factor to be off until confirmed, got %t and %v", enabled, err)
+	}
+
+	code, err := totp.Code(e.Secret, totp.Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := user.ConfirmMFA(ctx, db, mc, u.ID, "000000", "", now); err != user.ErrInvalidMFACode {
+		t.Fatalf("expected %v confirming with a wrong code, got %v", user.ErrInvalidMFACode, err)
+	}
+	codes, err := user.ConfirmMFA(ctx, db, mc, u.ID, code, "", now)
+	if err != nil {
+		t.Fatalf("confirming: %v", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %d", len(codes))
+	}
+	if _, err := user.Enroll(ctx, db, mc, u.ID, now); err != user.ErrMFAEnrolled {
+		t.Fatalf("expected %v enrolling twice, got %v", user.ErrMFAEnrolled, err)
+	}
+
+	challenge, _, err := user.StartChallenge(ctx, db, u.ID, now)
+	if err != nil {
+		t.Fatalf("starting challenge: %v", err)
+	}
+
+	// The code used to confirm can not be replayed.
+	if _, _, err := user.CompleteChallenge(ctx, db, mc, challenge, code, "", now); err != user.ErrInvalidMFACode {
+		t.Fatalf("expected %v replaying a code, got %v", user.ErrInvalidMFACode, err)
+	}
+
+	usr, _, err := user.CompleteChallenge(ctx, db, mc, challenge, strings.ToUpper(codes[0]), "", now)
+	if err != nil {
+		t.Fatalf("completing challenge with a recovery code: %v", err)
+	}
+	if usr.ID != u.ID {
+		t.Fatalf("expected user %s, got %s", u.ID, usr.ID)
+	}
+	if _, _, err := user.CompleteChallenge(ctx, db, mc, challenge, codes[1], "", now); err != user.ErrInvalidChallenge {
+		t.Fatalf("expected %v reusing a challenge, got %v", user.ErrInvalidChallenge, err)
+	}
+
+	challenge, _, err = user.StartChallenge(ctx, db, u.ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := user.CompleteChallenge(ctx, db, mc, challenge, codes[0], "", now); err != user.ErrInvalidMFACode {
+		t.Fatalf("expected %v reusing a recovery code, got %v", user.ErrInvalidMFACode, err)
+	}
+
+	later := now.Add(totp.Period)
+	next, err := totp.Code(e.Secret, totp.Step(later))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wrong codes count toward the lockout and giving the right password again
+	// does not clear them.
+	mc.Lockout = user.LockoutConfig{Threshold: 2, Delay: time.Minute, MaxDelay: time.Minute, Window: time.Hour}
+	for i := 0; i <= mc.Lockout.Threshold; i++ {
+		ip := fmt.Sprintf("10.0.2.%d", i)
+		if _, err := user.Authenticate(ctx, db, mc.Lockout, now, nu.Email, "gophers", ip); err != nil {
+			t.Fatalf("attempt %d: authenticating: %v", i+1, err)
+		}
+
+		challenge, _, err := user.StartChallenge(ctx, db, u.ID, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, err = user.CompleteChallenge(ctx, db, mc, challenge, "000000", ip, now)
+		if i < mc.Lockout.Threshold {
+			if err != user.ErrInvalidMFACode {
+				t.Fatalf("attempt %d: expected %v, got %v", i+1, user.ErrInvalidMFACode, err)
+			}
+			continue
+		}
+		if _, ok := err.(*user.LockedError); !ok {
+			t.Fatalf("expected a *user.LockedError after %d wrong codes, got %v", mc.Lockout.Threshold, err)
+		}
+	}
+
+	if err := user.Unlock(ctx, db, nu.Email); err != nil {
+		t.Fatalf("unlocking: %v", err)
+	}
+
+	if err := user.DisableMFA(ctx, db, mc, u.ID, next, "", later); err != nil {
+		t.Fatalf("disabling: %v", err)
+	}
+	if enabled, err := user.MFAEnabled(ctx, db, u.ID); err != nil || enabled {
+		t.Fatalf("expected two-factor to be off, got %t and %v", enabled, err)
+	}
+}